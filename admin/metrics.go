@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"zen/backend"
+	"zen/balancer"
+	"zen/handler"
+	"zen/utils/logger"
+)
+
+// handleMetrics writes metrics in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+
+	writeRuntimeMetrics(out)
+	writeRetryMetrics(out)
+	writeAccessControlMetrics(out)
+	s.writeHealthCheckMetrics(out)
+	s.writeSelectionMetrics(out)
+	s.writePoolMetrics(out)
+
+	if err := out.Flush(); err != nil {
+		logger.Debug("Failed to write metrics: %s", err)
+	}
+}
+
+// writeRuntimeMetrics writes the saturation gauges. Every relayed connection
+// holds two goroutines and two file descriptors, so both should track
+// zen_active_connections; drifting apart from it points at a leak.
+func writeRuntimeMetrics(out *bufio.Writer) {
+	fmt.Fprintln(out, "# HELP zen_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(out, "# TYPE zen_goroutines gauge")
+	fmt.Fprintf(out, "zen_goroutines %d\n", runtime.NumGoroutine())
+
+	fmt.Fprintln(out, "# HELP zen_active_connections Number of client connections and HTTP requests currently being handled.")
+	fmt.Fprintln(out, "# TYPE zen_active_connections gauge")
+	fmt.Fprintf(out, "zen_active_connections %d\n", handler.ActiveConnectionCount())
+
+	// Only available where /proc is, i.e. on Linux.
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		fmt.Fprintln(out, "# HELP zen_open_fds Number of open file descriptors.")
+		fmt.Fprintln(out, "# TYPE zen_open_fds gauge")
+		fmt.Fprintf(out, "zen_open_fds %d\n", len(fds))
+	}
+}
+
+// writeRetryMetrics writes the connect phase counters. Successes are labeled
+// with the number of retries they took, so retries="0" are first attempts.
+func writeRetryMetrics(out *bufio.Writer) {
+	m := handler.GetRetryMetrics()
+
+	fmt.Fprintln(out, "# HELP zen_connect_retries_total Backend connect attempts after the first one of a client.")
+	fmt.Fprintln(out, "# TYPE zen_connect_retries_total counter")
+	fmt.Fprintf(out, "zen_connect_retries_total %d\n", m.Retries)
+
+	fmt.Fprintln(out, "# HELP zen_connect_failures_total Failed backend connect attempts by backend.")
+	fmt.Fprintln(out, "# TYPE zen_connect_failures_total counter")
+	addresses := make([]string, 0, len(m.Failures))
+	for address := range m.Failures {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		fmt.Fprintf(out, "zen_connect_failures_total{backend=%q} %d\n", address, m.Failures[address])
+	}
+
+	fmt.Fprintln(out, "# HELP zen_connect_successes_total Clients connected to a backend, by retries needed.")
+	fmt.Fprintln(out, "# TYPE zen_connect_successes_total counter")
+	retries := make([]int, 0, len(m.Successes))
+	for n := range m.Successes {
+		retries = append(retries, n)
+	}
+	sort.Ints(retries)
+	for _, n := range retries {
+		fmt.Fprintf(out, "zen_connect_successes_total{retries=\"%d\"} %d\n", n, m.Successes[n])
+	}
+
+	fmt.Fprintln(out, "# HELP zen_connect_exhausted_total Clients that could not be connected to any backend.")
+	fmt.Fprintln(out, "# TYPE zen_connect_exhausted_total counter")
+	fmt.Fprintf(out, "zen_connect_exhausted_total %d\n", m.Exhausted)
+}
+
+func writeAccessControlMetrics(out *bufio.Writer) {
+	fmt.Fprintln(out, "# HELP zen_connections_denied_total Client connections and HTTP requests refused by access_control.")
+	fmt.Fprintln(out, "# TYPE zen_connections_denied_total counter")
+	fmt.Fprintf(out, "zen_connections_denied_total %d\n", handler.DeniedConnectionCount())
+}
+
+func (s *Server) writeHealthCheckMetrics(out *bufio.Writer) {
+	fmt.Fprintln(out, "# HELP zen_health_check_duration_seconds Duration of health checks per backend.")
+	fmt.Fprintln(out, "# TYPE zen_health_check_duration_seconds histogram")
+	s.eachHealthCheck(func(labels string, m backend.HealthCheckMetrics) {
+		var cumulative uint64
+		for i, bound := range backend.HealthCheckBuckets {
+			cumulative += m.BucketCounts[i]
+			fmt.Fprintf(out, "zen_health_check_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(out, "zen_health_check_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, m.Checks)
+		fmt.Fprintf(out, "zen_health_check_duration_seconds_sum{%s} %g\n", labels, m.TotalDuration.Seconds())
+		fmt.Fprintf(out, "zen_health_check_duration_seconds_count{%s} %d\n", labels, m.Checks)
+	})
+
+	fmt.Fprintln(out, "# HELP zen_health_check_failures_total Failed health checks per backend by reason.")
+	fmt.Fprintln(out, "# TYPE zen_health_check_failures_total counter")
+	s.eachHealthCheck(func(labels string, m backend.HealthCheckMetrics) {
+		for _, reason := range []string{
+			backend.FailureConnectionRefused,
+			backend.FailureTimeout,
+			backend.FailureNetworkUnreachable,
+			backend.FailureOther,
+		} {
+			fmt.Fprintf(out, "zen_health_check_failures_total{%s,reason=%q} %d\n", labels, reason, m.Failures[reason])
+		}
+	})
+
+	fmt.Fprintln(out, "# HELP zen_health_check_flaps_total Times a backend was held down for flapping.")
+	fmt.Fprintln(out, "# TYPE zen_health_check_flaps_total counter")
+	s.eachHealthCheck(func(labels string, m backend.HealthCheckMetrics) {
+		fmt.Fprintf(out, "zen_health_check_flaps_total{%s} %d\n", labels, m.Flaps)
+	})
+
+	fmt.Fprintln(out, "# HELP zen_backend_health_score Health score scaling a backend's weight, from 0 to 1.")
+	fmt.Fprintln(out, "# TYPE zen_backend_health_score gauge")
+	s.eachHealthCheck(func(labels string, m backend.HealthCheckMetrics) {
+		fmt.Fprintf(out, "zen_backend_health_score{%s} %g\n", labels, m.HealthScore)
+	})
+}
+
+// writeSelectionMetrics writes how often each group's balancer picked each
+// backend. Comparing the rates across a group shows whether it is balanced.
+func (s *Server) writeSelectionMetrics(out *bufio.Writer) {
+	fmt.Fprintln(out, "# HELP zen_balancer_selections_total Times the balancer selected a backend.")
+	fmt.Fprintln(out, "# TYPE zen_balancer_selections_total counter")
+	for _, group := range s.groups {
+		statsBalancer, ok := group.Balancer.(balancer.StatsBalancer)
+		if !ok {
+			continue
+		}
+
+		stats := statsBalancer.Stats()
+		addresses := make([]string, 0, len(stats))
+		for address := range stats {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+
+		for _, address := range addresses {
+			fmt.Fprintf(out, "zen_balancer_selections_total{group=%q,backend=%q} %d\n", group.Name, address, stats[address])
+		}
+	}
+}
+
+// writePoolMetrics writes how callers of each backend's connection pool were
+// served. A low share of reused connections means max_idle is too small or
+// connections are being closed instead of returned.
+func (s *Server) writePoolMetrics(out *bufio.Writer) {
+	fmt.Fprintln(out, "# HELP zen_pool_gets_total Connections handed out by a backend's pool, reused from idle or freshly dialed.")
+	fmt.Fprintln(out, "# TYPE zen_pool_gets_total counter")
+	for _, group := range s.groups {
+		for _, stats := range group.Pool.Stats() {
+			fmt.Fprintf(out, "zen_pool_gets_total{group=%q,backend=%q,result=\"reused\"} %d\n", group.Name, stats.Address, stats.TotalReuses)
+			fmt.Fprintf(out, "zen_pool_gets_total{group=%q,backend=%q,result=\"dialed\"} %d\n", group.Name, stats.Address, stats.Misses())
+		}
+	}
+
+	fmt.Fprintln(out, "# HELP zen_pool_prewarm_dials_total Connections dialed to keep min_idle connections ready.")
+	fmt.Fprintln(out, "# TYPE zen_pool_prewarm_dials_total counter")
+	for _, group := range s.groups {
+		for _, stats := range group.Pool.Stats() {
+			fmt.Fprintf(out, "zen_pool_prewarm_dials_total{group=%q,backend=%q} %d\n", group.Name, stats.Address, stats.PrewarmDials)
+		}
+	}
+}
+
+// eachHealthCheck calls fn for every backend of every group with health
+// checking enabled, in a stable order, with its group and backend labels.
+func (s *Server) eachHealthCheck(fn func(labels string, m backend.HealthCheckMetrics)) {
+	for _, group := range s.groups {
+		if group.HealthChecker == nil {
+			continue
+		}
+
+		metrics := group.HealthChecker.Metrics()
+		addresses := make([]string, 0, len(metrics))
+		for address := range metrics {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+
+		for _, address := range addresses {
+			fn(fmt.Sprintf("group=%q,backend=%q", group.Name, address), metrics[address])
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+	"zen/config"
+	"zen/handler"
+	"zen/utils/logger"
+	"zen/utils/recovery"
+	"zen/utils/version"
+)
+
+// Group is an upstream group the admin server reports on. HealthChecker is
+// nil when health checking is disabled.
+type Group struct {
+	Name          string
+	Pool          *backend.Pool
+	HealthChecker *backend.HealthChecker
+	Balancer      balancer.LoadBalancer
+}
+
+type Server struct {
+	httpServer *http.Server
+	groups     []Group
+	config     atomic.Pointer[config.Config]
+}
+
+func NewServer(address string, groups []Group, cfg *config.Config) *Server {
+	s := &Server{groups: groups}
+	s.config.Store(cfg)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/backends", s.handleBackends)
+	mux.HandleFunc("/backends/", s.handleBackendDrain)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/pools", s.handlePools)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.HandleFunc("/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/maintenance/on", s.handleMaintenanceToggle(true))
+	mux.HandleFunc("/maintenance/off", s.handleMaintenanceToggle(false))
+	mux.HandleFunc("/drain", s.handleDrain)
+
+	s.httpServer = &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// SetConfig replaces the configuration /config reports, after a reload has
+// applied part of a new one.
+func (s *Server) SetConfig(cfg *config.Config) {
+	s.config.Store(cfg)
+}
+
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Admin server stopped: %s", err)
+		}
+	}()
+
+	logger.Info("Admin server listening on %s", s.httpServer.Addr)
+	return nil
+}
+
+func (s *Server) Stop() {
+	s.httpServer.Close()
+	logger.Info("Admin server stopped")
+}
+
+type healthResponse struct {
+	Status        string `json:"status"`
+	AliveBackends int    `json:"alive_backends"`
+	TotalBackends int    `json:"total_backends"`
+	Panics        uint64 `json:"recovered_panics"`
+}
+
+// handleHealthz reports 200 while every upstream group has at least one alive backend.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	response, healthy := s.backendHealth()
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleReadyz additionally requires the first health check pass of every
+// group to have completed.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	response, healthy := s.backendHealth()
+	if handler.Draining() {
+		response.Status = "draining"
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+	if !healthy {
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	for _, group := range s.groups {
+		if group.HealthChecker != nil && !group.HealthChecker.FirstCheckCompleted() {
+			response.Status = "waiting for first health check"
+			writeJSON(w, http.StatusServiceUnavailable, response)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+type backendsResponse struct {
+	Backends []*backend.Backend                `json:"backends"`
+	Health   map[string]*backend.BackendHealth `json:"health,omitempty"`
+
+	// Selections counts how often the balancer handed out each backend.
+	Selections map[string]uint64 `json:"selections,omitempty"`
+}
+
+// handleBackends lists every upstream group with its backends and, when
+// health checking is enabled, the checker's view of each of them. Balancers
+// that keep selection counts add them too.
+func (s *Server) handleBackends(w http.ResponseWriter, r *http.Request) {
+	response := make([]backendsResponse, 0, len(s.groups))
+	for _, group := range s.groups {
+		entry := backendsResponse{Backends: group.Pool.GetAllBackends()}
+		if group.HealthChecker != nil {
+			entry.Health = group.HealthChecker.GetHealthStatus()
+		}
+		if stats, ok := group.Balancer.(balancer.StatsBalancer); ok {
+			entry.Selections = stats.Stats()
+		}
+		response = append(response, entry)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleConnections lists the live relayed connections with how long each
+// has gone without moving data.
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, handler.ActiveConnections())
+}
+
+type poolResponse struct {
+	Address          string  `json:"address"`
+	Idle             int     `json:"idle"`
+	Active           int     `json:"active"`
+	MaxActive        int     `json:"max_active"`
+	TotalDials       uint64  `json:"total_dials"`
+	TotalReuses      uint64  `json:"total_reuses"`
+	PrewarmDials     uint64  `json:"prewarm_dials"`
+	ReuseRatio       float64 `json:"reuse_ratio"`
+	ExhaustionEvents uint64  `json:"exhaustion_events"`
+	QueueDepth       int     `json:"queue_depth"`
+	MaxQueue         int     `json:"max_queue"`
+	TotalQueued      uint64  `json:"total_queued"`
+	AvgQueueWait     string  `json:"avg_queue_wait"`
+}
+
+// handlePools reports the connection pool of every backend, one list per
+// upstream group, including how many callers are queued for a connection.
+func (s *Server) handlePools(w http.ResponseWriter, r *http.Request) {
+	response := make([][]poolResponse, 0, len(s.groups))
+	for _, group := range s.groups {
+		pools := make([]poolResponse, 0)
+		for _, stats := range group.Pool.Stats() {
+			var avgWait time.Duration
+			if stats.TotalQueued > 0 {
+				avgWait = stats.QueueWaitTotal / time.Duration(stats.TotalQueued)
+			}
+
+			pools = append(pools, poolResponse{
+				Address:          stats.Address,
+				Idle:             stats.Idle,
+				Active:           stats.Active,
+				MaxActive:        stats.MaxActive,
+				TotalDials:       stats.TotalDials,
+				TotalReuses:      stats.TotalReuses,
+				PrewarmDials:     stats.PrewarmDials,
+				ReuseRatio:       stats.ReuseRatio(),
+				ExhaustionEvents: stats.ExhaustionEvents,
+				QueueDepth:       stats.QueueDepth,
+				MaxQueue:         stats.MaxQueue,
+				TotalQueued:      stats.TotalQueued,
+				AvgQueueWait:     avgWait.String(),
+			})
+		}
+		response = append(response, pools)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleConfig returns the effective configuration, defaults included and
+// secrets redacted.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	redacted, err := s.config.Load().Redacted()
+	if err != nil {
+		logger.Error("Failed to render configuration: %s", err)
+		http.Error(w, "failed to render configuration", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+// handleVersion returns the version and build details of the running binary.
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version.Get())
+}
+
+type maintenanceResponse struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, maintenanceResponse{Maintenance: handler.InMaintenance()})
+}
+
+func (s *Server) handleMaintenanceToggle(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler.SetMaintenance(enabled)
+		writeJSON(w, http.StatusOK, maintenanceResponse{Maintenance: handler.InMaintenance()})
+	}
+}
+
+type drainResponse struct {
+	Draining            bool `json:"draining"`
+	RefusingConnections bool `json:"refusing_connections"`
+	ActiveConnections   int  `json:"active_connections"`
+}
+
+// handleDrain starts a drain on POST. Any method reports the drain progress,
+// so a preStop hook can poll until active_connections reaches zero.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handler.StartDrain(s.config.Load().Server.DrainGracePeriod)
+	}
+
+	writeJSON(w, http.StatusOK, drainResponse{
+		Draining:            handler.Draining(),
+		RefusingConnections: handler.RefusingConnections(),
+		ActiveConnections:   handler.ActiveConnectionCount(),
+	})
+}
+
+type backendDrainResponse struct {
+	Address           string `json:"address"`
+	Draining          bool   `json:"draining"`
+	ActiveConnections int64  `json:"active_connections"`
+}
+
+// handleBackendDrain serves /backends/{address}/drain and /undrain. POST to
+// drain stops new connections to the backend in every group it belongs to
+// while its active ones finish; POST to undrain lets them in again. Any
+// method on drain reports the progress, so a deploy script can poll until
+// active_connections reaches zero before taking the backend down.
+func (s *Server) handleBackendDrain(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/backends/")
+	address, action, found := strings.Cut(path, "/")
+	if !found || address == "" || (action != "drain" && action != "undrain") {
+		http.NotFound(w, r)
+		return
+	}
+	if action == "undrain" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := backendDrainResponse{Address: address}
+	matched := false
+	for _, group := range s.groups {
+		var err error
+		switch {
+		case r.Method != http.MethodPost:
+		case action == "drain":
+			err = group.Pool.DrainBackend(address)
+		default:
+			err = group.Pool.UndrainBackend(address)
+		}
+		if errors.Is(err, backend.ErrBackendNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		for _, b := range group.Pool.GetAllBackends() {
+			if b.Address == address {
+				matched = true
+				response.Draining = response.Draining || b.IsDraining()
+				response.ActiveConnections += b.ActiveConnections()
+			}
+		}
+	}
+
+	if !matched {
+		http.Error(w, "backend not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) backendHealth() (healthResponse, bool) {
+	response := healthResponse{Status: "ok", Panics: recovery.Count()}
+	healthy := true
+
+	for _, group := range s.groups {
+		total, alive := group.Pool.GetBackendCount()
+		response.TotalBackends += total
+		response.AliveBackends += alive
+		if alive == 0 {
+			healthy = false
+		}
+	}
+
+	if !healthy {
+		response.Status = "no alive backends"
+	}
+	return response, healthy
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Debug("Failed to write admin response: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+	"zen/config"
+)
+
+// newTestServer returns an admin server reporting on one group of
+// addresses, which are never dialed.
+func newTestServer(t *testing.T, addresses ...string) (*Server, *backend.Pool) {
+	t.Helper()
+
+	upstreams := make([]backend.Upstream, 0, len(addresses))
+	for _, address := range addresses {
+		upstreams = append(upstreams, backend.Upstream{Address: address, Weight: 1})
+	}
+	pool := backend.NewBackendPool(upstreams, nil)
+	t.Cleanup(pool.Close)
+
+	groups := []Group{{Name: "default", Pool: pool, Balancer: balancer.NewRoundRobin(pool)}}
+	return NewServer("127.0.0.1:0", groups, &config.Config{}), pool
+}
+
+func serve(s *Server, method, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func decodeDrain(t *testing.T, recorder *httptest.ResponseRecorder) backendDrainResponse {
+	t.Helper()
+
+	var response backendDrainResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("decode response: %s", err)
+	}
+	return response
+}
+
+func TestBackendDrain(t *testing.T) {
+	s, pool := newTestServer(t, "127.0.0.1:10001", "127.0.0.1:10002")
+
+	recorder := serve(s, http.MethodPost, "/backends/127.0.0.1:10001/drain")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("POST drain: status %d: %s", recorder.Code, recorder.Body)
+	}
+	if response := decodeDrain(t, recorder); !response.Draining || response.Address != "127.0.0.1:10001" {
+		t.Fatalf("POST drain: got %+v", response)
+	}
+
+	alive := pool.GetAliveBackends()
+	if len(alive) != 1 || alive[0].Address != "127.0.0.1:10002" {
+		t.Fatalf("balancer still sees %v after the drain", alive)
+	}
+
+	recorder = serve(s, http.MethodGet, "/backends/127.0.0.1:10001/drain")
+	if response := decodeDrain(t, recorder); !response.Draining || response.ActiveConnections != 0 {
+		t.Fatalf("GET drain: got %+v", response)
+	}
+
+	recorder = serve(s, http.MethodPost, "/backends/127.0.0.1:10001/undrain")
+	if response := decodeDrain(t, recorder); response.Draining {
+		t.Fatalf("POST undrain: got %+v", response)
+	}
+	if alive := pool.GetAliveBackends(); len(alive) != 2 {
+		t.Fatalf("%d backends available after the undrain, want 2", len(alive))
+	}
+}
+
+func TestBackendDrainGetDoesNotDrain(t *testing.T) {
+	s, pool := newTestServer(t, "127.0.0.1:10001")
+
+	recorder := serve(s, http.MethodGet, "/backends/127.0.0.1:10001/drain")
+	if response := decodeDrain(t, recorder); response.Draining {
+		t.Fatalf("GET drain: got %+v", response)
+	}
+	if len(pool.GetAliveBackends()) != 1 {
+		t.Fatal("GET drained the backend")
+	}
+}
+
+func TestBackendDrainErrors(t *testing.T) {
+	s, _ := newTestServer(t, "127.0.0.1:10001")
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodPost, "/backends/127.0.0.1:9999/drain", http.StatusNotFound},
+		{http.MethodPost, "/backends/127.0.0.1:10001/restart", http.StatusNotFound},
+		{http.MethodPost, "/backends/127.0.0.1:10001", http.StatusNotFound},
+		{http.MethodGet, "/backends/127.0.0.1:10001/undrain", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		if recorder := serve(s, test.method, test.path); recorder.Code != test.want {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestConfigReportsReloadedSettings(t *testing.T) {
+	s, _ := newTestServer(t, "127.0.0.1:10001")
+	s.SetConfig(&config.Config{HealthCheck: &config.HealthCheck{Enabled: true, Interval: 5 * time.Second}})
+
+	recorder := serve(s, http.MethodGet, "/config")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+	}
+	var response struct {
+		HealthCheck struct {
+			Interval string `json:"interval"`
+		} `json:"health_check"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("decode response: %s", err)
+	}
+	if response.HealthCheck.Interval != "5s" {
+		t.Fatalf("interval %q after SetConfig, want 5s", response.HealthCheck.Interval)
+	}
+}
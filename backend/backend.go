@@ -1,11 +1,39 @@
 package backend
 
-import "sync/atomic"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream describes a configured backend before it is turned into a Backend.
+type Upstream struct {
+	Address       string
+	HealthAddress string // where health checks go, empty for Address
+	Weight        int
+	Priority      int // lower tiers are preferred, see Pool.refreshAliveBackends
+
+	// ServerName is the hostname an upstream resolved by DNS was configured
+	// with, for TLS verification against the resolved IP in Address.
+	ServerName string
+}
 
 type Backend struct {
 	Address        string
+	HealthAddress  string // health checks probe this address instead of Address
 	ConnectionPool *ConnectionPool
+	Weight         int
+	Priority       int
 	alive          atomic.Bool
+	draining       atomic.Bool
+	recoveredAt    atomic.Int64  // unix nanos of the last dead -> alive transition
+	active         atomic.Int64  // client connections currently relayed to this backend
+	exhaustions    atomic.Int32  // consecutive ErrPoolExhausted results
+	cooldownUntil  atomic.Int64  // unix nanos until which the backend is deprioritized
+	degradation    atomic.Uint64 // math.Float64bits of 1 - health score, so the zero value is healthy
+	removingSince  atomic.Int64  // unix nanos a pending removal started, 0 when none
 }
 
 func (b *Backend) IsAlive() bool {
@@ -20,11 +48,146 @@ func (b *Backend) CompareAndSetAlive(oldValue, newValue bool) bool {
 	return b.alive.CompareAndSwap(oldValue, newValue)
 }
 
-func NewBackend(address string) *Backend {
-	connPool := NewConnectionPool(address, 10, 100, 30)
+// IsDraining reports whether the backend is refusing new connections while
+// its existing ones finish.
+func (b *Backend) IsDraining() bool {
+	return b.draining.Load()
+}
+
+func (b *Backend) SetDraining(draining bool) {
+	b.draining.Store(draining)
+}
+
+// RemovalPending reports whether the backend is draining on its way out of
+// the pool.
+func (b *Backend) RemovalPending() bool {
+	return b.removingSince.Load() != 0
+}
+
+// IsAvailable reports whether the backend may receive new connections.
+func (b *Backend) IsAvailable() bool {
+	return b.IsAlive() && !b.IsDraining()
+}
+
+// IncrementActive records a client connection being relayed to the backend.
+func (b *Backend) IncrementActive() {
+	b.active.Add(1)
+}
+
+// DecrementActive records a relayed client connection having finished.
+func (b *Backend) DecrementActive() {
+	b.active.Add(-1)
+}
+
+func (b *Backend) ActiveConnections() int64 {
+	return b.active.Load()
+}
+
+// RecordExhaustion counts a connection attempt that failed because the
+// backend's pool was exhausted. After threshold consecutive exhaustions the
+// backend is put in cooldown for the given duration; it reports whether that
+// happened on this call.
+func (b *Backend) RecordExhaustion(threshold int, cooldown time.Duration) bool {
+	if int(b.exhaustions.Add(1)) < threshold {
+		return false
+	}
+
+	b.exhaustions.Store(0)
+	b.cooldownUntil.Store(time.Now().Add(cooldown).UnixNano())
+	return true
+}
+
+// ResetExhaustion clears the exhaustion count after a successful checkout.
+func (b *Backend) ResetExhaustion() {
+	b.exhaustions.Store(0)
+}
+
+// InCooldown reports whether the backend recently exhausted its pool
+// repeatedly and should be skipped while others are available.
+func (b *Backend) InCooldown() bool {
+	return time.Now().UnixNano() < b.cooldownUntil.Load()
+}
+
+// MarkRecovered records the moment the backend came back from unhealthy so
+// balancers can ramp its traffic up gradually.
+func (b *Backend) MarkRecovered(at time.Time) {
+	b.recoveredAt.Store(at.UnixNano())
+}
+
+// HealthScore returns how well the backend passes its health checks, from 0
+// for failing every recent check to 1 for passing them all in time.
+func (b *Backend) HealthScore() float64 {
+	return 1 - math.Float64frombits(b.degradation.Load())
+}
+
+// SetHealthScore records the score computed by the health checker. It is
+// clamped to [0, 1].
+func (b *Backend) SetHealthScore(score float64) {
+	b.degradation.Store(math.Float64bits(1 - min(max(score, 0), 1)))
+}
+
+// EffectiveWeight returns the weight to balance with: the configured weight
+// scaled by the health score. Within slowStart of a recovery the weight also
+// ramps linearly from 1 up to that value.
+func (b *Backend) EffectiveWeight(slowStart time.Duration) int {
+	weight := max(int(math.Round(float64(max(b.Weight, 1))*b.HealthScore())), 1)
+
+	recoveredAt := b.recoveredAt.Load()
+	if slowStart <= 0 || recoveredAt == 0 {
+		return weight
+	}
+
+	elapsed := time.Since(time.Unix(0, recoveredAt))
+	if elapsed >= slowStart {
+		return weight
+	}
+
+	return max(int(int64(weight)*int64(elapsed)/int64(slowStart)), 1)
+}
+
+func (b *Backend) String() string {
+	return fmt.Sprintf("%s (alive=%t active=%d weight=%d)", b.Address, b.IsAlive(), b.ActiveConnections(), b.Weight)
+}
+
+// MarshalJSON reports a snapshot of the backend's state. The connection pool
+// and atomics are left out on purpose.
+func (b *Backend) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address           string  `json:"address"`
+		HealthAddress     string  `json:"health_address"`
+		Alive             bool    `json:"alive"`
+		Draining          bool    `json:"draining"`
+		RemovalPending    bool    `json:"removal_pending"`
+		ActiveConnections int64   `json:"active_connections"`
+		Weight            int     `json:"weight"`
+		Priority          int     `json:"priority"`
+		HealthScore       float64 `json:"health_score"`
+		EffectiveWeight   int     `json:"effective_weight"`
+	}{
+		Address:           b.Address,
+		HealthAddress:     b.HealthAddress,
+		Alive:             b.IsAlive(),
+		Draining:          b.IsDraining(),
+		RemovalPending:    b.RemovalPending(),
+		ActiveConnections: b.ActiveConnections(),
+		Weight:            b.Weight,
+		Priority:          b.Priority,
+		HealthScore:       b.HealthScore(),
+		EffectiveWeight:   b.EffectiveWeight(0),
+	})
+}
+
+func NewBackend(upstream Upstream, poolSettings *ConnectionPoolSettings) *Backend {
+	connPool := newConnectionPool(upstream.Address, upstream.ServerName, poolSettings)
 	backend := &Backend{
-		Address:        address,
+		Address:        upstream.Address,
+		HealthAddress:  upstream.HealthAddress,
 		ConnectionPool: connPool,
+		Weight:         max(upstream.Weight, 1),
+		Priority:       upstream.Priority,
+	}
+	if backend.HealthAddress == "" {
+		backend.HealthAddress = upstream.Address
 	}
 	backend.alive.Store(true) // Start as alive
 	return backend
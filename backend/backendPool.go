@@ -1,33 +1,58 @@
 package backend
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 	"zen/utils/logger"
+	"zen/utils/recovery"
+)
+
+// removalPollInterval is how often a pending removal checks whether its
+// backend's connections have finished.
+const removalPollInterval = 100 * time.Millisecond
+
+var (
+	ErrBackendNotFound = errors.New("backend not found")
+	ErrBackendExists   = errors.New("backend already exists")
+	ErrBackendRemoving = errors.New("backend is being removed")
 )
 
 type Pool struct {
 	allBackends   []*Backend   // All backends (both alive and dead)
-	aliveBackends atomic.Value // Only alive backends
-	mu            sync.RWMutex // Protects allBackends slice
+	aliveBackends atomic.Value // Only alive backends that are not draining
+	mu            sync.RWMutex // Protects allBackends slice and observers
+	poolSettings  *ConnectionPoolSettings
+	observers     []MembershipObserver
+	serving       int // priority of the tier in aliveBackends, -1 when none is available
+	closed        bool
+	done          chan struct{} // closed by Close to stop pending removals
 }
 
-func NewBackendPool(addresses []string) *Pool {
-	allBps := make([]*Backend, 0, len(addresses))
-	aliveBps := make([]*Backend, 0, len(addresses))
+// MembershipObserver is told about backends added to or removed from a
+// running pool. It is called without the pool lock held.
+type MembershipObserver interface {
+	AddBackend(backend *Backend)
+	RemoveBackend(address string)
+}
 
-	for _, addr := range addresses {
-		backend := NewBackend(addr)
-		allBps = append(allBps, backend)
-		aliveBps = append(aliveBps, backend)
+func NewBackendPool(upstreams []Upstream, poolSettings *ConnectionPoolSettings) *Pool {
+	allBps := make([]*Backend, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		allBps = append(allBps, NewBackend(upstream, poolSettings))
 	}
 
+	aliveBps, serving, _ := servingTier(allBps)
 	aliveValue := atomic.Value{}
 	aliveValue.Store(aliveBps)
 
 	pool := &Pool{
 		allBackends:   allBps,
 		aliveBackends: aliveValue,
+		poolSettings:  poolSettings,
+		serving:       serving,
+		done:          make(chan struct{}),
 	}
 
 	logger.Info("Backend pool created with %d backends", len(allBps))
@@ -65,32 +90,265 @@ func (pool *Pool) updateBackendStatus(address string, alive bool) {
 		return
 	}
 
-	aliveBackends := make([]*Backend, 0, len(pool.allBackends))
+	pool.refreshAliveBackends()
+}
+
+// DrainBackend stops routing new connections to a backend while letting its
+// existing connections finish. The health checker leaves draining backends alone.
+func (pool *Pool) DrainBackend(address string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, backend := range pool.allBackends {
+		if backend.Address == address {
+			backend.SetDraining(true)
+			logger.Info("Backend %s is now DRAINING", address)
+			pool.refreshAliveBackends()
+			return nil
+		}
+	}
+
+	return ErrBackendNotFound
+}
+
+// UndrainBackend routes new connections to a drained backend again, once the
+// health checker considers it alive. A backend draining on its way out of
+// the pool stays draining; AddBackend is what cancels a removal.
+func (pool *Pool) UndrainBackend(address string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
 	for _, backend := range pool.allBackends {
-		if backend.IsAlive() {
-			aliveBackends = append(aliveBackends, backend)
+		if backend.Address != address {
+			continue
+		}
+		if backend.RemovalPending() {
+			return ErrBackendRemoving
 		}
+		if backend.IsDraining() {
+			backend.SetDraining(false)
+			logger.Info("Backend %s is no longer draining", address)
+			pool.refreshAliveBackends()
+		}
+		return nil
 	}
 
+	return ErrBackendNotFound
+}
+
+// AddBackend adds a backend with its own connection pool to a running pool.
+// It starts out alive; the health checker picks it up on its next pass. A
+// backend still draining after RemoveBackend is kept instead, with its
+// removal cancelled.
+func (pool *Pool) AddBackend(upstream Upstream) error {
+	pool.mu.Lock()
+	for _, backend := range pool.allBackends {
+		if backend.Address != upstream.Address {
+			continue
+		}
+		if backend.removingSince.Swap(0) == 0 {
+			pool.mu.Unlock()
+			return ErrBackendExists
+		}
+
+		backend.SetDraining(false)
+		logger.Info("Backend %s is back, its removal is cancelled", upstream.Address)
+		pool.refreshAliveBackends()
+		pool.mu.Unlock()
+		return nil
+	}
+
+	added := NewBackend(upstream, pool.poolSettings)
+	pool.allBackends = append(pool.allBackends, added)
+	logger.Info("Backend %s added to pool", upstream.Address)
+	pool.refreshAliveBackends()
+	observers := pool.observers
+	pool.mu.Unlock()
+
+	for _, observer := range observers {
+		observer.AddBackend(added)
+	}
+	return nil
+}
+
+// RemoveBackend takes a backend out of a running pool in two phases. It is
+// drained first, so it gets no new connections while its active ones
+// finish; once none are left, or RemovalTimeout has passed, it is dropped
+// and its connection pool closed. Connections still in use at that point
+// are closed instead of pooled when their clients are done with them.
+func (pool *Pool) RemoveBackend(address string) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, backend := range pool.allBackends {
+		if backend.Address != address {
+			continue
+		}
+		if backend.RemovalPending() {
+			return nil
+		}
+
+		since := time.Now().UnixNano()
+		backend.removingSince.Store(since)
+		backend.SetDraining(true)
+		pool.refreshAliveBackends()
+
+		if active := backend.ActiveConnections(); active > 0 {
+			logger.Info("Backend %s is being removed, waiting for %d active connections", address, active)
+		}
+		go pool.awaitRemoval(backend, since)
+		return nil
+	}
+
+	return ErrBackendNotFound
+}
+
+// awaitRemoval finishes the removal started at since once the backend has
+// no active connections or the removal timeout has passed. It gives up if
+// the removal was cancelled or the pool closed in the meantime.
+func (pool *Pool) awaitRemoval(backend *Backend, since int64) {
+	defer recovery.Recover("removal of " + backend.Address)
+
+	deadline := time.Unix(0, since).Add(pool.poolSettings.RemovalTimeout)
+	ticker := time.NewTicker(removalPollInterval)
+	defer ticker.Stop()
+
+	for backend.ActiveConnections() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ticker.C:
+		case <-pool.done:
+			return
+		}
+		if backend.removingSince.Load() != since {
+			return
+		}
+	}
+
+	pool.mu.Lock()
+	if pool.closed || backend.removingSince.Load() != since {
+		pool.mu.Unlock()
+		return
+	}
+
+	remaining := make([]*Backend, 0, len(pool.allBackends))
+	for _, b := range pool.allBackends {
+		if b != backend {
+			remaining = append(remaining, b)
+		}
+	}
+	pool.allBackends = remaining
+	backend.ConnectionPool.Close()
+
+	if active := backend.ActiveConnections(); active > 0 {
+		logger.Warn("Backend %s removed from pool with %d connections still active after %s",
+			backend.Address, active, pool.poolSettings.RemovalTimeout)
+	} else {
+		logger.Info("Backend %s removed from pool", backend.Address)
+	}
+	pool.refreshAliveBackends()
+	observers := pool.observers
+	pool.mu.Unlock()
+
+	for _, observer := range observers {
+		observer.RemoveBackend(backend.Address)
+	}
+}
+
+// Observe registers o for membership changes from now on.
+func (pool *Pool) Observe(o MembershipObserver) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.observers = append(pool.observers, o)
+}
+
+// refreshAliveBackends rebuilds the alive snapshot. Must be called with pool.mu held.
+//
+// Only the available backends of the lowest priority are put in it, so
+// every balancer spreads traffic within that tier alone. A standby tier
+// starts receiving connections once the whole tier in front of it is down,
+// and loses them again as soon as one backend there is available.
+func (pool *Pool) refreshAliveBackends() {
+	aliveBackends, serving, available := servingTier(pool.allBackends)
+
 	pool.aliveBackends.Store(aliveBackends)
-	logger.Info("Backend pool updated: %d/%d backends alive", len(aliveBackends), len(pool.allBackends))
+	logger.Info("Backend pool updated: %d/%d backends alive", available, len(pool.allBackends))
+
+	if serving != pool.serving && serving >= 0 && pool.hasPriorities() {
+		logger.Warn("Backends of priority %d are now serving traffic (%d alive)", serving, len(aliveBackends))
+	}
+	pool.serving = serving
+}
+
+// servingTier returns the available backends of the lowest priority that
+// has any, that priority (-1 when none is available) and how many backends
+// are available across all priorities.
+func servingTier(backends []*Backend) (tier []*Backend, priority int, available int) {
+	priority = -1
+	for _, backend := range backends {
+		if backend.IsAvailable() {
+			available++
+			if priority < 0 || backend.Priority < priority {
+				priority = backend.Priority
+			}
+		}
+	}
+
+	tier = make([]*Backend, 0, available)
+	for _, backend := range backends {
+		if backend.IsAvailable() && backend.Priority == priority {
+			tier = append(tier, backend)
+		}
+	}
+	return tier, priority, available
 }
 
+// hasPriorities reports whether backends are split into more than one
+// priority tier. Must be called with pool.mu held.
+func (pool *Pool) hasPriorities() bool {
+	for _, backend := range pool.allBackends {
+		if backend.Priority != pool.allBackends[0].Priority {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBackendCount returns how many backends the pool has and how many of
+// them are available, standby tiers included.
 func (pool *Pool) GetBackendCount() (total int, alive int) {
 	pool.mu.RLock()
-	total = len(pool.allBackends)
-	pool.mu.RUnlock()
-
-	aliveBackends := pool.GetAliveBackends()
-	alive = len(aliveBackends)
+	defer pool.mu.RUnlock()
 
-	return total, alive
+	for _, backend := range pool.allBackends {
+		if backend.IsAvailable() {
+			alive++
+		}
+	}
+	return len(pool.allBackends), alive
 }
 
-func (pool *Pool) Close() {
+// Stats returns a connection pool snapshot for every backend.
+func (pool *Pool) Stats() []PoolStats {
 	pool.mu.RLock()
 	defer pool.mu.RUnlock()
 
+	stats := make([]PoolStats, 0, len(pool.allBackends))
+	for _, backend := range pool.allBackends {
+		stats = append(stats, backend.ConnectionPool.Stats())
+	}
+	return stats
+}
+
+func (pool *Pool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if !pool.closed {
+		pool.closed = true
+		close(pool.done)
+	}
+
 	for _, backend := range pool.allBackends {
 		backend.ConnectionPool.Close()
 	}
@@ -1,11 +1,16 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	"zen/utils/logger"
+	"zen/utils/recovery"
 )
 
 var (
@@ -17,120 +22,644 @@ type ConnectionPool struct {
 	config      *ConnectionPoolConfig
 	mu          sync.Mutex
 	idleConns   []*PoolConn
-	activeCount int
+	activeCount int // idle + checked out connections
+	maxActive   int // current limit on activeCount, moved by autosizing
+	peakInUse   int // most connections checked out at once since the last autosize tick
 	closed      bool
+	done        chan struct{}   // closed by Close to stop the cleanup goroutine
+	waiters     []chan struct{} // FIFO queue of GetContext calls blocked on an exhausted pool
+	wakeups     int             // waiters signalled but not yet back under the lock
+
+	totalDials       atomic.Uint64
+	totalReuses      atomic.Uint64
+	prewarmDials     atomic.Uint64 // the part of totalDials made to refill minIdle
+	exhaustionEvents atomic.Uint64
+	totalQueued      atomic.Uint64
+	queueWaitNanos   atomic.Int64
+	replenishing     atomic.Bool
+	refillPaused     atomic.Bool // set while the backend is dead, so min_idle is not redialed
+
+	autosize poolAutosizer
+}
+
+// PoolStats is a point in time snapshot of a ConnectionPool.
+type PoolStats struct {
+	Address          string
+	Idle             int
+	Active           int // checked out connections
+	MaxActive        int
+	TotalDials       uint64
+	TotalReuses      uint64 // callers served an idle connection
+	PrewarmDials     uint64 // dials made to refill min_idle rather than for a caller
+	ExhaustionEvents uint64
+	QueueDepth       int           // callers currently waiting for a slot
+	MaxQueue         int           // zero means unbounded
+	TotalQueued      uint64        // callers that had to wait
+	QueueWaitTotal   time.Duration // time spent waiting by callers that got a connection
 }
 
 type ConnectionPoolConfig struct {
-	address        string
-	maxIdle        int
-	maxActive      int
-	idleTimeout    time.Duration
-	connectTimeout time.Duration
+	address           string
+	maxIdle           int
+	minIdle           int
+	maxActive         int
+	idleTimeout       time.Duration
+	connectTimeout    time.Duration
+	maxConnLifetime   time.Duration
+	blockOnExhaustion bool
+	maxWait           time.Duration
+	maxQueue          int
+	autosizeMin       int
+	autosizeMax       int
+	socketReceive     int
+	socketSend        int
+	tls               *tls.Config
+	localAddr         *net.TCPAddr
+}
+
+// ConnectionPoolSettings holds the tunables shared by every backend's pool.
+type ConnectionPoolSettings struct {
+	MaxIdle           int
+	MinIdle           int // idle connections kept warm in the background
+	MaxActive         int
+	IdleTimeout       time.Duration
+	MaxConnLifetime   time.Duration // zero disables lifetime based retirement
+	BlockOnExhaustion bool          // wait for a free slot instead of failing fast
+	MaxWait           time.Duration // upper bound on the wait when blocking
+	MaxQueue          int           // callers allowed to wait at once when blocking, zero is unbounded
+
+	// With AutosizeMax set, MaxActive is only the starting limit: it grows
+	// toward AutosizeMax under sustained exhaustion and shrinks toward
+	// AutosizeMin while utilization stays low.
+	AutosizeMin int
+	AutosizeMax int
+
+	// SocketReceiveBuffer and SocketSendBuffer size the kernel buffers of
+	// dialed connections. Zero keeps the OS default.
+	SocketReceiveBuffer int
+	SocketSendBuffer    int
+
+	// TLS, when set, wraps every dialed connection in a TLS client that
+	// completes its handshake before the connection is used.
+	TLS *tls.Config
+
+	// LocalAddr, when set, is the source address of dialed connections.
+	LocalAddr *net.TCPAddr
+
+	// RemovalTimeout bounds how long a backend removed from a running pool
+	// drains before it is dropped with connections still active.
+	RemovalTimeout time.Duration
 }
 
 type PoolConn struct {
 	conn       net.Conn
+	createdAt  time.Time
 	lastUsedAt time.Time
 }
 
-func NewConnectionPool(address string, maxIdle, maxActive int, idleTimeout time.Duration) *ConnectionPool {
-	config := newConfig(address, maxIdle, maxActive, idleTimeout)
+func NewConnectionPool(address string, settings *ConnectionPoolSettings) *ConnectionPool {
+	return newConnectionPool(address, "", settings)
+}
+
+// newConnectionPool is NewConnectionPool for a backend whose TLS server name
+// is not the host of address, such as an IP resolved from a hostname. An
+// empty serverName uses that host.
+func newConnectionPool(address, serverName string, settings *ConnectionPoolSettings) *ConnectionPool {
+	config := newConfig(address, serverName, settings)
 	pool := &ConnectionPool{
 		config:    config,
-		idleConns: make([]*PoolConn, 0, maxIdle),
+		idleConns: make([]*PoolConn, 0, config.maxIdle),
+		maxActive: config.maxActive,
+		done:      make(chan struct{}),
 	}
 
 	go pool.periodicCleanup()
+	go pool.replenish()
 
 	return pool
 }
 
-func newConfig(address string, maxIdle, maxActive int, idleTimeout time.Duration) *ConnectionPoolConfig {
+// defaultIdleTimeout applies when no positive idle timeout was configured.
+const defaultIdleTimeout = 30 * time.Second
+
+func newConfig(address, serverName string, settings *ConnectionPoolSettings) *ConnectionPoolConfig {
+	if settings == nil {
+		settings = &ConnectionPoolSettings{
+			MaxIdle:     10,
+			MaxActive:   100,
+			IdleTimeout: defaultIdleTimeout,
+		}
+	}
+
+	idleTimeout := settings.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
 	return &ConnectionPoolConfig{
-		address:        address,
-		maxIdle:        maxIdle,
-		maxActive:      maxActive,
-		idleTimeout:    idleTimeout,
-		connectTimeout: 5 * time.Second,
+		address:           address,
+		maxIdle:           settings.MaxIdle,
+		minIdle:           min(settings.MinIdle, settings.MaxIdle),
+		maxActive:         settings.MaxActive,
+		idleTimeout:       idleTimeout,
+		connectTimeout:    5 * time.Second,
+		maxConnLifetime:   settings.MaxConnLifetime,
+		blockOnExhaustion: settings.BlockOnExhaustion,
+		maxWait:           settings.MaxWait,
+		maxQueue:          settings.MaxQueue,
+		autosizeMin:       settings.AutosizeMin,
+		autosizeMax:       settings.AutosizeMax,
+		socketReceive:     settings.SocketReceiveBuffer,
+		socketSend:        settings.SocketSendBuffer,
+		tls:               upstreamTLSConfig(address, serverName, settings.TLS),
+		localAddr:         settings.LocalAddr,
+	}
+}
+
+// upstreamTLSConfig verifies the backend against serverName, or the host of
+// its address when that is empty, unless a server name was configured.
+func upstreamTLSConfig(address, serverName string, tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil || tlsConfig.ServerName != "" {
+		return tlsConfig
+	}
+
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return tlsConfig
+		}
+		serverName = host
 	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = serverName
+	return tlsConfig
 }
 
 func (cp *ConnectionPool) Get() (net.Conn, error) {
+	return cp.GetContext(context.Background())
+}
+
+// GetContext returns an idle connection if one is available, otherwise dials
+// a new one. Cancellation and deadlines of ctx are honored by the dial and,
+// in blocking mode, by the wait for a free slot. Blocked callers are served
+// in arrival order, and newcomers queue behind them rather than grabbing a
+// slot that frees up.
+func (cp *ConnectionPool) GetContext(ctx context.Context) (net.Conn, error) {
 	logger.Debug("Attempting to get a connection from the pool.")
-	cp.mu.Lock()
-	defer cp.mu.Unlock()
 
-	if cp.closed {
-		return nil, ErrPoolClosed
+	var waitDeadline <-chan time.Time
+	if cp.config.blockOnExhaustion && cp.config.maxWait > 0 {
+		timer := time.NewTimer(cp.config.maxWait)
+		defer timer.Stop()
+		waitDeadline = timer.C
 	}
 
-	for len(cp.idleConns) > 0 {
-		n := len(cp.idleConns) - 1
-		poolConn := cp.idleConns[n]
-		cp.idleConns = cp.idleConns[:n]
+	var waitStart time.Time
+	woken := false
 
-		logger.Debug("Reusing idle connection to %s", poolConn.conn.RemoteAddr())
-		return &PooledConnection{conn: poolConn.conn, pool: cp}, nil
-	}
+	cp.mu.Lock()
+
+	for {
+		if cp.closed {
+			cp.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		// Only a caller whose turn it is may take capacity while others wait
+		mustQueue := !woken && (len(cp.waiters) > 0 || cp.wakeups > 0)
+
+		for !mustQueue && len(cp.idleConns) > 0 {
+			n := len(cp.idleConns) - 1
+			poolConn := cp.idleConns[n]
+			cp.idleConns = cp.idleConns[:n]
+			cp.notePeakInUse()
+
+			// The liveness probe may block for a moment, so it runs
+			// without the lock; the connection is checked out meanwhile.
+			cp.mu.Unlock()
+			if cp.isExpired(poolConn, time.Now()) || !isConnAlive(poolConn.conn) {
+				logger.Debug("Discarding stale idle connection to %s", poolConn.conn.RemoteAddr())
+				poolConn.conn.Close()
+
+				cp.mu.Lock()
+				cp.activeCount--
+				if cp.closed {
+					cp.mu.Unlock()
+					return nil, ErrPoolClosed
+				}
+				// Callers that queued up during the probe come first
+				mustQueue = !woken && (len(cp.waiters) > 0 || cp.wakeups > 0)
+				if mustQueue {
+					cp.notifyWaiters()
+				}
+				continue
+			}
+
+			cp.recordQueueWait(waitStart)
+			cp.totalReuses.Add(1)
+			logger.Debug("Reusing idle connection to %s", poolConn.conn.RemoteAddr())
+			return &PooledConnection{conn: poolConn.conn, pool: cp, createdAt: poolConn.createdAt}, nil
+		}
 
-	if cp.activeCount >= cp.config.maxActive {
-		logger.Warn("Max active connections reached: %d. Pool exhausted.", cp.config.maxActive)
-		return nil, ErrPoolExhausted
+		if !mustQueue && cp.activeCount < cp.maxActive {
+			break
+		}
+
+		limit := cp.maxActive
+		if !cp.config.blockOnExhaustion {
+			cp.mu.Unlock()
+			cp.exhaustionEvents.Add(1)
+			logger.Warn("Max active connections reached: %d. Pool exhausted.", limit)
+			return nil, ErrPoolExhausted
+		}
+
+		if !woken && cp.config.maxQueue > 0 && len(cp.waiters) >= cp.config.maxQueue {
+			cp.mu.Unlock()
+			cp.exhaustionEvents.Add(1)
+			logger.Warn("Connection queue for %s is full: %d waiting. Pool exhausted.", cp.config.address, len(cp.waiters))
+			return nil, ErrPoolExhausted
+		}
+
+		// A caller that was already woken keeps its place at the head
+		turn := make(chan struct{})
+		if woken {
+			cp.waiters = append([]chan struct{}{turn}, cp.waiters...)
+		} else {
+			cp.waiters = append(cp.waiters, turn)
+		}
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+			cp.totalQueued.Add(1)
+		}
+		cp.mu.Unlock()
+
+		logger.Debug("Pool for %s exhausted, waiting for a free connection", cp.config.address)
+		select {
+		case <-turn:
+		case <-waitDeadline:
+			cp.leaveQueue(turn)
+			cp.exhaustionEvents.Add(1)
+			logger.Warn("Max active connections reached: %d. Gave up waiting after %s.", limit, cp.config.maxWait)
+			return nil, ErrPoolExhausted
+		case <-ctx.Done():
+			cp.leaveQueue(turn)
+			return nil, ctx.Err()
+		}
+
+		cp.mu.Lock()
+		cp.wakeups--
+		woken = true
 	}
 
+	// Reserve the slot before dialing so the lock is not held during the dial
+	cp.activeCount++
+	cp.notePeakInUse()
+	cp.mu.Unlock()
+	cp.recordQueueWait(waitStart)
+	cp.totalDials.Add(1)
+
 	address := cp.config.address
-	conn, err := net.DialTimeout("tcp", address, cp.config.connectTimeout)
+	conn, err := cp.dial(ctx)
 	if err != nil {
+		cp.mu.Lock()
+		cp.activeCount--
+		cp.notifyWaiters()
+		cp.mu.Unlock()
 		logger.Error("Failed to establish connection with backend server: %s - %v", address, err)
 		return nil, err
 	}
 
-	cp.activeCount++
 	logger.Debug("New connection established with backend server: %s", address)
-	return &PooledConnection{conn: conn, pool: cp}, nil
+	return &PooledConnection{conn: conn, pool: cp, createdAt: time.Now()}, nil
+}
+
+// dial opens a new connection to the backend with the configured socket options.
+func (cp *ConnectionPool) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: cp.config.connectTimeout}
+	if cp.config.localAddr != nil {
+		dialer.LocalAddr = cp.config.localAddr
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", cp.config.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := SetSocketBuffers(conn, cp.config.socketReceive, cp.config.socketSend); err != nil {
+		logger.Debug("Failed to size socket buffers for %s: %s", cp.config.address, err)
+	}
+
+	if cp.config.tls == nil {
+		return conn, nil
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, cp.config.connectTimeout)
+	defer cancel()
+
+	tlsConnection := tls.Client(conn, cp.config.tls)
+	if err := tlsConnection.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %w", cp.config.address, err)
+	}
+	return tlsConnection, nil
+}
+
+// notifyWaiters hands the freed capacity to the longest waiting GetContext
+// call. Must be called with cp.mu held, once per freed slot or idle connection.
+func (cp *ConnectionPool) notifyWaiters() {
+	if len(cp.waiters) == 0 {
+		return
+	}
+
+	turn := cp.waiters[0]
+	cp.waiters = cp.waiters[1:]
+	cp.wakeups++
+	close(turn)
+}
+
+// leaveQueue removes a caller that gave up waiting. If its turn was signalled
+// in the meantime, the turn is passed on so the freed capacity is not lost.
+func (cp *ConnectionPool) leaveQueue(turn chan struct{}) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for i, waiter := range cp.waiters {
+		if waiter == turn {
+			cp.waiters = append(cp.waiters[:i], cp.waiters[i+1:]...)
+			return
+		}
+	}
+
+	cp.wakeups--
+	cp.notifyWaiters()
+}
+
+func (cp *ConnectionPool) recordQueueWait(waitStart time.Time) {
+	if !waitStart.IsZero() {
+		cp.queueWaitNanos.Add(int64(time.Since(waitStart)))
+	}
 }
 
-func (cp *ConnectionPool) put(conn net.Conn) {
+func (cp *ConnectionPool) put(conn net.Conn, createdAt time.Time) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
+	defer cp.notifyWaiters()
 
 	if cp.closed {
 		conn.Close()
+		cp.activeCount--
 		return
 	}
 
-	if len(cp.idleConns) >= cp.config.maxIdle {
+	now := time.Now()
+	poolConn := &PoolConn{
+		conn:       conn,
+		createdAt:  createdAt,
+		lastUsedAt: now,
+	}
+
+	if len(cp.idleConns) >= cp.config.maxIdle || cp.isExpired(poolConn, now) {
 		conn.Close()
 		cp.activeCount--
 		return
 	}
 
-	cp.idleConns = append(cp.idleConns, &PoolConn{
-		conn:       conn,
-		lastUsedAt: time.Now(),
-	})
+	cp.idleConns = append(cp.idleConns, poolConn)
+}
+
+// release gives back the slot of a connection that was closed by its user.
+func (cp *ConnectionPool) release() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.activeCount--
+	cp.notifyWaiters()
+}
+
+func (cp *ConnectionPool) isExpired(poolConn *PoolConn, now time.Time) bool {
+	if cp.config.maxConnLifetime <= 0 {
+		return false
+	}
+	return now.Sub(poolConn.createdAt) > cp.config.maxConnLifetime
+}
+
+// socketState is what peekSocket finds in a socket's receive queue.
+type socketState int
+
+const (
+	socketEmpty  socketState = iota // nothing queued, the peer is still there
+	socketData                      // bytes queued
+	socketClosed                    // EOF or an error
+)
+
+// isConnAlive checks an idle connection before it is handed out. Where the
+// socket can be peeked at without blocking, an empty queue means usable and
+// EOF or an error means dead, at the cost of one syscall. Queued bytes on a
+// plain connection are unexpected and also mean dead. Connections that
+// cannot be peeked at, and TLS ones with records queued, which may be
+// session tickets the peer sent after the handshake, are probed with a read
+// instead, see isConnAliveRead.
+func isConnAlive(conn net.Conn) bool {
+	socket := conn
+	if tlsConnection, ok := conn.(*tls.Conn); ok {
+		socket = tlsConnection.NetConn()
+	}
+
+	state, ok := peekSocket(socket)
+	switch {
+	case !ok:
+	case state == socketEmpty:
+		return true
+	case state == socketClosed || socket == conn:
+		return false
+	}
+	return isConnAliveRead(conn)
+}
+
+// isConnAliveRead probes an idle connection with a read that gives up after
+// a millisecond. A timeout means the peer has nothing to say and the
+// connection is usable; EOF, a reset or unexpected data means it should not
+// be handed out.
+func isConnAliveRead(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var probe [1]byte
+	_, err := conn.Read(probe[:])
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Misses returns how many callers had to wait for a fresh dial because no
+// idle connection was available.
+func (s PoolStats) Misses() uint64 {
+	return s.TotalDials - s.PrewarmDials
+}
+
+// ReuseRatio returns the share of callers served an idle connection, or 0
+// before the first one.
+func (s PoolStats) ReuseRatio() float64 {
+	gets := s.TotalReuses + s.Misses()
+	if gets == 0 {
+		return 0
+	}
+	return float64(s.TotalReuses) / float64(gets)
+}
+
+func (cp *ConnectionPool) Stats() PoolStats {
+	cp.mu.Lock()
+	idle := len(cp.idleConns)
+	active := cp.activeCount - idle
+	queueDepth := len(cp.waiters)
+	maxActive := cp.maxActive
+	cp.mu.Unlock()
+
+	return PoolStats{
+		Address:          cp.config.address,
+		Idle:             idle,
+		Active:           active,
+		MaxActive:        maxActive,
+		TotalDials:       cp.totalDials.Load(),
+		TotalReuses:      cp.totalReuses.Load(),
+		PrewarmDials:     cp.prewarmDials.Load(),
+		ExhaustionEvents: cp.exhaustionEvents.Load(),
+		QueueDepth:       queueDepth,
+		MaxQueue:         cp.config.maxQueue,
+		TotalQueued:      cp.totalQueued.Load(),
+		QueueWaitTotal:   time.Duration(cp.queueWaitNanos.Load()),
+	}
 }
 
 func (cp *ConnectionPool) Close() {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
+	if cp.closed {
+		return
+	}
+
 	cp.closed = true
+	close(cp.done)
+	for len(cp.waiters) > 0 {
+		cp.notifyWaiters()
+	}
 
 	for _, idleConn := range cp.idleConns {
 		idleConn.conn.Close()
+		cp.activeCount--
 	}
 
 	cp.idleConns = nil
 }
 
+// FlushIdle closes every idle connection, for instance once the backend has
+// been found dead, and returns how many were closed. Checked out connections
+// are left to their users.
+func (cp *ConnectionPool) FlushIdle() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	flushed := len(cp.idleConns)
+	for _, idleConn := range cp.idleConns {
+		idleConn.conn.Close()
+		cp.activeCount--
+		cp.notifyWaiters()
+	}
+	cp.idleConns = cp.idleConns[:0]
+
+	return flushed
+}
+
+// minCleanupInterval is the shortest interval between idle cleanups. A tiny
+// idle timeout would otherwise have the cleanup loop spin on a busy ticker.
+const minCleanupInterval = 100 * time.Millisecond
+
+// cleanupInterval is how often idle connections are checked: twice per
+// idle timeout, but never more often than minCleanupInterval.
+func cleanupInterval(idleTimeout time.Duration) time.Duration {
+	return max(idleTimeout/2, minCleanupInterval)
+}
+
 func (cp *ConnectionPool) periodicCleanup() {
-	ticker := time.NewTicker(cp.config.idleTimeout / 2)
+	ticker := time.NewTicker(cleanupInterval(cp.config.idleTimeout))
 	defer ticker.Stop()
 
-	for range ticker.C {
-		cp.cleanup()
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-ticker.C:
+			func() {
+				defer recovery.Recover("connection pool cleanup for " + cp.config.address)
+				cp.cleanup()
+				cp.autosizeTick()
+			}()
+			if !cp.refillPaused.Load() {
+				go cp.replenish()
+			}
+		}
+	}
+}
+
+// PauseRefill stops the background refill of minIdle, for instance once the
+// backend has been found dead, so the pool does not keep dialing it.
+// Prewarm still dials.
+func (cp *ConnectionPool) PauseRefill() {
+	cp.refillPaused.Store(true)
+}
+
+// ResumeRefill restarts the background refill stopped by PauseRefill.
+func (cp *ConnectionPool) ResumeRefill() {
+	cp.refillPaused.Store(false)
+}
+
+// prewarmDialInterval spaces out background dials so refilling the idle
+// pool never hammers a backend that just came up.
+const prewarmDialInterval = 50 * time.Millisecond
+
+// Prewarm fills the pool up to minIdle idle connections and returns how many
+// it dialed. Unlike the background refill it blocks until done.
+func (cp *ConnectionPool) Prewarm() int {
+	return cp.replenish()
+}
+
+// replenish dials until the pool holds at least minIdle idle connections,
+// without exceeding maxActive, and returns how many it added.
+func (cp *ConnectionPool) replenish() (dialed int) {
+	if cp.config.minIdle <= 0 || !cp.replenishing.CompareAndSwap(false, true) {
+		return 0
+	}
+	defer cp.replenishing.Store(false)
+	defer recovery.Recover("connection pool prewarm for " + cp.config.address)
+
+	for {
+		cp.mu.Lock()
+		if cp.closed || len(cp.idleConns) >= cp.config.minIdle || cp.activeCount >= cp.maxActive ||
+			len(cp.waiters) > 0 || cp.wakeups > 0 {
+			cp.mu.Unlock()
+			return
+		}
+		cp.activeCount++
+		cp.mu.Unlock()
+
+		cp.totalDials.Add(1)
+		cp.prewarmDials.Add(1)
+		conn, err := cp.dial(context.Background())
+		if err != nil {
+			cp.mu.Lock()
+			cp.activeCount--
+			cp.notifyWaiters()
+			cp.mu.Unlock()
+			logger.Debug("Failed to prewarm connection to %s: %s", cp.config.address, err)
+			return
+		}
+
+		logger.Debug("Prewarmed idle connection to %s", cp.config.address)
+		cp.put(conn, time.Now())
+		dialed++
+
+		time.Sleep(prewarmDialInterval)
 	}
 }
 
@@ -147,10 +676,11 @@ func (cp *ConnectionPool) cleanup() {
 	remainingIdleConnections := make([]*PoolConn, 0, len(cp.idleConns))
 
 	for _, idleConn := range cp.idleConns {
-		if now.Sub(idleConn.lastUsedAt) > cp.config.idleTimeout {
+		if now.Sub(idleConn.lastUsedAt) > cp.config.idleTimeout || cp.isExpired(idleConn, now) {
 			logger.Debug("Closing idle connection: %s", idleConn.conn.RemoteAddr())
 			idleConn.conn.Close()
 			cp.activeCount--
+			cp.notifyWaiters()
 		} else {
 			remainingIdleConnections = append(remainingIdleConnections, idleConn)
 		}
@@ -0,0 +1,342 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zen/utils/testutil"
+)
+
+// timeoutError is what a read past its deadline returns.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// probedConn is an idle connection whose liveness probe blocks until it is
+// released, then reports the connection as alive.
+type probedConn struct {
+	net.Conn
+	probing chan struct{}
+	release chan struct{}
+}
+
+func (c *probedConn) Read(b []byte) (int, error) {
+	close(c.probing)
+	<-c.release
+	return 0, timeoutError{}
+}
+
+func (c *probedConn) SetReadDeadline(time.Time) error { return nil }
+func (c *probedConn) RemoteAddr() net.Addr            { return &net.TCPAddr{} }
+func (c *probedConn) Close() error                    { return nil }
+
+func newTestPool(t *testing.T, address string, settings *ConnectionPoolSettings) *ConnectionPool {
+	t.Helper()
+
+	cp := NewConnectionPool(address, settings)
+	t.Cleanup(cp.Close)
+	return cp
+}
+
+// addIdle puts conn in the pool as if it had been checked out and returned.
+func addIdle(cp *ConnectionPool, conn net.Conn) {
+	cp.mu.Lock()
+	cp.activeCount++
+	cp.mu.Unlock()
+	cp.put(conn, time.Now())
+}
+
+func TestLivenessProbeRunsWithoutPoolLock(t *testing.T) {
+	cp := newTestPool(t, "127.0.0.1:1", &ConnectionPoolSettings{MaxIdle: 2, MaxActive: 2, IdleTimeout: time.Minute})
+	conn := &probedConn{probing: make(chan struct{}), release: make(chan struct{})}
+	addIdle(cp, conn)
+
+	got := make(chan net.Conn, 1)
+	go func() {
+		pooled, err := cp.GetContext(context.Background())
+		if err != nil {
+			t.Errorf("GetContext: %s", err)
+		}
+		got <- pooled
+	}()
+	<-conn.probing
+
+	// Stats takes the pool lock, so it only returns if the probe runs without it
+	stats := make(chan PoolStats, 1)
+	go func() { stats <- cp.Stats() }()
+	select {
+	case s := <-stats:
+		if s.Active != 1 || s.Idle != 0 {
+			t.Errorf("during the probe: active=%d idle=%d, want the connection checked out", s.Active, s.Idle)
+		}
+	case <-time.After(time.Second):
+		close(conn.release)
+		t.Fatal("the pool lock is held while an idle connection is probed")
+	}
+
+	close(conn.release)
+	if pooled := <-got; pooled == nil || pooled.(*PooledConnection).conn != conn {
+		t.Fatalf("got %v, want the idle connection", pooled)
+	}
+}
+
+func TestStaleIdleConnectionIsReplaced(t *testing.T) {
+	b, err := testutil.NewEchoBackend()
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	defer b.Close()
+
+	cp := newTestPool(t, b.Address(), &ConnectionPoolSettings{MaxIdle: 2, MaxActive: 1, IdleTimeout: time.Minute})
+
+	// A connection the backend has closed fails the probe
+	client, server := net.Pipe()
+	server.Close()
+	addIdle(cp, client)
+
+	conn, err := cp.GetContext(context.Background())
+	if err != nil {
+		t.Fatalf("GetContext: %s", err)
+	}
+	defer conn.Close()
+	if conn.(*PooledConnection).conn == client {
+		t.Fatal("a dead idle connection was handed out")
+	}
+	if stats := cp.Stats(); stats.Active != 1 || stats.TotalDials != 1 {
+		t.Fatalf("active=%d dials=%d, want the dead connection's slot reused for one dial", stats.Active, stats.TotalDials)
+	}
+}
+
+func TestBlockedCallersAreServedInArrivalOrder(t *testing.T) {
+	b, err := testutil.NewEchoBackend()
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	defer b.Close()
+
+	cp := newTestPool(t, b.Address(), &ConnectionPoolSettings{
+		MaxIdle:           1,
+		MaxActive:         1,
+		IdleTimeout:       time.Minute,
+		BlockOnExhaustion: true,
+		MaxWait:           5 * time.Second,
+	})
+
+	held, err := cp.GetContext(context.Background())
+	if err != nil {
+		t.Fatalf("GetContext: %s", err)
+	}
+
+	// Queue the waiters one at a time so their arrival order is known
+	const waiters = 8
+	served := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			conn, err := cp.GetContext(context.Background())
+			if err != nil {
+				t.Errorf("waiter %d: %s", i, err)
+				served <- -1
+				return
+			}
+			served <- i
+			conn.Close()
+		}(i)
+		for cp.Stats().QueueDepth != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	held.Close()
+	for want := 0; want < waiters; want++ {
+		if got := <-served; got != want {
+			t.Fatalf("waiter %d was served in position %d", got, want)
+		}
+	}
+}
+
+func TestMaxActiveHoldsUnderContention(t *testing.T) {
+	b, err := testutil.NewEchoBackend()
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	defer b.Close()
+
+	const maxActive = 3
+	cp := newTestPool(t, b.Address(), &ConnectionPoolSettings{
+		MaxIdle:           maxActive,
+		MaxActive:         maxActive,
+		IdleTimeout:       time.Minute,
+		BlockOnExhaustion: true,
+		MaxWait:           10 * time.Second,
+	})
+
+	var inUse, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := cp.GetContext(context.Background())
+			if err != nil {
+				t.Errorf("GetContext: %s", err)
+				return
+			}
+			n := inUse.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			inUse.Add(-1)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > maxActive {
+		t.Fatalf("%d connections were checked out at once, max_active is %d", p, maxActive)
+	}
+	stats := cp.Stats()
+	if stats.Active != 0 || stats.QueueDepth != 0 {
+		t.Fatalf("after the run: active=%d queued=%d, want both 0", stats.Active, stats.QueueDepth)
+	}
+	if stats.TotalDials > maxActive {
+		t.Fatalf("%d dials for a pool of %d reusable connections", stats.TotalDials, maxActive)
+	}
+}
+
+func TestClosedPoolsLeaveNoGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 200; i++ {
+		cp := NewConnectionPool("127.0.0.1:1", &ConnectionPoolSettings{MaxIdle: 2, MaxActive: 2, IdleTimeout: time.Minute})
+		cp.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines after closing the pools, %d before", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTinyIdleTimeoutDoesNotSpin(t *testing.T) {
+	tests := []struct {
+		idleTimeout time.Duration
+		want        time.Duration
+	}{
+		{time.Nanosecond, minCleanupInterval},
+		{30, minCleanupInterval}, // 30ns, the old unit bug
+		{minCleanupInterval, minCleanupInterval},
+		{time.Minute, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := cleanupInterval(test.idleTimeout); got != test.want {
+			t.Errorf("cleanupInterval(%s) = %s, want %s", test.idleTimeout, got, test.want)
+		}
+	}
+
+	// A pool with a tiny idle timeout still starts and closes cleanly
+	cp := newTestPool(t, "127.0.0.1:1", &ConnectionPoolSettings{MaxIdle: 1, MaxActive: 1, IdleTimeout: time.Nanosecond})
+	if cp.config.idleTimeout != time.Nanosecond {
+		t.Errorf("idle timeout %s, want the configured 1ns", cp.config.idleTimeout)
+	}
+}
+
+func TestNonPositiveIdleTimeoutUsesDefault(t *testing.T) {
+	for _, idleTimeout := range []time.Duration{0, -time.Second} {
+		config := newConfig("127.0.0.1:1", "", &ConnectionPoolSettings{MaxIdle: 1, MaxActive: 1, IdleTimeout: idleTimeout})
+		if config.idleTimeout != defaultIdleTimeout {
+			t.Errorf("IdleTimeout %s: got %s, want %s", idleTimeout, config.idleTimeout, defaultIdleTimeout)
+		}
+	}
+	if config := newConfig("127.0.0.1:1", "", nil); config.idleTimeout != defaultIdleTimeout {
+		t.Errorf("nil settings: got %s, want %s", config.idleTimeout, defaultIdleTimeout)
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %s", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// deadlineCountingConn counts read deadlines set on a TCP connection, which
+// only the read probe does.
+type deadlineCountingConn struct {
+	*net.TCPConn
+	deadlines int
+}
+
+func (c *deadlineCountingConn) SetReadDeadline(t time.Time) error {
+	c.deadlines++
+	return c.TCPConn.SetReadDeadline(t)
+}
+
+func TestLivenessProbeOfIdleTCPDoesNotRead(t *testing.T) {
+	client, _ := tcpPair(t)
+	conn := &deadlineCountingConn{TCPConn: client}
+
+	if !isConnAlive(conn) {
+		t.Fatal("an open idle connection was found dead")
+	}
+	if _, ok := peekSocket(conn); ok && conn.deadlines != 0 {
+		t.Fatalf("the probe set %d read deadlines, want a peek only", conn.deadlines)
+	}
+}
+
+func TestLivenessProbeFindsClosedOrChattyTCP(t *testing.T) {
+	client, server := tcpPair(t)
+	server.Close()
+	waitFor(t, "the FIN to arrive", func() bool { return !isConnAlive(client) })
+
+	client, server = tcpPair(t)
+	server.Write([]byte("unexpected"))
+	waitFor(t, "the data to arrive", func() bool { return !isConnAlive(client) })
+}
+
+func TestLivenessProbeOfIdleTLS(t *testing.T) {
+	address, clientTLS := tlsBackend(t, "backend.test")
+	clientTLS.ServerName = "backend.test"
+
+	conn, err := tls.Dial("tcp", address, clientTLS)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	// Session tickets sent after the handshake are not a reason to drop it
+	time.Sleep(20 * time.Millisecond)
+	if !isConnAlive(conn) || !isConnAlive(conn) {
+		t.Fatal("an open idle TLS connection was found dead")
+	}
+}
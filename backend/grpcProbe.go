@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The gRPC probe speaks just enough cleartext HTTP/2 to call
+// grpc.health.v1.Health/Check, which keeps zen free of a gRPC dependency.
+// Response headers are never decoded: the verdict comes from the
+// HealthCheckResponse message in the DATA frame, and a trailers-only
+// response (how gRPC reports errors) counts as a failure.
+
+const (
+	http2FrameData     = 0x0
+	http2FrameHeaders  = 0x1
+	http2FrameRST      = 0x3
+	http2FrameSettings = 0x4
+	http2FramePing     = 0x6
+	http2FrameGoAway   = 0x7
+
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+
+	http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	grpcServingStatus   = 1
+	grpcMaxFrameSize    = 1 << 14
+)
+
+type grpcProbe struct {
+	service string
+	dialer  net.Dialer
+}
+
+// NewGRPCProbe returns a probe implementing the standard gRPC health checking
+// protocol. An empty service checks the overall server health.
+func NewGRPCProbe(service string, localAddr *net.TCPAddr) HealthProbe {
+	return &grpcProbe{service: service, dialer: probeDialer(localAddr)}
+}
+
+func (p *grpcProbe) Probe(ctx context.Context, address string) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(p.request(address)); err != nil {
+		return err
+	}
+
+	var message []byte
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return fmt.Errorf("reading gRPC health response: %w", err)
+		}
+
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frameType, flags := header[3], header[4]
+		streamID := binary.BigEndian.Uint32(header[5:9]) & 0x7fffffff
+
+		if length > grpcMaxFrameSize {
+			return fmt.Errorf("HTTP/2 frame too large: %d bytes", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return fmt.Errorf("reading gRPC health response: %w", err)
+		}
+
+		switch frameType {
+		case http2FrameSettings:
+			if flags&http2FlagAck == 0 {
+				conn.Write(appendHTTP2Frame(nil, http2FrameSettings, http2FlagAck, 0, nil))
+			}
+		case http2FramePing:
+			if flags&http2FlagAck == 0 {
+				conn.Write(appendHTTP2Frame(nil, http2FramePing, http2FlagAck, 0, payload))
+			}
+		case http2FrameGoAway:
+			return errors.New("server sent GOAWAY")
+		case http2FrameRST:
+			if streamID == 1 {
+				return errors.New("health check stream was reset")
+			}
+		case http2FrameData:
+			if streamID != 1 {
+				continue
+			}
+			if flags&http2FlagPadded != 0 && len(payload) > 0 {
+				padding := int(payload[0])
+				if padding >= len(payload) {
+					return errors.New("malformed padded DATA frame")
+				}
+				payload = payload[1 : len(payload)-padding]
+			}
+			message = append(message, payload...)
+			if status, ok := parseHealthCheckResponse(message); ok {
+				if status != grpcServingStatus {
+					return fmt.Errorf("gRPC health status %d, want SERVING", status)
+				}
+				return nil
+			}
+		case http2FrameHeaders:
+			if streamID == 1 && flags&http2FlagEndStream != 0 {
+				return errors.New("gRPC health check returned no response message")
+			}
+		}
+	}
+}
+
+// request builds the connection preface, our SETTINGS and the full
+// Health/Check call on stream 1.
+func (p *grpcProbe) request(authority string) []byte {
+	var headers []byte
+	for _, field := range [][2]string{
+		{":method", "POST"},
+		{":scheme", "http"},
+		{":path", grpcHealthCheckPath},
+		{":authority", authority},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	} {
+		headers = appendHpackLiteral(headers, field[0], field[1])
+	}
+
+	// HealthCheckRequest { string service = 1; }
+	var message []byte
+	if p.service != "" {
+		message = append(message, 0x0a)
+		message = binary.AppendUvarint(message, uint64(len(p.service)))
+		message = append(message, p.service...)
+	}
+
+	data := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(data[1:], uint32(len(message)))
+	data = append(data, message...)
+
+	buf := []byte(http2ClientPreface)
+	buf = appendHTTP2Frame(buf, http2FrameSettings, 0, 0, nil)
+	buf = appendHTTP2Frame(buf, http2FrameHeaders, http2FlagEndHeaders, 1, headers)
+	buf = appendHTTP2Frame(buf, http2FrameData, http2FlagEndStream, 1, data)
+	return buf
+}
+
+func appendHTTP2Frame(buf []byte, frameType, flags byte, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	buf = append(buf, byte(length>>16), byte(length>>8), byte(length), frameType, flags)
+	buf = binary.BigEndian.AppendUint32(buf, streamID)
+	return append(buf, payload...)
+}
+
+// appendHpackLiteral encodes a header as a literal without indexing and
+// without Huffman coding, which every HPACK decoder must accept.
+func appendHpackLiteral(buf []byte, name, value string) []byte {
+	buf = append(buf, 0x00)
+	buf = appendHpackString(buf, name)
+	return appendHpackString(buf, value)
+}
+
+func appendHpackString(buf []byte, s string) []byte {
+	length := len(s)
+	if length < 127 {
+		buf = append(buf, byte(length))
+	} else {
+		buf = append(buf, 127)
+		length -= 127
+		for length >= 128 {
+			buf = append(buf, byte(length%128+128))
+			length /= 128
+		}
+		buf = append(buf, byte(length))
+	}
+	return append(buf, s...)
+}
+
+// parseHealthCheckResponse decodes a length-prefixed gRPC message holding a
+// HealthCheckResponse { ServingStatus status = 1; }. It reports false until
+// the whole message has arrived.
+func parseHealthCheckResponse(message []byte) (uint64, bool) {
+	if len(message) < 5 {
+		return 0, false
+	}
+
+	length := int(binary.BigEndian.Uint32(message[1:5]))
+	if len(message) < 5+length {
+		return 0, false
+	}
+
+	body := message[5 : 5+length]
+	for len(body) > 0 {
+		tag, n := binary.Uvarint(body)
+		if n <= 0 {
+			return 0, true
+		}
+		body = body[n:]
+
+		value, n := binary.Uvarint(body)
+		if n <= 0 || tag&0x7 != 0 {
+			return 0, true
+		}
+		body = body[n:]
+
+		if tag>>3 == 1 {
+			return value, true
+		}
+	}
+
+	return 0, true
+}
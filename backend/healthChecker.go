@@ -2,28 +2,59 @@ package backend
 
 import (
 	"context"
-	"net"
+	"encoding/json"
 	"strings"
 	"sync"
 	"time"
 	"zen/utils/logger"
+	"zen/utils/recovery"
 )
 
+// checkNowCooldown is the least time between two checks of a backend
+// requested through CheckNow.
+const checkNowCooldown = time.Second
+
+// healthHistorySize is how many recent check results are kept per backend.
+const healthHistorySize = 20
+
 type HealthCheckConfig struct {
 	Interval           time.Duration
 	Timeout            time.Duration
 	HealthyThreshold   int
 	UnhealthyThreshold int
+	WaitForFirstCheck  bool // a single failure on the first pass marks a backend unhealthy
+	Probe              HealthProbe
+
+	// A backend changing state more than FlapThreshold times within
+	// FlapWindow is held down for FlapPenalty. Zero disables flap detection.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapPenalty   time.Duration
+
+	// Checks slower than SlowThreshold lower a backend's health score, and
+	// with it its weight; failed checks lower it further. Zero keeps every
+	// alive backend at full weight.
+	SlowThreshold time.Duration
+
+	// Concurrency caps how many checks run at once, out-of-band checks
+	// included, so a large pool is not probed in one burst. Zero means no cap.
+	Concurrency int
 }
 
 type HealthChecker struct {
-	config        *HealthCheckConfig
+	config        *HealthCheckConfig // replaced as a whole by Reconfigure, under mu
 	pool          *Pool
 	ctx           context.Context
 	cancel        context.CancelFunc
 	wg            sync.WaitGroup
 	mu            sync.RWMutex
 	backendHealth map[string]*BackendHealth
+	metrics       map[string]*HealthCheckMetrics
+	outOfBand     map[string]bool // backends with a CheckNow check in flight
+	checkSlots    chan struct{}   // semaphore of Concurrency slots, nil when unbounded
+	reconfigured  chan struct{}   // wakes the check loop to pick up a new interval
+
+	firstCheckDone chan struct{}
 }
 
 type BackendHealth struct {
@@ -31,6 +62,160 @@ type BackendHealth struct {
 	consecutiveFailures  int
 	lastCheckTime        time.Time
 	lastError            error
+	stateSince           time.Time   // last alive <-> dead change, or when tracking started
+	alive                bool        // only set in snapshots from GetHealthStatus
+	warmingUp            bool        // recovered, waiting for its pool to be prewarmed
+	transitions          []time.Time // state changes within the flap window
+	heldUntil            time.Time   // kept dead until then for flapping
+	history              healthHistory
+}
+
+// HealthCheckResult is one check in a backend's recent history.
+type HealthCheckResult struct {
+	Time     time.Time
+	Healthy  bool
+	Duration time.Duration
+	Reason   string // failure reason, empty when healthy
+}
+
+// healthHistory is a ring buffer of the last healthHistorySize results, so
+// a failure stays visible after the next success resets the counters.
+type healthHistory struct {
+	results [healthHistorySize]HealthCheckResult
+	next    int
+	count   int
+}
+
+func (h *healthHistory) add(result HealthCheckResult) {
+	h.results[h.next] = result
+	h.next = (h.next + 1) % healthHistorySize
+	h.count = min(h.count+1, healthHistorySize)
+}
+
+// list returns the recorded results, oldest first.
+func (h *healthHistory) list() []HealthCheckResult {
+	results := make([]HealthCheckResult, 0, h.count)
+	start := (h.next - h.count + healthHistorySize) % healthHistorySize
+	for i := 0; i < h.count; i++ {
+		results = append(results, h.results[(start+i)%healthHistorySize])
+	}
+	return results
+}
+
+// score rates the recorded results from 0 to 1. A passed check within
+// slowThreshold counts fully, a slower one by how much of slowThreshold it
+// took, and a failed one not at all.
+func (h *healthHistory) score(slowThreshold time.Duration) float64 {
+	if h.count == 0 {
+		return 1
+	}
+
+	var total float64
+	for _, result := range h.results[:h.count] {
+		switch {
+		case !result.Healthy:
+		case result.Duration <= slowThreshold:
+			total++
+		default:
+			total += float64(slowThreshold) / float64(result.Duration)
+		}
+	}
+	return total / float64(h.count)
+}
+
+// BackendStatus is what an operator looks at first when a backend is down.
+type BackendStatus struct {
+	Alive               bool
+	Since               time.Time // last state change, or when checking started
+	ConsecutiveFailures int
+	LastError           string // the last failed check's error, empty after a success
+	LastErrorReason     string // LastError categorized, e.g. connection_refused
+}
+
+// Downtime returns how long the backend has been dead, zero while alive.
+func (s BackendStatus) Downtime() time.Duration {
+	if s.Alive {
+		return 0
+	}
+	return time.Since(s.Since)
+}
+
+// Status summarizes a snapshot returned by GetHealthStatus.
+func (h *BackendHealth) Status() BackendStatus {
+	status := BackendStatus{
+		Alive:               h.alive,
+		Since:               h.stateSince,
+		ConsecutiveFailures: h.consecutiveFailures,
+	}
+	if h.lastError != nil {
+		status.LastError = h.lastError.Error()
+		status.LastErrorReason = failureReason(h.lastError)
+	}
+	return status
+}
+
+// History returns the backend's recent check results, oldest first.
+func (h *BackendHealth) History() []HealthCheckResult {
+	return h.history.list()
+}
+
+func (h *BackendHealth) MarshalJSON() ([]byte, error) {
+	status := h.Status()
+
+	var downtime string
+	if !status.Alive {
+		downtime = status.Downtime().Round(time.Second).String()
+	}
+
+	var lastCheckTime *time.Time
+	if !h.lastCheckTime.IsZero() {
+		lastCheckTime = &h.lastCheckTime
+	}
+
+	var heldUntil *time.Time
+	if time.Now().Before(h.heldUntil) {
+		heldUntil = &h.heldUntil
+	}
+
+	type historyEntry struct {
+		Time     time.Time `json:"time"`
+		Healthy  bool      `json:"healthy"`
+		Duration string    `json:"duration"`
+		Reason   string    `json:"reason,omitempty"`
+	}
+	history := make([]historyEntry, 0, h.history.count)
+	for _, result := range h.history.list() {
+		history = append(history, historyEntry{
+			Time:     result.Time,
+			Healthy:  result.Healthy,
+			Duration: result.Duration.String(),
+			Reason:   result.Reason,
+		})
+	}
+
+	return json.Marshal(struct {
+		Alive                bool           `json:"alive"`
+		StateSince           time.Time      `json:"state_since"`
+		Downtime             string         `json:"downtime,omitempty"`
+		ConsecutiveSuccesses int            `json:"consecutive_successes"`
+		ConsecutiveFailures  int            `json:"consecutive_failures"`
+		LastCheckTime        *time.Time     `json:"last_check_time,omitempty"`
+		LastError            string         `json:"last_error,omitempty"`
+		LastErrorReason      string         `json:"last_error_reason,omitempty"`
+		FlappingUntil        *time.Time     `json:"flapping_until,omitempty"`
+		History              []historyEntry `json:"history"`
+	}{
+		Alive:                status.Alive,
+		StateSince:           status.Since,
+		Downtime:             downtime,
+		ConsecutiveSuccesses: h.consecutiveSuccesses,
+		ConsecutiveFailures:  h.consecutiveFailures,
+		LastCheckTime:        lastCheckTime,
+		LastError:            status.LastError,
+		LastErrorReason:      status.LastErrorReason,
+		FlappingUntil:        heldUntil,
+		History:              history,
+	})
 }
 
 func NewHealthChecker(pool *Pool, config *HealthCheckConfig) *HealthChecker {
@@ -43,77 +228,269 @@ func NewHealthChecker(pool *Pool, config *HealthCheckConfig) *HealthChecker {
 		}
 	}
 
+	if config.Probe == nil {
+		config.Probe = NewTCPProbe(nil)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	var checkSlots chan struct{}
+	if config.Concurrency > 0 {
+		checkSlots = make(chan struct{}, config.Concurrency)
+	}
+
 	return &HealthChecker{
 		config:        config,
 		pool:          pool,
 		ctx:           ctx,
 		cancel:        cancel,
 		backendHealth: make(map[string]*BackendHealth),
+		metrics:       make(map[string]*HealthCheckMetrics),
+		outOfBand:     make(map[string]bool),
+		checkSlots:    checkSlots,
+		reconfigured:  make(chan struct{}, 1),
+
+		firstCheckDone: make(chan struct{}),
 	}
 }
 
-func (hc *HealthChecker) Start() {
-	logger.Info("Starting health checker with interval: %s", hc.config.Interval)
+// Reconfigure applies new settings to a running checker without losing the
+// health state of any backend. The interval takes effect right away, the
+// timeout and probe from the next check, and the thresholds from the next
+// evaluation, against the consecutive counts reached so far. Concurrency
+// is fixed at construction and kept.
+func (hc *HealthChecker) Reconfigure(config *HealthCheckConfig) {
+	updated := *config
+	if updated.Probe == nil {
+		updated.Probe = NewTCPProbe(nil)
+	}
 
-	backends := hc.pool.GetAliveBackends()
 	hc.mu.Lock()
-	for _, backend := range backends {
-		hc.backendHealth[backend.Address] = &BackendHealth{
-			consecutiveSuccesses: hc.config.HealthyThreshold,
-		}
+	if updated.Concurrency != hc.config.Concurrency {
+		logger.Warn("Health check concurrency cannot change while running, keeping %d", hc.config.Concurrency)
+		updated.Concurrency = hc.config.Concurrency
 	}
+	hc.config = &updated
 	hc.mu.Unlock()
 
+	select {
+	case hc.reconfigured <- struct{}{}:
+	default:
+	}
+	logger.Info("Health checker reconfigured: interval=%s timeout=%s healthy_threshold=%d unhealthy_threshold=%d",
+		updated.Interval, updated.Timeout, updated.HealthyThreshold, updated.UnhealthyThreshold)
+}
+
+// settings returns the current configuration, for code not holding hc.mu.
+// The returned value is never modified.
+func (hc *HealthChecker) settings() *HealthCheckConfig {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return hc.config
+}
+
+func (hc *HealthChecker) Start() {
+	logger.Info("Starting health checker with interval: %s", hc.settings().Interval)
+
+	// Observe first so that a backend added in between is not missed
+	hc.pool.Observe(hc)
+	for _, backend := range hc.pool.GetAllBackends() {
+		hc.AddBackend(backend)
+	}
+
 	hc.wg.Add(1)
 	go hc.healthCheckLoop()
 }
 
+// AddBackend starts tracking a backend at the healthy baseline, so like the
+// backends present at Start it takes UnhealthyThreshold failures to go down.
+// The pool calls it for every backend added while the checker runs.
+func (hc *HealthChecker) AddBackend(backend *Backend) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if _, exists := hc.backendHealth[backend.Address]; exists {
+		return
+	}
+	hc.backendHealth[backend.Address] = &BackendHealth{
+		consecutiveSuccesses: hc.config.HealthyThreshold,
+		stateSince:           time.Now(),
+	}
+}
+
+// RemoveBackend forgets the health state and metrics of a backend that left
+// the pool. The pool calls it for every backend removed while the checker runs.
+func (hc *HealthChecker) RemoveBackend(address string) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	delete(hc.backendHealth, address)
+	delete(hc.metrics, address)
+}
+
+// WaitForFirstCheck blocks until the first health check pass has completed
+// or timeout elapses. It reports whether the pass completed in time.
+func (hc *HealthChecker) WaitForFirstCheck(timeout time.Duration) bool {
+	select {
+	case <-hc.firstCheckDone:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// FirstCheckCompleted reports whether the first health check pass has finished.
+func (hc *HealthChecker) FirstCheckCompleted() bool {
+	select {
+	case <-hc.firstCheckDone:
+		return true
+	default:
+		return false
+	}
+}
+
 func (hc *HealthChecker) Stop() {
 	logger.Info("Stopping health checker...")
+	// Under the lock so that CheckNow cannot start a check after the wait
+	hc.mu.Lock()
 	hc.cancel()
+	hc.mu.Unlock()
 	hc.wg.Wait()
 	logger.Info("Health checker stopped")
 }
 
+// CheckNow checks a backend right away instead of at the next interval, e.g.
+// because clients failed to connect to it. It returns immediately. Calls for
+// a backend already being checked this way, or checked less than
+// checkNowCooldown ago, are dropped, so a burst of failing clients adds up
+// to about one check per cooldown.
+func (hc *HealthChecker) CheckNow(address string) {
+	var target *Backend
+	for _, backend := range hc.pool.GetAllBackends() {
+		if backend.Address == address {
+			target = backend
+			break
+		}
+	}
+	if target == nil {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	health, exists := hc.backendHealth[address]
+	if hc.ctx.Err() != nil || !exists || hc.outOfBand[address] || time.Since(health.lastCheckTime) < checkNowCooldown {
+		return
+	}
+
+	logger.Debug("Checking backend %s out of band", address)
+	hc.outOfBand[address] = true
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+		defer recovery.Recover("out-of-band health check of " + address)
+		defer func() {
+			hc.mu.Lock()
+			delete(hc.outOfBand, address)
+			hc.mu.Unlock()
+		}()
+
+		if !hc.acquireCheckSlot() {
+			return
+		}
+		defer hc.releaseCheckSlot()
+
+		hc.checkBackend(target, false)
+	}()
+}
+
+// acquireCheckSlot blocks until a check may start under the concurrency
+// limit. It reports false when the checker was stopped while waiting.
+func (hc *HealthChecker) acquireCheckSlot() bool {
+	if hc.checkSlots == nil {
+		return true
+	}
+
+	select {
+	case hc.checkSlots <- struct{}{}:
+		return true
+	case <-hc.ctx.Done():
+		return false
+	}
+}
+
+func (hc *HealthChecker) releaseCheckSlot() {
+	if hc.checkSlots != nil {
+		<-hc.checkSlots
+	}
+}
+
 func (hc *HealthChecker) healthCheckLoop() {
 	defer hc.wg.Done()
 
-	ticker := time.NewTicker(hc.config.Interval)
+	interval := hc.settings().Interval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	hc.checkAllBackends()
+	hc.checkAllBackends(true)
+	close(hc.firstCheckDone)
 
 	for {
 		select {
 		case <-hc.ctx.Done():
 			return
+		case <-hc.reconfigured:
+			if updated := hc.settings().Interval; updated != interval {
+				interval = updated
+				ticker.Reset(interval)
+			}
 		case <-ticker.C:
-			hc.checkAllBackends()
+			hc.checkAllBackends(false)
 		}
 	}
 }
 
-func (hc *HealthChecker) checkAllBackends() {
+func (hc *HealthChecker) checkAllBackends(initial bool) {
 	allBackends := hc.pool.GetAllBackends()
 
 	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []string
 	for _, backend := range allBackends {
+		// Taken before starting the goroutine, so a large pool does not
+		// park thousands of them on the semaphore either.
+		if !hc.acquireCheckSlot() {
+			break
+		}
+
 		wg.Add(1)
 		go func(b *Backend) {
 			defer wg.Done()
-			hc.checkBackend(b)
+			defer hc.releaseCheckSlot()
+			defer recovery.Recover("health check of " + b.Address)
+			if !hc.checkBackend(b, initial) {
+				failedMu.Lock()
+				failed = append(failed, b.Address)
+				failedMu.Unlock()
+			}
 		}(backend)
 	}
 
 	wg.Wait()
-	logger.Debug("Health check cycle completed for %s backends", len(allBackends))
+	logger.Debug("Health check cycle completed for %d backends", len(allBackends))
+
+	if initial && len(failed) > 0 {
+		logger.Warn("Initial health check failed for %d/%d backends: %s",
+			len(failed), len(allBackends), strings.Join(failed, ", "))
+	}
 }
 
-func (hc *HealthChecker) checkBackend(backend *Backend) {
+func (hc *HealthChecker) checkBackend(backend *Backend, initial bool) bool {
 	startTime := time.Now()
-	healthy := hc.isBackendHealthy(backend.Address)
+	err := hc.probe(backend.HealthAddress)
+	healthy := err == nil
 	checkDuration := time.Since(startTime)
 
 	hc.mu.Lock()
@@ -121,79 +498,194 @@ func (hc *HealthChecker) checkBackend(backend *Backend) {
 
 	health, exists := hc.backendHealth[backend.Address]
 	if !exists {
-		health = &BackendHealth{}
-		hc.backendHealth[backend.Address] = health
+		logger.Debug("Backend %s left the pool during its health check", backend.Address)
+		return healthy
 	}
 
+	metrics, exists := hc.metrics[backend.Address]
+	if !exists {
+		metrics = newHealthCheckMetrics()
+		hc.metrics[backend.Address] = metrics
+	}
+	metrics.observe(checkDuration, err)
+
 	health.lastCheckTime = startTime
+	result := HealthCheckResult{Time: startTime, Healthy: healthy, Duration: checkDuration}
+	if !healthy {
+		result.Reason = failureReason(err)
+	}
+	health.history.add(result)
+	if hc.config.SlowThreshold > 0 {
+		score := health.history.score(hc.config.SlowThreshold)
+		backend.SetHealthScore(score)
+		metrics.HealthScore = score
+	}
 
 	if healthy {
 		health.consecutiveSuccesses++
 		health.consecutiveFailures = 0
 		health.lastError = nil
-		logger.Debug("Health check SUCCESS for %s (took %sms)",
+		logger.Debug("Health check SUCCESS for %s (took %dms)",
 			backend.Address, checkDuration.Milliseconds())
 	} else {
 		health.consecutiveFailures++
 		health.consecutiveSuccesses = 0
-		logger.Debug("Health check FAILED for %s (took %sms)",
+		health.lastError = err
+		logFailure(backend.Address, err)
+		logger.Debug("Health check FAILED for %s (took %dms)",
 			backend.Address, checkDuration.Milliseconds())
 	}
 
-	hc.evaluateBackendStatus(backend, health)
+	hc.evaluateBackendStatus(backend, health, initial)
+	return healthy
 }
 
-func (hc *HealthChecker) evaluateBackendStatus(backend *Backend, health *BackendHealth) {
+func (hc *HealthChecker) evaluateBackendStatus(backend *Backend, health *BackendHealth, initial bool) {
+	if backend.IsDraining() {
+		return
+	}
+
 	currentlyAlive := backend.IsAlive()
 	shouldBeAlive := currentlyAlive
 
+	// Backends start out alive, so when startup waits on the first pass a
+	// single failure has to be enough for the pool to reflect reality.
+	unhealthyThreshold := hc.config.UnhealthyThreshold
+	if initial && hc.config.WaitForFirstCheck {
+		unhealthyThreshold = 1
+	}
+
 	if !currentlyAlive && health.consecutiveSuccesses >= hc.config.HealthyThreshold {
-		shouldBeAlive = true
-		logger.Info("Backend %s is now HEALTHY", backend.Address)
-	} else if currentlyAlive && health.consecutiveFailures >= hc.config.UnhealthyThreshold {
+		if time.Now().Before(health.heldUntil) {
+			logger.Debug("Backend %s passes its health checks but is held down for flapping until %s",
+				backend.Address, health.heldUntil.Format(time.RFC3339))
+			return
+		}
+
+		// The pool was flushed when the backend died. Refill it before
+		// routing traffic there so the first clients do not all pay for a
+		// dial; the backend is revived once that is done.
+		if !health.warmingUp {
+			health.warmingUp = true
+			hc.wg.Add(1)
+			go hc.warmUp(backend)
+		}
+		return
+	} else if currentlyAlive && health.consecutiveFailures >= unhealthyThreshold {
 		shouldBeAlive = false
 		logger.Warn("Backend %s is now UNHEALTHY", backend.Address)
+		health.stateSince = time.Now()
+		hc.recordTransition(backend.Address, health, health.stateSince)
 	}
 
 	if shouldBeAlive != currentlyAlive {
 		backend.SetAlive(shouldBeAlive)
 		hc.pool.updateBackendStatus(backend.Address, shouldBeAlive)
+
+		// Idle connections to a dead backend are almost certainly broken too,
+		// and refilling them would only dial it over and over until warmUp
+		if !shouldBeAlive {
+			backend.ConnectionPool.PauseRefill()
+			if flushed := backend.ConnectionPool.FlushIdle(); flushed > 0 {
+				logger.Info("Closed %d idle connections to unhealthy backend %s", flushed, backend.Address)
+			}
+		}
 	}
 }
 
-func (hc *HealthChecker) isBackendHealthy(address string) bool {
-	conn, err := net.DialTimeout("tcp", address, hc.config.Timeout)
-	if err != nil {
-		hc.storeLastError(address, err)
+// warmUp prewarms the pool of a recovered backend, then marks it alive
+// unless it failed again or was drained in the meantime.
+func (hc *HealthChecker) warmUp(backend *Backend) {
+	defer hc.wg.Done()
+	defer recovery.Recover("warm up of " + backend.Address)
+
+	startTime := time.Now()
+	if warmed := backend.ConnectionPool.Prewarm(); warmed > 0 {
+		logger.Info("Warmed up %d idle connections to backend %s in %s",
+			warmed, backend.Address, time.Since(startTime).Round(time.Millisecond))
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	health, exists := hc.backendHealth[backend.Address]
+	if !exists {
+		return
+	}
+	health.warmingUp = false
+	if backend.IsAlive() || backend.IsDraining() || health.consecutiveSuccesses < hc.config.HealthyThreshold {
+		return
+	}
+	if hc.recordTransition(backend.Address, health, time.Now()) {
+		backend.ConnectionPool.FlushIdle()
+		return
+	}
+
+	health.stateSince = time.Now()
+	backend.MarkRecovered(health.stateSince)
+	backend.ConnectionPool.ResumeRefill()
+	backend.SetAlive(true)
+	hc.pool.updateBackendStatus(backend.Address, true)
+	logger.Info("Backend %s is now HEALTHY", backend.Address)
+}
+
+// recordTransition notes a state change of a backend and reports whether it
+// made the backend flapping, in which case it is held dead for FlapPenalty.
+// Must be called with hc.mu held.
+func (hc *HealthChecker) recordTransition(address string, health *BackendHealth, now time.Time) bool {
+	if hc.config.FlapThreshold <= 0 {
+		return false
+	}
+
+	recent := health.transitions[:0]
+	for _, at := range health.transitions {
+		if now.Sub(at) < hc.config.FlapWindow {
+			recent = append(recent, at)
+		}
+	}
+	health.transitions = append(recent, now)
+
+	if len(health.transitions) <= hc.config.FlapThreshold {
 		return false
 	}
 
-	conn.Close()
+	logger.Warn("Backend %s is FLAPPING: %d state changes within %s, holding it down for %s",
+		address, len(health.transitions), hc.config.FlapWindow, hc.config.FlapPenalty)
+	health.transitions = nil
+	health.heldUntil = now.Add(hc.config.FlapPenalty)
+	if metrics, exists := hc.metrics[address]; exists {
+		metrics.Flaps++
+	}
 	return true
 }
 
-func (hc *HealthChecker) storeLastError(address string, err error) {
-	hc.mu.Lock()
-	defer hc.mu.Unlock()
+func (hc *HealthChecker) probe(address string) error {
+	config := hc.settings()
+	ctx, cancel := context.WithTimeout(hc.ctx, config.Timeout)
+	defer cancel()
 
-	if health, exists := hc.backendHealth[address]; exists {
-		health.lastError = err
+	return config.Probe.Probe(ctx, address)
+}
 
-		errStr := err.Error()
-		switch {
-		case strings.Contains(errStr, "connection refused"):
-			logger.Debug("Backend %s connection refused (service down)", address)
-		case strings.Contains(errStr, "timeout"):
-			logger.Debug("Backend %s connection timeout (slow/overloaded)", address)
-		case strings.Contains(errStr, "network unreachable"):
-			logger.Debug("Backend %s network unreachable", address)
-		default:
-			logger.Debug("Backend %s connection error: %s", address, err)
-		}
+func logFailure(address string, err error) {
+	switch failureReason(err) {
+	case FailureConnectionRefused:
+		logger.Debug("Backend %s connection refused (service down)", address)
+	case FailureTimeout:
+		logger.Debug("Backend %s connection timeout (slow/overloaded)", address)
+	case FailureNetworkUnreachable:
+		logger.Debug("Backend %s network unreachable", address)
+	default:
+		logger.Debug("Backend %s connection error: %s", address, err)
 	}
 }
 
 func (hc *HealthChecker) GetHealthStatus() map[string]*BackendHealth {
+	alive := make(map[string]bool)
+	for _, backend := range hc.pool.GetAllBackends() {
+		alive[backend.Address] = backend.IsAlive()
+	}
+
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
 
@@ -204,7 +696,34 @@ func (hc *HealthChecker) GetHealthStatus() map[string]*BackendHealth {
 			consecutiveFailures:  health.consecutiveFailures,
 			lastCheckTime:        health.lastCheckTime,
 			lastError:            health.lastError,
+			stateSince:           health.stateSince,
+			alive:                alive[addr],
+			heldUntil:            health.heldUntil,
+			history:              health.history,
 		}
 	}
 	return status
 }
+
+// Statuses summarizes every tracked backend: whether it is alive, since
+// when, and why its last check failed.
+func (hc *HealthChecker) Statuses() map[string]BackendStatus {
+	statuses := make(map[string]BackendStatus)
+	for addr, health := range hc.GetHealthStatus() {
+		statuses[addr] = health.Status()
+	}
+	return statuses
+}
+
+// Metrics returns a snapshot of the health check metrics of every backend
+// checked so far, keyed by address.
+func (hc *HealthChecker) Metrics() map[string]HealthCheckMetrics {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	metrics := make(map[string]HealthCheckMetrics, len(hc.metrics))
+	for addr, m := range hc.metrics {
+		metrics[addr] = m.clone()
+	}
+	return metrics
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zen/utils/testutil"
+)
+
+// switchProbe fails while down is set, whatever the backend does.
+type switchProbe struct {
+	down atomic.Bool
+}
+
+func (p *switchProbe) Probe(context.Context, string) error {
+	if p.down.Load() {
+		return errors.New("probe failed")
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeadBackendIsNotRefilled(t *testing.T) {
+	echo, err := testutil.NewEchoBackend()
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	defer echo.Close()
+
+	// Idle connections expire on every cleanup, so a refilling pool dials
+	// again each tick
+	pool := NewBackendPool([]Upstream{{Address: echo.Address(), Weight: 1}}, &ConnectionPoolSettings{
+		MinIdle:     1,
+		MaxIdle:     1,
+		MaxActive:   2,
+		IdleTimeout: time.Nanosecond,
+	})
+	defer pool.Close()
+	b := pool.GetAllBackends()[0]
+
+	probe := &switchProbe{}
+	hc := NewHealthChecker(pool, &HealthCheckConfig{
+		Interval:           20 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+		Probe:              probe,
+	})
+	hc.Start()
+	defer hc.Stop()
+
+	probe.down.Store(true)
+	waitFor(t, "the backend to be marked dead", func() bool { return !b.IsAlive() })
+
+	// An in-flight refill may still land; after that nothing is dialed
+	time.Sleep(2 * minCleanupInterval)
+	dials := b.ConnectionPool.Stats().TotalDials
+	time.Sleep(5 * minCleanupInterval)
+	if got := b.ConnectionPool.Stats().TotalDials; got != dials {
+		t.Fatalf("dialed a dead backend %d more times", got-dials)
+	}
+
+	// The warm-up on recovery resumes the background refill
+	probe.down.Store(false)
+	waitFor(t, "the backend to recover", b.IsAlive)
+	dials = b.ConnectionPool.Stats().TotalDials
+	waitFor(t, "the refill to resume", func() bool { return b.ConnectionPool.Stats().TotalDials > dials+1 })
+}
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"strings"
+	"time"
+)
+
+// Failure reasons health check errors are bucketed into.
+const (
+	FailureConnectionRefused  = "connection_refused"
+	FailureTimeout            = "timeout"
+	FailureNetworkUnreachable = "network_unreachable"
+	FailureOther              = "other"
+)
+
+// HealthCheckBuckets are the upper bounds of the check duration histogram.
+var HealthCheckBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// HealthCheckMetrics is a snapshot of one backend's health check history.
+// BucketCounts holds one count per HealthCheckBuckets entry plus a final
+// overflow bucket; counts are not cumulative.
+type HealthCheckMetrics struct {
+	Checks        uint64
+	TotalDuration time.Duration
+	BucketCounts  []uint64
+	Failures      map[string]uint64
+	Flaps         uint64  // times the backend was held down for flapping
+	HealthScore   float64 // latest score, 1 unless slow checks are scored
+}
+
+func newHealthCheckMetrics() *HealthCheckMetrics {
+	return &HealthCheckMetrics{
+		HealthScore:  1,
+		BucketCounts: make([]uint64, len(HealthCheckBuckets)+1),
+		Failures:     make(map[string]uint64),
+	}
+}
+
+func (m *HealthCheckMetrics) observe(duration time.Duration, err error) {
+	m.Checks++
+	m.TotalDuration += duration
+
+	bucket := len(HealthCheckBuckets)
+	for i, bound := range HealthCheckBuckets {
+		if duration <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.BucketCounts[bucket]++
+
+	if err != nil {
+		m.Failures[failureReason(err)]++
+	}
+}
+
+func (m *HealthCheckMetrics) clone() HealthCheckMetrics {
+	snapshot := HealthCheckMetrics{
+		Checks:        m.Checks,
+		TotalDuration: m.TotalDuration,
+		Flaps:         m.Flaps,
+		HealthScore:   m.HealthScore,
+		BucketCounts:  append([]uint64(nil), m.BucketCounts...),
+		Failures:      make(map[string]uint64, len(m.Failures)),
+	}
+	for reason, count := range m.Failures {
+		snapshot.Failures[reason] = count
+	}
+	return snapshot
+}
+
+func failureReason(err error) string {
+	errStr := err.Error()
+	switch {
+	case strings.Contains(errStr, "connection refused"):
+		return FailureConnectionRefused
+	case strings.Contains(errStr, "timeout"), strings.Contains(errStr, "deadline exceeded"):
+		return FailureTimeout
+	case strings.Contains(errStr, "network unreachable"), strings.Contains(errStr, "network is unreachable"):
+		return FailureNetworkUnreachable
+	default:
+		return FailureOther
+	}
+}
@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HealthProbe checks a single backend. A nil error means the backend is
+// healthy; the error otherwise describes why it is not.
+type HealthProbe interface {
+	Probe(ctx context.Context, address string) error
+}
+
+// probeDialer returns the dialer a probe connects with. A nil localAddr
+// leaves picking the source address to the kernel.
+func probeDialer(localAddr *net.TCPAddr) net.Dialer {
+	var dialer net.Dialer
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	return dialer
+}
+
+type tcpProbe struct {
+	dialer net.Dialer
+}
+
+// NewTCPProbe returns a probe that only checks a TCP connection can be
+// established. Probes dial from localAddr when it is not nil.
+func NewTCPProbe(localAddr *net.TCPAddr) HealthProbe {
+	return &tcpProbe{dialer: probeDialer(localAddr)}
+}
+
+func (p *tcpProbe) Probe(ctx context.Context, address string) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// maxExpectResponse caps how much of a tcp_send response is buffered while
+// looking for the expected bytes.
+const maxExpectResponse = 4096
+
+type tcpSendProbe struct {
+	send   []byte
+	expect []byte
+	dialer net.Dialer
+}
+
+// NewTCPSendProbe returns a probe that writes send and requires the response
+// to contain expect. Both accept a "hex:" prefix for binary payloads.
+func NewTCPSendProbe(send, expect string, localAddr *net.TCPAddr) (HealthProbe, error) {
+	sendBytes, err := decodePayload(send)
+	if err != nil {
+		return nil, fmt.Errorf("invalid send payload: %w", err)
+	}
+
+	expectBytes, err := decodePayload(expect)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expect payload: %w", err)
+	}
+
+	return &tcpSendProbe{send: sendBytes, expect: expectBytes, dialer: probeDialer(localAddr)}, nil
+}
+
+func (p *tcpSendProbe) Probe(ctx context.Context, address string) error {
+	conn, err := p.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(p.send); err != nil {
+		return fmt.Errorf("sending probe: %w", err)
+	}
+
+	response := make([]byte, 0, 512)
+	buffer := make([]byte, 512)
+	for len(response) < maxExpectResponse {
+		n, err := conn.Read(buffer)
+		response = append(response, buffer[:n]...)
+		if bytes.Contains(response, p.expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("response %q does not contain %q: %w", response, p.expect, err)
+		}
+	}
+
+	return fmt.Errorf("response %q does not contain %q", response, p.expect)
+}
+
+func decodePayload(payload string) ([]byte, error) {
+	if encoded, ok := strings.CutPrefix(payload, "hex:"); ok {
+		return hex.DecodeString(encoded)
+	}
+	return []byte(payload), nil
+}
+
+type httpProbe struct {
+	path   string
+	client *http.Client
+}
+
+// NewHTTPProbe returns a probe that issues GET path and expects a 2xx or 3xx status.
+func NewHTTPProbe(path string, localAddr *net.TCPAddr) HealthProbe {
+	if path == "" {
+		path = "/"
+	}
+
+	dialer := probeDialer(localAddr)
+	return &httpProbe{
+		path: path,
+		client: &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true, DialContext: dialer.DialContext},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (p *httpProbe) Probe(ctx context.Context, address string) error {
+	// url.URL escapes the zone of a link-local IPv6 address, e.g. [fe80::1%eth0]
+	target := (&url.URL{Scheme: "http", Host: address}).String() + p.path
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// listenIPv6 listens on the IPv6 loopback, skipping the test where there
+// is none.
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	return ln
+}
+
+func TestProbesReachIPv6Backend(t *testing.T) {
+	ln := listenIPv6(t)
+	var paths []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	address := ln.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := NewTCPProbe(nil).Probe(ctx, address); err != nil {
+		t.Errorf("TCP probe of %s: %s", address, err)
+	}
+	if err := NewHTTPProbe("/healthz", nil).Probe(ctx, address); err != nil {
+		t.Errorf("HTTP probe of %s: %s", address, err)
+	}
+	if len(paths) != 1 || paths[0] != "/healthz" {
+		t.Errorf("the HTTP probe requested %v, want [/healthz]", paths)
+	}
+}
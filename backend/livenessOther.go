@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package backend
+
+import "net"
+
+// peekSocket cannot look at a socket's receive queue on this platform, so
+// idle connections are always probed with a read.
+func peekSocket(net.Conn) (socketState, bool) {
+	return 0, false
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package backend
+
+import (
+	"net"
+	"syscall"
+)
+
+// peekSocket looks at the receive queue of the socket behind conn without
+// blocking or consuming anything. ok is false when conn has no socket.
+func peekSocket(conn net.Conn) (state socketState, ok bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return socketClosed, true
+	}
+
+	err = rawConn.Read(func(fd uintptr) bool {
+		var peek [1]byte
+		for {
+			n, _, err := syscall.Recvfrom(int(fd), peek[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN || err == syscall.EWOULDBLOCK:
+				state = socketEmpty
+			case err != nil || n == 0:
+				state = socketClosed
+			default:
+				state = socketData
+			}
+			// Never wait for the socket to become readable
+			return true
+		}
+	})
+	if err != nil {
+		return socketClosed, true
+	}
+	return state, true
+}
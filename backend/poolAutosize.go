@@ -0,0 +1,82 @@
+package backend
+
+import "zen/utils/logger"
+
+// Autosizing runs on the cleanup tick. The limit grows by a quarter after
+// autosizeGrowAfter ticks in a row saw the pool exhausted, and shrinks by a
+// quarter after autosizeShrinkAfter ticks in a row in which at most
+// autosizeLowUtilization of it was in use. Shrinking is slower on purpose:
+// a pool that is too small costs failed connections, one too large only
+// costs some headroom on the backend.
+const (
+	autosizeGrowAfter      = 2
+	autosizeShrinkAfter    = 6
+	autosizeLowUtilization = 0.5
+)
+
+// poolAutosizer is the state kept between ticks. Only the cleanup goroutine
+// touches it.
+type poolAutosizer struct {
+	lastExhaustions uint64
+	exhaustedTicks  int
+	idleTicks       int
+}
+
+// notePeakInUse records the number of checked out connections for
+// autosizing. Must be called with cp.mu held.
+func (cp *ConnectionPool) notePeakInUse() {
+	cp.peakInUse = max(cp.peakInUse, cp.activeCount-len(cp.idleConns))
+}
+
+func (cp *ConnectionPool) autosizeTick() {
+	if cp.config.autosizeMax <= 0 {
+		return
+	}
+
+	exhaustions := cp.exhaustionEvents.Load()
+	exhausted := exhaustions > cp.autosize.lastExhaustions
+	cp.autosize.lastExhaustions = exhaustions
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.closed {
+		return
+	}
+
+	exhausted = exhausted || len(cp.waiters) > 0
+	lowUtilization := float64(cp.peakInUse) <= float64(cp.maxActive)*autosizeLowUtilization
+	cp.peakInUse = cp.activeCount - len(cp.idleConns)
+
+	switch {
+	case exhausted:
+		cp.autosize.exhaustedTicks++
+		cp.autosize.idleTicks = 0
+	case lowUtilization:
+		cp.autosize.idleTicks++
+		cp.autosize.exhaustedTicks = 0
+	default:
+		cp.autosize.exhaustedTicks = 0
+		cp.autosize.idleTicks = 0
+	}
+
+	step := max(cp.maxActive/4, 1)
+	previous := cp.maxActive
+
+	if cp.autosize.exhaustedTicks >= autosizeGrowAfter && cp.maxActive < cp.config.autosizeMax {
+		cp.maxActive = min(cp.maxActive+step, cp.config.autosizeMax)
+		cp.autosize.exhaustedTicks = 0
+
+		// Hand the new slots to callers already waiting for one
+		for i := previous; i < cp.maxActive; i++ {
+			cp.notifyWaiters()
+		}
+		logger.Info("Pool for %s keeps running out, raising max active connections from %d to %d",
+			cp.config.address, previous, cp.maxActive)
+	} else if cp.autosize.idleTicks >= autosizeShrinkAfter && cp.maxActive > cp.config.autosizeMin {
+		cp.maxActive = max(cp.maxActive-step, cp.config.autosizeMin)
+		cp.autosize.idleTicks = 0
+		logger.Info("Pool for %s is mostly unused, lowering max active connections from %d to %d",
+			cp.config.address, previous, cp.maxActive)
+	}
+}
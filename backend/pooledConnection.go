@@ -3,26 +3,86 @@ package backend
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+	"zen/utils/logger"
 )
 
 type PooledConnection struct {
-	conn net.Conn
-	pool *ConnectionPool
-	once sync.Once
+	conn      net.Conn
+	pool      *ConnectionPool
+	createdAt time.Time
+	once      sync.Once
+
+	// broken is set once a read or write has failed in a way that leaves
+	// the stream in an unknown state. Close then discards the connection.
+	broken atomic.Bool
+}
+
+// Read timeouts are deliberate deadlines set by the relay and leave the
+// stream intact; any other read error, EOF included, breaks the connection.
+func (pc *PooledConnection) Read(b []byte) (int, error) {
+	n, err := pc.conn.Read(b)
+	if err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			pc.broken.Store(true)
+		}
+	}
+	return n, err
+}
+
+// A failed write, even a timed out one, may have sent part of b.
+func (pc *PooledConnection) Write(b []byte) (int, error) {
+	n, err := pc.conn.Write(b)
+	if err != nil {
+		pc.broken.Store(true)
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the connection, passing on the FIN of a client that
+// finished sending. The backend may still answer, but the stream can no
+// longer carry another client, so Close discards it.
+func (pc *PooledConnection) CloseWrite() error {
+	pc.broken.Store(true)
+	if halfCloser, ok := pc.conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+	return nil
 }
 
-func (pc *PooledConnection) Read(b []byte) (int, error)         { return pc.conn.Read(b) }
-func (pc *PooledConnection) Write(b []byte) (int, error)        { return pc.conn.Write(b) }
+// NetConn returns the underlying connection, for relays that bypass the
+// wrapper to move data with kernel zero-copy. Errors they run into are not
+// seen by the wrapper, so they must Discard the connection on any error.
+func (pc *PooledConnection) NetConn() net.Conn { return pc.conn }
+
 func (pc *PooledConnection) LocalAddr() net.Addr                { return pc.conn.LocalAddr() }
 func (pc *PooledConnection) RemoteAddr() net.Addr               { return pc.conn.RemoteAddr() }
 func (pc *PooledConnection) SetDeadline(t time.Time) error      { return pc.conn.SetDeadline(t) }
 func (pc *PooledConnection) SetReadDeadline(t time.Time) error  { return pc.conn.SetReadDeadline(t) }
 func (pc *PooledConnection) SetWriteDeadline(t time.Time) error { return pc.conn.SetWriteDeadline(t) }
 
+// Discard closes the underlying connection instead of returning it to the
+// pool. Use it when the connection is in an unknown state after an error.
+func (pc *PooledConnection) Discard() error {
+	var err error
+	pc.once.Do(func() {
+		err = pc.conn.Close()
+		pc.pool.release()
+	})
+	return err
+}
+
+// Close returns the connection to the pool, unless a read or write on it has
+// failed, in which case it is discarded like with Discard.
 func (pc *PooledConnection) Close() error {
+	if pc.broken.Load() {
+		logger.Debug("Discarding connection to %s after an I/O error instead of pooling it", pc.conn.RemoteAddr())
+		return pc.Discard()
+	}
+
 	pc.once.Do(func() {
-		pc.pool.put(pc.conn)
+		pc.pool.put(pc.conn, pc.createdAt)
 	})
 	return nil
 }
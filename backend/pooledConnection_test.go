@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closeCountingConn counts how often the pool closes it.
+type closeCountingConn struct {
+	net.Conn
+	closes atomic.Int32
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closes.Add(1)
+	return c.Conn.Close()
+}
+
+func (c *closeCountingConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func TestPooledConnectionClosesOnce(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(pc *PooledConnection)
+	}{
+		{"discard twice", func(pc *PooledConnection) { pc.Discard(); pc.Discard() }},
+		{"discard then close", func(pc *PooledConnection) { pc.Discard(); pc.Close() }},
+		{"broken close twice", func(pc *PooledConnection) { pc.CloseWrite(); pc.Close(); pc.Close() }},
+	}
+	for _, test := range tests {
+		cp := newTestPool(t, "127.0.0.1:1", &ConnectionPoolSettings{MaxIdle: 1, MaxActive: 1, IdleTimeout: time.Minute})
+		client, server := net.Pipe()
+		defer server.Close()
+		conn := &closeCountingConn{Conn: client}
+		addIdle(cp, conn)
+
+		pooled, err := cp.GetContext(context.Background())
+		if err != nil {
+			t.Fatalf("%s: GetContext: %s", test.name, err)
+		}
+		test.close(pooled.(*PooledConnection))
+
+		if closes := conn.closes.Load(); closes != 1 {
+			t.Errorf("%s: closed %d times, want once", test.name, closes)
+		}
+		if stats := cp.Stats(); stats.Active != 0 || stats.Idle != 0 {
+			t.Errorf("%s: active=%d idle=%d, want the slot released once", test.name, stats.Active, stats.Idle)
+		}
+	}
+}
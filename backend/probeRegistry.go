@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Names of the built-in health probes.
+const (
+	ProbeTCP     = "tcp"
+	ProbeTCPSend = "tcp_send"
+	ProbeHTTP    = "http"
+	ProbeGRPC    = "grpc"
+)
+
+var ErrUnknownProbe = errors.New("unknown health check type")
+
+// ProbeOptions carries the health check settings from the configuration.
+// Each probe uses the ones that apply to it.
+type ProbeOptions struct {
+	Path      string
+	Service   string
+	Send      string
+	Expect    string
+	LocalAddr *net.TCPAddr      // nil lets the kernel pick the source address
+	Params    map[string]string // probe specific parameters
+}
+
+// ProbeFactory builds the probe of one health checker.
+type ProbeFactory func(options ProbeOptions) (HealthProbe, error)
+
+var (
+	probeRegistryMu sync.RWMutex
+	probeRegistry   = make(map[string]ProbeFactory)
+)
+
+func init() {
+	RegisterProbe(ProbeTCP, func(options ProbeOptions) (HealthProbe, error) {
+		return NewTCPProbe(options.LocalAddr), nil
+	})
+	RegisterProbe(ProbeTCPSend, func(options ProbeOptions) (HealthProbe, error) {
+		return NewTCPSendProbe(options.Send, options.Expect, options.LocalAddr)
+	})
+	RegisterProbe(ProbeHTTP, func(options ProbeOptions) (HealthProbe, error) {
+		return NewHTTPProbe(options.Path, options.LocalAddr), nil
+	})
+	RegisterProbe(ProbeGRPC, func(options ProbeOptions) (HealthProbe, error) {
+		return NewGRPCProbe(options.Service, options.LocalAddr), nil
+	})
+}
+
+// RegisterProbe makes a health check type available under name. It is
+// meant to be called from init functions and panics if name is already
+// taken.
+func RegisterProbe(name string, factory ProbeFactory) {
+	probeRegistryMu.Lock()
+	defer probeRegistryMu.Unlock()
+
+	if _, exists := probeRegistry[name]; exists {
+		panic(fmt.Sprintf("backend: health probe %q registered twice", name))
+	}
+	probeRegistry[name] = factory
+}
+
+// NewProbe builds the probe registered under name.
+func NewProbe(name string, options ProbeOptions) (HealthProbe, error) {
+	probeRegistryMu.RLock()
+	factory, exists := probeRegistry[name]
+	probeRegistryMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownProbe, name)
+	}
+	return factory(options)
+}
+
+// IsProbeRegistered reports whether a health check type exists under name.
+func IsProbeRegistered(name string) bool {
+	probeRegistryMu.RLock()
+	defer probeRegistryMu.RUnlock()
+
+	_, exists := probeRegistry[name]
+	return exists
+}
+
+// ProbeTypes returns the names of all registered health check types, sorted.
+func ProbeTypes() []string {
+	probeRegistryMu.RLock()
+	defer probeRegistryMu.RUnlock()
+
+	names := make([]string, 0, len(probeRegistry))
+	for name := range probeRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
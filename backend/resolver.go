@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+	"zen/utils/logger"
+	"zen/utils/recovery"
+)
+
+// Resolver expands upstreams given as hostnames into one backend per resolved
+// IP and keeps the pool in sync as DNS records change.
+type Resolver struct {
+	pool      *Pool
+	upstreams []Upstream
+	interval  time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	lastKnown map[string][]string // upstream -> addresses currently in the pool
+}
+
+func NewResolver(pool *Pool, upstreams []Upstream, interval time.Duration) *Resolver {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lastKnown := make(map[string][]string, len(upstreams))
+	for _, upstream := range upstreams {
+		lastKnown[upstream.Address] = []string{upstream.Address}
+	}
+
+	return &Resolver{
+		pool:      pool,
+		upstreams: upstreams,
+		interval:  interval,
+		ctx:       ctx,
+		cancel:    cancel,
+		lastKnown: lastKnown,
+	}
+}
+
+// Start resolves every upstream once before returning, then keeps
+// re-resolving in the background on the configured interval.
+func (r *Resolver) Start() {
+	logger.Info("Starting DNS resolver with refresh interval: %s", r.interval)
+	r.resolveAll()
+
+	r.wg.Add(1)
+	go r.resolveLoop()
+}
+
+func (r *Resolver) Stop() {
+	logger.Info("Stopping DNS resolver...")
+	r.cancel()
+	r.wg.Wait()
+	logger.Info("DNS resolver stopped")
+}
+
+func (r *Resolver) resolveLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			func() {
+				defer recovery.Recover("DNS resolution")
+				r.resolveAll()
+			}()
+		}
+	}
+}
+
+func (r *Resolver) resolveAll() {
+	for _, upstream := range r.upstreams {
+		host, port, err := net.SplitHostPort(upstream.Address)
+		if err != nil {
+			logger.Warn("Skipping DNS resolution for invalid upstream %s: %s", upstream.Address, err)
+			continue
+		}
+
+		if net.ParseIP(host) != nil {
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupHost(r.ctx, host)
+		if err != nil || len(ips) == 0 {
+			logger.Warn("DNS resolution failed for %s, keeping last known backends: %v", upstream.Address, err)
+			continue
+		}
+
+		addresses := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip, port))
+		}
+
+		r.sync(upstream, addresses)
+	}
+}
+
+func (r *Resolver) sync(upstream Upstream, addresses []string) {
+	previous := make(map[string]bool, len(r.lastKnown[upstream.Address]))
+	for _, address := range r.lastKnown[upstream.Address] {
+		previous[address] = true
+	}
+
+	current := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		current[address] = true
+		if !previous[address] {
+			logger.Debug("DNS record %s appeared for %s", address, upstream.Address)
+			if err := r.pool.AddBackend(resolvedUpstream(upstream, address)); err != nil {
+				logger.Debug("Not adding %s for %s: %s", address, upstream.Address, err)
+			}
+		}
+	}
+
+	for address := range previous {
+		if !current[address] {
+			logger.Debug("DNS record %s disappeared for %s", address, upstream.Address)
+			if err := r.pool.RemoveBackend(address); err != nil {
+				logger.Warn("Failed to remove backend %s for %s: %s", address, upstream.Address, err)
+			}
+		}
+	}
+
+	r.lastKnown[upstream.Address] = addresses
+}
+
+// resolvedUpstream is upstream with address, one of its resolved IPs, in
+// place of the hostname, which stays the TLS server name. Every other
+// setting carries over. A health address on the same host follows it to
+// that IP, so each resolved backend is checked on its own; any other health
+// address is kept as configured.
+func resolvedUpstream(upstream Upstream, address string) Upstream {
+	resolved := upstream
+	resolved.Address = address
+
+	host, _, err := net.SplitHostPort(upstream.Address)
+	if err != nil {
+		return resolved
+	}
+	if resolved.ServerName == "" {
+		resolved.ServerName = host
+	}
+
+	if upstream.HealthAddress == "" {
+		return resolved
+	}
+	healthHost, healthPort, err := net.SplitHostPort(upstream.HealthAddress)
+	if err != nil || healthHost != host {
+		return resolved
+	}
+	ip, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return resolved
+	}
+	resolved.HealthAddress = net.JoinHostPort(ip, healthPort)
+	return resolved
+}
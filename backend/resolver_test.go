@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolvedBackendsKeepUpstreamSettings(t *testing.T) {
+	upstreams := []Upstream{
+		{Address: "db.internal:5432", HealthAddress: "db.internal:8008", Weight: 3, Priority: 1},
+		{Address: "cache.internal:6379", HealthAddress: "monitor.internal:9000", Weight: 2},
+		{Address: "web.internal:80", Weight: 5, Priority: 2},
+	}
+	pool := NewBackendPool(upstreams, &ConnectionPoolSettings{MaxIdle: 1, MaxActive: 1, IdleTimeout: time.Minute})
+	defer pool.Close()
+	r := NewResolver(pool, upstreams, time.Minute)
+
+	r.sync(upstreams[0], []string{"192.0.2.1:5432", "[2001:db8::1]:5432"})
+	r.sync(upstreams[1], []string{"192.0.2.2:6379"})
+	r.sync(upstreams[2], []string{"192.0.2.3:80"})
+
+	want := map[string]Upstream{
+		"192.0.2.1:5432":     {HealthAddress: "192.0.2.1:8008", Weight: 3, Priority: 1},
+		"[2001:db8::1]:5432": {HealthAddress: "[2001:db8::1]:8008", Weight: 3, Priority: 1},
+		"192.0.2.2:6379":     {HealthAddress: "monitor.internal:9000", Weight: 2},
+		"192.0.2.3:80":       {HealthAddress: "192.0.2.3:80", Weight: 5, Priority: 2},
+	}
+	// The hostname entries leave the pool once their removal completes
+	deadline := time.Now().Add(time.Second)
+	for len(pool.GetAllBackends()) > len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	backends := pool.GetAllBackends()
+	if len(backends) != len(want) {
+		t.Fatalf("%d backends after resolution, want %d: %v", len(backends), len(want), backends)
+	}
+	for _, b := range backends {
+		expected, exists := want[b.Address]
+		if !exists {
+			t.Errorf("unexpected backend %s", b.Address)
+			continue
+		}
+		if b.HealthAddress != expected.HealthAddress || b.Weight != expected.Weight || b.Priority != expected.Priority {
+			t.Errorf("%s: health_address=%s weight=%d priority=%d, want %s, %d, %d",
+				b.Address, b.HealthAddress, b.Weight, b.Priority, expected.HealthAddress, expected.Weight, expected.Priority)
+		}
+	}
+}
+
+// tlsBackend serves TLS on a loopback port with a certificate valid only
+// for hostname, with no IP addresses, and returns its address and a client
+// configuration trusting it.
+func tlsBackend(t *testing.T, hostname string) (string, *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %s", err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return ln.Addr().String(), &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+func TestResolvedBackendVerifiesTLSAgainstHostname(t *testing.T) {
+	address, clientTLS := tlsBackend(t, "backend.test")
+	_, port, _ := net.SplitHostPort(address)
+
+	upstreams := []Upstream{{Address: net.JoinHostPort("backend.test", port), Weight: 1}}
+	pool := NewBackendPool(upstreams, &ConnectionPoolSettings{
+		MaxIdle:     1,
+		MaxActive:   1,
+		IdleTimeout: time.Minute,
+		TLS:         clientTLS,
+	})
+	defer pool.Close()
+
+	// As if backend.test had resolved to the loopback address
+	NewResolver(pool, upstreams, time.Minute).sync(upstreams[0], []string{address})
+
+	var resolved *Backend
+	for _, b := range pool.GetAllBackends() {
+		if b.Address == address {
+			resolved = b
+		}
+	}
+	if resolved == nil {
+		t.Fatalf("no backend for %s in %v", address, pool.GetAllBackends())
+	}
+
+	conn, err := resolved.ConnectionPool.Get()
+	if err != nil {
+		t.Fatalf("TLS to the resolved address: %s", err)
+	}
+	defer conn.Close()
+	if name := conn.(*PooledConnection).NetConn().(*tls.Conn).ConnectionState().ServerName; name != "backend.test" {
+		t.Fatalf("SNI %q, want backend.test", name)
+	}
+}
@@ -0,0 +1,26 @@
+package backend
+
+import (
+	"errors"
+	"net"
+)
+
+// SetSocketBuffers sets the kernel receive and send buffer sizes of a TCP
+// connection. A zero size is left at the OS default, and connections that
+// are not TCP are left alone. The kernel may round or cap the sizes, e.g. to
+// net.core.rmem_max and net.core.wmem_max on Linux.
+func SetSocketBuffers(conn net.Conn, receive, send int) error {
+	tcpConnection, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	var errs []error
+	if receive > 0 {
+		errs = append(errs, tcpConnection.SetReadBuffer(receive))
+	}
+	if send > 0 {
+		errs = append(errs, tcpConnection.SetWriteBuffer(send))
+	}
+	return errors.Join(errs...)
+}
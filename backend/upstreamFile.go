@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zen/utils/logger"
+	"zen/utils/recovery"
+)
+
+// upstreamFilePollInterval is how often a watched upstream file is checked
+// for a new modification time.
+const upstreamFilePollInterval = 2 * time.Second
+
+// ReadUpstreamFile parses a file listing one backend per line, either as
+// "address" or "address weight". Blank lines and lines starting with # are
+// ignored. Malformed lines are skipped with a warning so that one typo does
+// not take every other backend down with it.
+func ReadUpstreamFile(path string) ([]Upstream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var upstreams []Upstream
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		upstream, err := parseUpstreamLine(line)
+		if err != nil {
+			logger.Warn("Skipping line %d of %s: %s", lineNumber, path, err)
+			continue
+		}
+		if seen[upstream.Address] {
+			logger.Warn("Skipping line %d of %s: duplicate upstream %s", lineNumber, path, upstream.Address)
+			continue
+		}
+
+		seen[upstream.Address] = true
+		upstreams = append(upstreams, upstream)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+func parseUpstreamLine(line string) (Upstream, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return Upstream{}, fmt.Errorf("expected \"address\" or \"address weight\", got %q", line)
+	}
+
+	host, port, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		return Upstream{}, fmt.Errorf("upstream %q: %w", fields[0], err)
+	}
+	if host == "" || port == "" {
+		return Upstream{}, fmt.Errorf("upstream %q: both host and port are required", fields[0])
+	}
+
+	upstream := Upstream{Address: fields[0], Weight: 1}
+	if len(fields) == 2 {
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight <= 0 {
+			return Upstream{}, fmt.Errorf("upstream %q: weight must be a positive integer, got %q", fields[0], fields[1])
+		}
+		upstream.Weight = weight
+	}
+	return upstream, nil
+}
+
+// UpstreamFileWatcher keeps a pool in sync with an upstream file, adding
+// and removing backends as lines are added to and removed from it.
+type UpstreamFileWatcher struct {
+	pool    *Pool
+	path    string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	modTime time.Time
+	size    int64
+	current map[string]int // address -> weight of the backends the file put in the pool
+}
+
+// NewUpstreamFileWatcher watches path for a pool that was built from
+// upstreams, the file's contents at startup.
+func NewUpstreamFileWatcher(pool *Pool, path string, upstreams []Upstream) *UpstreamFileWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	current := make(map[string]int, len(upstreams))
+	for _, upstream := range upstreams {
+		current[upstream.Address] = upstream.Weight
+	}
+
+	watcher := &UpstreamFileWatcher{
+		pool:    pool,
+		path:    path,
+		ctx:     ctx,
+		cancel:  cancel,
+		current: current,
+	}
+	if info, err := os.Stat(path); err == nil {
+		watcher.modTime, watcher.size = info.ModTime(), info.Size()
+	}
+	return watcher
+}
+
+func (w *UpstreamFileWatcher) Start() {
+	logger.Info("Watching upstream file %s for changes", w.path)
+
+	w.wg.Add(1)
+	go w.watchLoop()
+}
+
+func (w *UpstreamFileWatcher) Stop() {
+	logger.Info("Stopping upstream file watcher...")
+	w.cancel()
+	w.wg.Wait()
+	logger.Info("Upstream file watcher stopped")
+}
+
+func (w *UpstreamFileWatcher) watchLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(upstreamFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			func() {
+				defer recovery.Recover("upstream file reload")
+				w.poll()
+			}()
+		}
+	}
+}
+
+// poll reloads the file when its modification time or size has changed.
+// A file that cannot be read or lists no valid upstream leaves the pool
+// as it is, since that is more likely a write in progress than an intent
+// to remove every backend.
+func (w *UpstreamFileWatcher) poll() {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		logger.Warn("Cannot stat upstream file %s, keeping current backends: %s", w.path, err)
+		return
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+
+	upstreams, err := ReadUpstreamFile(w.path)
+	if err != nil {
+		logger.Warn("Cannot read upstream file %s, keeping current backends: %s", w.path, err)
+		return
+	}
+	if len(upstreams) == 0 {
+		logger.Warn("Upstream file %s lists no valid upstream, keeping current backends", w.path)
+		return
+	}
+
+	logger.Info("Upstream file %s changed, reloading %d upstreams", w.path, len(upstreams))
+	w.sync(upstreams)
+}
+
+func (w *UpstreamFileWatcher) sync(upstreams []Upstream) {
+	next := make(map[string]int, len(upstreams))
+	for _, upstream := range upstreams {
+		next[upstream.Address] = upstream.Weight
+
+		weight, known := w.current[upstream.Address]
+		if !known {
+			if err := w.pool.AddBackend(upstream); err != nil {
+				logger.Warn("Not adding %s from %s: %s", upstream.Address, w.path, err)
+			}
+		} else if weight != upstream.Weight {
+			logger.Warn("Weight of %s changed from %d to %d in %s; remove and re-add the line to apply it",
+				upstream.Address, weight, upstream.Weight, w.path)
+			next[upstream.Address] = weight
+		}
+	}
+
+	for address := range w.current {
+		if _, keep := next[address]; !keep {
+			if err := w.pool.RemoveBackend(address); err != nil {
+				logger.Warn("Failed to remove backend %s listed in %s: %s", address, w.path, err)
+			}
+		}
+	}
+
+	w.current = next
+}
@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// UpstreamTLSSettings describes the TLS connections made to backends.
+type UpstreamTLSSettings struct {
+	ServerName         string // empty verifies each backend against the host of its address
+	CAFile             string // empty uses the system roots
+	InsecureSkipVerify bool
+	ClientCert         string
+	ClientKey          string
+}
+
+// NewUpstreamTLSConfig loads the CA bundle and client certificate named in
+// settings into a client side TLS configuration.
+func NewUpstreamTLSConfig(settings *UpstreamTLSSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s contains no PEM certificate", settings.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if settings.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.ClientCert, settings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,134 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+	"time"
+	"zen/backend"
+	"zen/utils/recovery"
+)
+
+// Affinity sends a key, normally a client IP, back to the backend it last
+// used as long as it returns within the TTL and that backend is still alive.
+// New keys and expired ones are spread by the wrapped balancer. Unlike
+// Sticky, nothing pins a key for good: an entry lives for TTL after its last
+// use and is then forgotten.
+type Affinity struct {
+	fallback    LoadBalancer
+	backendPool *backend.Pool
+	ttl         time.Duration
+
+	mu      sync.Mutex
+	entries map[string]affinityEntry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	selectionCounter
+}
+
+type affinityEntry struct {
+	backend   *backend.Backend
+	expiresAt time.Time
+}
+
+// NewAffinity wraps fallback with an affinity table and starts the
+// background sweep of expired entries. Call Stop to end it.
+func NewAffinity(fallback LoadBalancer, backendPool *backend.Pool, ttl time.Duration) *Affinity {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a := &Affinity{
+		fallback:    fallback,
+		backendPool: backendPool,
+		ttl:         ttl,
+		entries:     make(map[string]affinityEntry),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	a.wg.Add(1)
+	go a.sweepLoop()
+	return a
+}
+
+func (a *Affinity) Next() (*backend.Backend, error) {
+	return a.selected(a.fallback.Next())
+}
+
+// NextForKey returns the backend remembered for key, or asks the wrapped
+// balancer when there is none or it is no longer usable. The choice is only
+// remembered once a connection to it succeeds, through Pin.
+func (a *Affinity) NextForKey(key string) (*backend.Backend, error) {
+	a.mu.Lock()
+	entry, exists := a.entries[key]
+	a.mu.Unlock()
+
+	if exists && time.Now().Before(entry.expiresAt) && a.isAvailable(entry.backend) {
+		return a.selected(entry.backend, nil)
+	}
+	return a.selected(a.fallback.Next())
+}
+
+// isAvailable reports whether b is still in the pool's alive set, which
+// rules out backends that died, are draining or were removed by DNS.
+func (a *Affinity) isAvailable(b *backend.Backend) bool {
+	for _, alive := range a.backendPool.GetAliveBackends() {
+		if alive == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Pin records that key was served by b, restarting its TTL.
+func (a *Affinity) Pin(key string, b *backend.Backend) {
+	a.mu.Lock()
+	a.entries[key] = affinityEntry{backend: b, expiresAt: time.Now().Add(a.ttl)}
+	a.mu.Unlock()
+}
+
+func (a *Affinity) GetAvailableCount() int {
+	return a.fallback.GetAvailableCount()
+}
+
+func (a *Affinity) GetAliveBackends() []*backend.Backend {
+	return a.backendPool.GetAliveBackends()
+}
+
+func (a *Affinity) Stop() {
+	a.cancel()
+	a.wg.Wait()
+}
+
+func (a *Affinity) sweepLoop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			func() {
+				defer recovery.Recover("affinity sweep")
+				a.sweep()
+			}()
+		}
+	}
+}
+
+func (a *Affinity) sweep() {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, entry := range a.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(a.entries, key)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"zen/backend"
+)
+
+// defaultHalfLife is used when the half_life param is not set.
+const defaultHalfLife = 10 * time.Second
+
+func init() {
+	Register(StrategyLeastRequest, func(pool *backend.Pool, options Options) (LoadBalancer, error) {
+		halfLife := defaultHalfLife
+		if value, ok := options.Params["half_life"]; ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("least_request: half_life must be a positive duration, got %q", value)
+			}
+			halfLife = parsed
+		}
+		return NewLeastRequest(pool, halfLife), nil
+	})
+}
+
+// LeastRequest picks the backend that was handed the fewest requests
+// recently. Each backend's count decays exponentially, halving every
+// halfLife, so old bursts stop counting against it. Unlike least
+// connections it still spreads load when connections are too short lived
+// to ever overlap. Ties are broken by taking the first in the scan, which
+// starts after the last pick.
+type LeastRequest struct {
+	backendPool *backend.Pool
+	halfLife    time.Duration
+
+	mu       sync.Mutex
+	counts   map[*backend.Backend]*decayingCount
+	backends []*backend.Backend // the alive set counts was last pruned to
+	next     int
+
+	selectionCounter
+}
+
+type decayingCount struct {
+	value     float64
+	updatedAt time.Time
+}
+
+// at returns the count decayed to now.
+func (c *decayingCount) at(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(c.updatedAt)
+	return c.value * math.Exp2(-float64(elapsed)/float64(halfLife))
+}
+
+func NewLeastRequest(backendPool *backend.Pool, halfLife time.Duration) *LeastRequest {
+	return &LeastRequest{
+		backendPool: backendPool,
+		halfLife:    halfLife,
+		counts:      make(map[*backend.Backend]*decayingCount),
+	}
+}
+
+func (lr *LeastRequest) Next() (*backend.Backend, error) {
+	aliveBackends := lr.backendPool.GetAliveBackends()
+	if len(aliveBackends) == 0 {
+		return nil, ErrNoAvailableBackends
+	}
+
+	now := time.Now()
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	lr.prune(aliveBackends, now)
+
+	start := lr.next % len(aliveBackends)
+	var selected *backend.Backend
+	var selectedCount float64
+	for i := range aliveBackends {
+		candidate := aliveBackends[(start+i)%len(aliveBackends)]
+
+		count := lr.counts[candidate].at(now, lr.halfLife)
+		if selected == nil || count < selectedCount {
+			selected, selectedCount = candidate, count
+		}
+	}
+
+	lr.counts[selected].value = selectedCount + 1
+	lr.counts[selected].updatedAt = now
+	lr.next = start + 1
+	lr.record(selected)
+	return selected, nil
+}
+
+func (lr *LeastRequest) GetAvailableCount() int {
+	return len(lr.backendPool.GetAliveBackends())
+}
+
+func (lr *LeastRequest) GetAliveBackends() []*backend.Backend {
+	return lr.backendPool.GetAliveBackends()
+}
+
+// prune drops the counts of backends that left the alive set and starts
+// those that joined it at the lowest current count, rather than at zero
+// where they would draw every request until they caught up. Must be called
+// with lr.mu held.
+func (lr *LeastRequest) prune(aliveBackends []*backend.Backend, now time.Time) {
+	if sameBackends(lr.backends, aliveBackends) {
+		return
+	}
+
+	alive := make(map[*backend.Backend]bool, len(aliveBackends))
+	for _, b := range aliveBackends {
+		alive[b] = true
+	}
+	lowest := math.Inf(1)
+	for b, c := range lr.counts {
+		if !alive[b] {
+			delete(lr.counts, b)
+			continue
+		}
+		lowest = min(lowest, c.at(now, lr.halfLife))
+	}
+	if math.IsInf(lowest, 1) {
+		lowest = 0
+	}
+
+	for _, b := range aliveBackends {
+		if _, exists := lr.counts[b]; !exists {
+			lr.counts[b] = &decayingCount{value: lowest, updatedAt: now}
+		}
+	}
+	lr.backends = aliveBackends
+}
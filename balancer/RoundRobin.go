@@ -1,33 +1,73 @@
 package balancer
 
 import (
-	"errors"
-	"sync/atomic"
+	"sync"
 	"zen/backend"
 )
 
+func init() {
+	Register(StrategyRoundRobin, func(pool *backend.Pool, options Options) (LoadBalancer, error) {
+		return NewRoundRobin(pool), nil
+	})
+}
+
+// RoundRobin hands out alive backends in turn. It remembers the backend it
+// picked last rather than a bare counter, so when the alive set is rebuilt
+// after a status change the rotation resumes right after that backend instead
+// of jumping to wherever a growing counter modulo the new size happens to land.
 type RoundRobin struct {
 	backendPool *backend.Pool
-	counter     atomic.Uint64
+
+	mu        sync.Mutex
+	last      *backend.Backend
+	lastIndex int
+
+	selectionCounter
 }
 
 func NewRoundRobin(backendPool *backend.Pool) *RoundRobin {
 	return &RoundRobin{
 		backendPool: backendPool,
+		lastIndex:   -1,
 	}
 }
 
 func (rr *RoundRobin) Next() (*backend.Backend, error) {
 	aliveBackends := rr.backendPool.GetAliveBackends()
-	if aliveBackends == nil || len(aliveBackends) == 0 {
-		return nil, errors.New("no available backends")
+	if len(aliveBackends) == 0 {
+		return nil, ErrNoAvailableBackends
 	}
 
-	next := rr.counter.Add(1)
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
 
-	selectedIndex := int(next % uint64(len(aliveBackends)))
+	selectedIndex := rr.nextIndex(aliveBackends)
+	rr.last = aliveBackends[selectedIndex]
+	rr.lastIndex = selectedIndex
+	rr.record(rr.last)
 
-	return aliveBackends[selectedIndex], nil
+	return rr.last, nil
+}
+
+// nextIndex returns the position following the last selected backend in the
+// current alive set. If that backend has left the set, its successor has
+// shifted into its old position, so selection continues from there.
+func (rr *RoundRobin) nextIndex(aliveBackends []*backend.Backend) int {
+	if rr.lastIndex < 0 {
+		return 0
+	}
+
+	if rr.lastIndex < len(aliveBackends) && aliveBackends[rr.lastIndex] == rr.last {
+		return (rr.lastIndex + 1) % len(aliveBackends)
+	}
+
+	for i, b := range aliveBackends {
+		if b == rr.last {
+			return (i + 1) % len(aliveBackends)
+		}
+	}
+
+	return rr.lastIndex % len(aliveBackends)
 }
 
 func (rr *RoundRobin) GetAvailableCount() int {
@@ -37,3 +77,7 @@ func (rr *RoundRobin) GetAvailableCount() int {
 	}
 	return len(aliveBackends)
 }
+
+func (rr *RoundRobin) GetAliveBackends() []*backend.Backend {
+	return rr.backendPool.GetAliveBackends()
+}
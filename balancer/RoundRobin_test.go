@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"testing"
+)
+
+func TestRoundRobinStartsAtFirstBackend(t *testing.T) {
+	pool := newTestPool(t, 3)
+	rr := NewRoundRobin(pool)
+
+	backends := pool.GetAliveBackends()
+	for i := 0; i < 6; i++ {
+		selected, err := rr.Next()
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		if want := backends[i%len(backends)]; selected != want {
+			t.Fatalf("pick %d: got %s, want %s", i, selected.Address, want.Address)
+		}
+	}
+}
+
+func TestRoundRobinResumesAfterLastBackend(t *testing.T) {
+	pool := newTestPool(t, 4)
+	rr := NewRoundRobin(pool)
+	backends := pool.GetAliveBackends()
+
+	rr.Next()
+	rr.Next() // backends[1]
+
+	// Removing a backend before the last pick shifts it down one position
+	if err := pool.DrainBackend(backends[0].Address); err != nil {
+		t.Fatalf("DrainBackend: %s", err)
+	}
+	if selected, _ := rr.Next(); selected != backends[2] {
+		t.Fatalf("after the alive set shrank: got %s, want %s", selected.Address, backends[2].Address)
+	}
+
+	// The last pick leaving the set continues with its successor
+	if err := pool.DrainBackend(backends[2].Address); err != nil {
+		t.Fatalf("DrainBackend: %s", err)
+	}
+	if selected, _ := rr.Next(); selected != backends[3] {
+		t.Fatalf("after the last pick left: got %s, want %s", selected.Address, backends[3].Address)
+	}
+}
+
+func TestRoundRobinEvenUnderChurn(t *testing.T) {
+	pool := newTestPool(t, 4)
+	rr := NewRoundRobin(pool)
+	backends := pool.GetAliveBackends()
+	flapping := backends[2]
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		// Flap one backend at an interval that shares no factor with the
+		// set sizes, so a counter modulo the size would drift
+		if i%7 == 6 {
+			var err error
+			if flapping.IsDraining() {
+				err = pool.UndrainBackend(flapping.Address)
+			} else {
+				err = pool.DrainBackend(flapping.Address)
+			}
+			if err != nil {
+				t.Fatalf("flap: %s", err)
+			}
+		}
+
+		selected, err := rr.Next()
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		counts[selected.Address]++
+	}
+
+	// The backends that never left must be picked evenly
+	lowest, highest := counts[backends[0].Address], counts[backends[0].Address]
+	for _, b := range backends {
+		if b == flapping {
+			continue
+		}
+		lowest, highest = min(lowest, counts[b.Address]), max(highest, counts[b.Address])
+	}
+	if float64(highest-lowest) > 0.05*float64(highest) {
+		t.Fatalf("stable backends picked between %d and %d times: %v", lowest, highest, counts)
+	}
+}
@@ -0,0 +1,96 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"zen/backend"
+)
+
+// virtualNodes is the number of points each backend gets on the hash ring.
+// More points spread keys more evenly at the cost of a larger ring.
+const virtualNodes = 100
+
+// Sticky maps keys to backends with consistent hashing, so a key keeps
+// landing on the same backend and only the keys of a removed backend move.
+// Connections without a key are handed to the wrapped balancer.
+type Sticky struct {
+	fallback    LoadBalancer
+	backendPool *backend.Pool
+
+	mu       sync.Mutex
+	backends []*backend.Backend // the alive set the ring was built from
+	ring     []ringPoint
+
+	selectionCounter
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend.Backend
+}
+
+func NewSticky(fallback LoadBalancer, backendPool *backend.Pool) *Sticky {
+	return &Sticky{
+		fallback:    fallback,
+		backendPool: backendPool,
+	}
+}
+
+func (s *Sticky) Next() (*backend.Backend, error) {
+	return s.selected(s.fallback.Next())
+}
+
+func (s *Sticky) NextForKey(key string) (*backend.Backend, error) {
+	ring := s.currentRing()
+	if len(ring) == 0 {
+		return nil, ErrNoAvailableBackends
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return s.selected(ring[i].backend, nil)
+}
+
+func (s *Sticky) GetAvailableCount() int {
+	return s.fallback.GetAvailableCount()
+}
+
+func (s *Sticky) GetAliveBackends() []*backend.Backend {
+	return s.backendPool.GetAliveBackends()
+}
+
+// currentRing returns the ring for the current alive set, rebuilding it only
+// when that set has changed.
+func (s *Sticky) currentRing() []ringPoint {
+	aliveBackends := s.backendPool.GetAliveBackends()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sameBackends(s.backends, aliveBackends) {
+		return s.ring
+	}
+
+	ring := make([]ringPoint, 0, len(aliveBackends)*virtualNodes)
+	for _, b := range aliveBackends {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(b.Address + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	s.backends = aliveBackends
+	s.ring = ring
+	return ring
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
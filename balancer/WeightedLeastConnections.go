@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"sync/atomic"
+	"zen/backend"
+)
+
+func init() {
+	Register(StrategyWeightedLeastConns, func(pool *backend.Pool, options Options) (LoadBalancer, error) {
+		return NewWeightedLeastConnections(pool), nil
+	})
+}
+
+// WeightedLeastConnections picks the backend minimizing active connections
+// divided by weight. Ties are broken round-robin by rotating the scan start.
+type WeightedLeastConnections struct {
+	backendPool *backend.Pool
+	counter     atomic.Uint64
+
+	selectionCounter
+}
+
+func NewWeightedLeastConnections(backendPool *backend.Pool) *WeightedLeastConnections {
+	return &WeightedLeastConnections{
+		backendPool: backendPool,
+	}
+}
+
+func (wlc *WeightedLeastConnections) Next() (*backend.Backend, error) {
+	aliveBackends := wlc.backendPool.GetAliveBackends()
+	if len(aliveBackends) == 0 {
+		return nil, ErrNoAvailableBackends
+	}
+
+	start := int(wlc.counter.Add(1) % uint64(len(aliveBackends)))
+
+	var selected *backend.Backend
+	var selectedActive, selectedWeight int64
+	for i := range aliveBackends {
+		candidate := aliveBackends[(start+i)%len(aliveBackends)]
+		active := candidate.ActiveConnections()
+		weight := int64(candidate.EffectiveWeight(0))
+
+		// active/weight < selectedActive/selectedWeight, without division
+		if selected == nil || active*selectedWeight < selectedActive*weight {
+			selected, selectedActive, selectedWeight = candidate, active, weight
+		}
+	}
+
+	wlc.record(selected)
+	return selected, nil
+}
+
+func (wlc *WeightedLeastConnections) GetAvailableCount() int {
+	return len(wlc.backendPool.GetAliveBackends())
+}
+
+func (wlc *WeightedLeastConnections) GetAliveBackends() []*backend.Backend {
+	return wlc.backendPool.GetAliveBackends()
+}
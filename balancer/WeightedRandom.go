@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"zen/backend"
+)
+
+func init() {
+	Register(StrategyWeightedRandom, func(pool *backend.Pool, options Options) (LoadBalancer, error) {
+		return NewWeightedRandom(pool), nil
+	})
+}
+
+// WeightedRandom picks a backend with probability proportional to its weight
+// using a single random draw over a cumulative weight table. It is cheaper
+// than smooth weighted round-robin but only fair over many picks.
+type WeightedRandom struct {
+	backendPool *backend.Pool
+	table       atomic.Pointer[weightTable]
+
+	selectionCounter
+}
+
+// weightTable is built from one alive set and reused until that set changes.
+type weightTable struct {
+	backends   []*backend.Backend
+	weights    []int
+	cumulative []int64
+	total      int64
+}
+
+func NewWeightedRandom(backendPool *backend.Pool) *WeightedRandom {
+	return &WeightedRandom{
+		backendPool: backendPool,
+	}
+}
+
+func (wr *WeightedRandom) Next() (*backend.Backend, error) {
+	aliveBackends := wr.backendPool.GetAliveBackends()
+	if len(aliveBackends) == 0 {
+		return nil, ErrNoAvailableBackends
+	}
+
+	table := wr.currentTable(aliveBackends)
+
+	// Without any weight to go by every backend is equally likely
+	if table.total <= 0 {
+		return wr.selected(aliveBackends[rand.Intn(len(aliveBackends))], nil)
+	}
+
+	draw := rand.Int63n(table.total)
+	i := sort.Search(len(table.cumulative), func(i int) bool { return table.cumulative[i] > draw })
+	return wr.selected(table.backends[i], nil)
+}
+
+func (wr *WeightedRandom) GetAvailableCount() int {
+	return len(wr.backendPool.GetAliveBackends())
+}
+
+func (wr *WeightedRandom) GetAliveBackends() []*backend.Backend {
+	return wr.backendPool.GetAliveBackends()
+}
+
+// currentTable returns the cached table, rebuilding it when the alive set or
+// any weight differs from the one it was built from.
+func (wr *WeightedRandom) currentTable(aliveBackends []*backend.Backend) *weightTable {
+	if table := wr.table.Load(); table != nil && table.matches(aliveBackends) {
+		return table
+	}
+
+	table := &weightTable{
+		backends:   aliveBackends,
+		weights:    make([]int, len(aliveBackends)),
+		cumulative: make([]int64, len(aliveBackends)),
+	}
+	for i, b := range aliveBackends {
+		table.weights[i] = b.EffectiveWeight(0)
+		table.total += int64(table.weights[i])
+		table.cumulative[i] = table.total
+	}
+
+	wr.table.Store(table)
+	return table
+}
+
+func (t *weightTable) matches(aliveBackends []*backend.Backend) bool {
+	if !sameBackends(t.backends, aliveBackends) {
+		return false
+	}
+	for i, b := range aliveBackends {
+		if b.EffectiveWeight(0) != t.weights[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+	"zen/backend"
+)
+
+func init() {
+	Register(StrategyWeightedRoundRobin, func(pool *backend.Pool, options Options) (LoadBalancer, error) {
+		return NewWeightedRoundRobin(pool, options.SlowStart), nil
+	})
+}
+
+// WeightedRoundRobin implements smooth weighted round-robin: every pick adds
+// each backend's weight to its running score, selects the highest score and
+// subtracts the total weight from the winner. Heavier backends are chosen
+// proportionally more often without being picked in bursts.
+type WeightedRoundRobin struct {
+	backendPool *backend.Pool
+	slowStart   time.Duration
+	mu          sync.Mutex
+	current     map[*backend.Backend]int
+
+	selectionCounter
+}
+
+func NewWeightedRoundRobin(backendPool *backend.Pool, slowStart time.Duration) *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		backendPool: backendPool,
+		slowStart:   slowStart,
+		current:     make(map[*backend.Backend]int),
+	}
+}
+
+func (wrr *WeightedRoundRobin) Next() (*backend.Backend, error) {
+	aliveBackends := wrr.backendPool.GetAliveBackends()
+	if len(aliveBackends) == 0 {
+		return nil, ErrNoAvailableBackends
+	}
+
+	wrr.mu.Lock()
+	defer wrr.mu.Unlock()
+
+	if len(wrr.current) > len(aliveBackends) {
+		wrr.prune(aliveBackends)
+	}
+
+	total := 0
+	var selected *backend.Backend
+	for _, b := range aliveBackends {
+		weight := b.EffectiveWeight(wrr.slowStart)
+		wrr.current[b] += weight
+		total += weight
+
+		if selected == nil || wrr.current[b] > wrr.current[selected] {
+			selected = b
+		}
+	}
+
+	wrr.current[selected] -= total
+	wrr.record(selected)
+	return selected, nil
+}
+
+func (wrr *WeightedRoundRobin) GetAvailableCount() int {
+	return len(wrr.backendPool.GetAliveBackends())
+}
+
+func (wrr *WeightedRoundRobin) GetAliveBackends() []*backend.Backend {
+	return wrr.backendPool.GetAliveBackends()
+}
+
+// prune forgets scores of backends that left the alive set. Must be called with wrr.mu held.
+func (wrr *WeightedRoundRobin) prune(aliveBackends []*backend.Backend) {
+	alive := make(map[*backend.Backend]bool, len(aliveBackends))
+	for _, b := range aliveBackends {
+		alive[b] = true
+	}
+
+	for b := range wrr.current {
+		if !alive[b] {
+			delete(wrr.current, b)
+		}
+	}
+}
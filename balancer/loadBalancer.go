@@ -1,10 +1,50 @@
 package balancer
 
 import (
+	"errors"
 	"zen/backend"
 )
 
+var ErrNoAvailableBackends = errors.New("no available backends")
+
 type LoadBalancer interface {
 	Next() (*backend.Backend, error)
 	GetAvailableCount() int
 }
+
+// KeyedBalancer is implemented by balancers that can pin a key, such as a
+// session cookie or client IP, to the same backend across connections.
+type KeyedBalancer interface {
+	LoadBalancer
+	NextForKey(key string) (*backend.Backend, error)
+}
+
+// PinningBalancer is a KeyedBalancer that learns which backend a key went
+// to, so it can only remember backends a connection was actually made to.
+type PinningBalancer interface {
+	KeyedBalancer
+	Pin(key string, b *backend.Backend)
+}
+
+// ListingBalancer is implemented by balancers that can list the backends
+// they currently pick from. Listing is not a selection: nothing is counted
+// or moved, so a caller can look for a backend of its own, such as a hedge
+// partner, without skewing the balancing.
+type ListingBalancer interface {
+	LoadBalancer
+	GetAliveBackends() []*backend.Backend
+}
+
+// sameBackends reports whether two alive sets hold the same backends in the
+// same order, letting balancers reuse state derived from the previous set.
+func sameBackends(a, b []*backend.Backend) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+	"zen/backend"
+)
+
+// newTestPool returns a pool of count backends with weights 1 to count,
+// which are never dialed.
+func newTestPool(t testing.TB, count int) *backend.Pool {
+	t.Helper()
+
+	upstreams := make([]backend.Upstream, 0, count)
+	for i := 0; i < count; i++ {
+		upstreams = append(upstreams, backend.Upstream{Address: fmt.Sprintf("127.0.0.1:%d", 10001+i), Weight: i + 1})
+	}
+	pool := backend.NewBackendPool(upstreams, nil)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// BenchmarkNext measures each registered strategy's Next with every
+// processor selecting at once.
+func BenchmarkNext(b *testing.B) {
+	for _, strategy := range Strategies() {
+		b.Run(strategy, func(b *testing.B) {
+			lb, err := New(strategy, newTestPool(b, 8), Options{})
+			if err != nil {
+				b.Fatalf("New: %s", err)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := lb.Next(); err != nil {
+						b.Errorf("Next: %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkNextForKey measures the key based balancers over a spread of
+// client keys.
+func BenchmarkNextForKey(b *testing.B) {
+	pool := newTestPool(b, 8)
+	affinity := NewAffinity(NewRoundRobin(pool), pool, time.Minute)
+	b.Cleanup(affinity.Stop)
+
+	balancers := []struct {
+		name string
+		lb   KeyedBalancer
+	}{
+		{"sticky", NewSticky(NewRoundRobin(pool), pool)},
+		{"affinity", affinity},
+	}
+	for _, test := range balancers {
+		b.Run(test.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := test.lb.NextForKey(strconv.Itoa(i % 1024)); err != nil {
+						b.Errorf("NextForKey: %s", err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"zen/backend"
+)
+
+// Names of the built-in strategies.
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyWeightedLeastConns = "weighted_least_connections"
+	StrategyWeightedRandom     = "weighted_random"
+	StrategyLeastRequest       = "least_request"
+)
+
+var ErrUnknownStrategy = errors.New("unknown balancer strategy")
+
+// Options carries the balancer settings from the configuration. Backend
+// weights are not repeated here; they travel with each backend.Backend.
+type Options struct {
+	SlowStart time.Duration
+	Params    map[string]string // strategy specific parameters
+}
+
+// Factory builds a balancer for one upstream group.
+type Factory func(pool *backend.Pool, options Options) (LoadBalancer, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a strategy available under name. It is meant to be called
+// from init functions and panics if name is already taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("balancer: strategy %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New builds the balancer registered under name.
+func New(name string, pool *backend.Pool, options Options) (LoadBalancer, error) {
+	registryMu.RLock()
+	factory, exists := registry[name]
+	registryMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("%w %q", ErrUnknownStrategy, name)
+	}
+	return factory(pool, options)
+}
+
+// IsRegistered reports whether a strategy exists under name.
+func IsRegistered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, exists := registry[name]
+	return exists
+}
+
+// Strategies returns the names of all registered strategies, sorted.
+func Strategies() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
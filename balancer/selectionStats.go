@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"sync"
+	"sync/atomic"
+	"zen/backend"
+)
+
+// StatsBalancer is implemented by balancers that count how often they handed
+// out each backend, so an operator can check the load is actually spread.
+// Wrapping balancers such as Sticky count what they return themselves, for a
+// key or not.
+type StatsBalancer interface {
+	LoadBalancer
+	Stats() map[string]uint64
+}
+
+// selectionCounter counts selections per backend address. A counter is
+// created the first time an address is selected and only incremented
+// atomically after that, so recording a selection never takes a lock.
+// Backends that left the pool keep their counts.
+type selectionCounter struct {
+	counts sync.Map // address -> *atomic.Uint64
+}
+
+func (c *selectionCounter) record(b *backend.Backend) {
+	counter, ok := c.counts.Load(b.Address)
+	if !ok {
+		counter, _ = c.counts.LoadOrStore(b.Address, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// selected records a successful selection and passes the result through.
+func (c *selectionCounter) selected(b *backend.Backend, err error) (*backend.Backend, error) {
+	if err == nil {
+		c.record(b)
+	}
+	return b, err
+}
+
+// Stats returns how many times each backend was selected.
+func (c *selectionCounter) Stats() map[string]uint64 {
+	stats := make(map[string]uint64)
+	c.counts.Range(func(address, counter any) bool {
+		stats[address.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return stats
+}
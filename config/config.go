@@ -1,46 +1,348 @@
 package config
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v3"
-	"os"
+	"net"
+	"strings"
 	"time"
+	"zen/backend"
+	zenbalancer "zen/balancer"
 	"zen/utils/logger"
 )
 
+const (
+	ModeTCP  = "tcp"
+	ModeHTTP = "http"
+)
+
+const (
+	HealthCheckTCP  = backend.ProbeTCP
+	HealthCheckHTTP = backend.ProbeHTTP
+	HealthCheckGRPC = backend.ProbeGRPC
+	HealthCheckSend = backend.ProbeTCPSend
+)
+
+const (
+	ErrorResponseNone   = "none"
+	ErrorResponseHTTP   = "http"
+	ErrorResponseCustom = "custom"
+)
+
+const (
+	OnNoBackendsReject = "reject"
+	OnNoBackendsWait   = "wait"
+)
+
 type Config struct {
 	Server struct {
-		Port string `yaml:"port" envconfig:"SERVER_PORT"`
+		Port        string `yaml:"port" envconfig:"SERVER_PORT"`
+		Mode        string `yaml:"mode"`
+		Maintenance bool   `yaml:"maintenance"`
+		ReusePort   bool   `yaml:"reuse_port"` // Let several processes bind the same listener addresses
+
+		// ProxyProtocol expects a PROXY protocol header on every connection
+		// to the default listener and uses the client address it carries.
+		ProxyProtocol bool `yaml:"proxy_protocol"`
+
+		// DrainGracePeriod is how long after POST /drain new connections
+		// are still accepted, while readiness already fails.
+		DrainGracePeriod time.Duration `yaml:"drain_grace_period"`
+
+		// ShutdownTimeout is how long a shutdown waits for connections to
+		// finish before closing the ones still open.
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 	} `yaml:"server"`
-	Upstream    []string     `yaml:"upstream"`
+	Upstream           []Upstream      `yaml:"upstream"`
+	UpstreamFile       string          `yaml:"upstream_file"`        // Read upstreams from this file and follow its changes
+	UpstreamSourceAddr string          `yaml:"upstream_source_addr"` // Local IP backend connections are made from
+	Routes             []Route         `yaml:"routes,omitempty"`
+	Balancer           *Balancer       `yaml:"balancer,omitempty"`
+	HealthCheck        *HealthCheck    `yaml:"health_check,omitempty"`
+	UpstreamTLS        *UpstreamTLS    `yaml:"upstream_tls,omitempty"`
+	ConnectionPool     *ConnectionPool `yaml:"connection_pool,omitempty"`
+	DNS                *DNS            `yaml:"dns,omitempty"`
+	Proxy              *Proxy          `yaml:"proxy,omitempty"`
+	Admin              *Admin          `yaml:"admin,omitempty"`
+	Logging            *Logging        `yaml:"logging,omitempty"`
+	Limits             *Limits         `yaml:"limits,omitempty"`
+	AccessLog          *AccessLog      `yaml:"access_log,omitempty"`
+	ErrorResponse      *ErrorResponse  `yaml:"error_response,omitempty"`
+	AccessControl      *AccessControl  `yaml:"access_control,omitempty"`
+	Listeners          []*Listener     `yaml:"listeners,omitempty"`
+}
+
+// Listener is one bind address with its own upstream group. When no listeners
+// are configured, a single one is built from server.port and the top level
+// upstream, routes, balancer and health_check settings.
+type Listener struct {
+	Name        string       `yaml:"name"`
+	Address     string       `yaml:"address"`
+	Mode        string       `yaml:"mode"`
+	Upstream    []Upstream   `yaml:"upstream"`
+	Routes      []Route      `yaml:"routes,omitempty"`
+	Balancer    *Balancer    `yaml:"balancer,omitempty"`
 	HealthCheck *HealthCheck `yaml:"health_check,omitempty"`
+	UpstreamTLS *UpstreamTLS `yaml:"upstream_tls,omitempty"`
+
+	// UpstreamSourceAddr is the local IP connections to this listener's
+	// backends are made from. Empty inherits the top level setting.
+	UpstreamSourceAddr string `yaml:"upstream_source_addr"`
+
+	// UpstreamFile lists the upstreams one per line, as "address" or
+	// "address weight". It is read at startup instead of upstream and then
+	// polled, so backends added or removed in it join or leave the pool live.
+	UpstreamFile string `yaml:"upstream_file"`
+
+	// ProxyProtocol requires a PROXY protocol v1 or v2 header from the
+	// load balancer in front. Only enable it when every peer sends one.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// Route sends HTTP requests matching Host and PathPrefix to their own upstream group.
+// Only used when the server runs in http mode.
+type Route struct {
+	Host       string     `yaml:"host"`
+	PathPrefix string     `yaml:"path_prefix"`
+	Upstream   []Upstream `yaml:"upstream"`
+}
+
+// Upstream is a backend address with an optional weight, priority and health
+// check address. It can be written either as a plain "host:port" string or as
+// a mapping.
+type Upstream struct {
+	Address       string `yaml:"address"`
+	HealthAddress string `yaml:"health_address"` // Health checks go here instead of to address
+	Weight        int    `yaml:"weight"`
+	Priority      int    `yaml:"priority"` // Only used when every upstream of a lower priority is down
+}
+
+func (u *Upstream) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		u.Address = value.Value
+		return nil
+	}
+
+	type plain Upstream
+	return value.Decode((*plain)(u))
+}
+
+type Balancer struct {
+	Strategy          string        `yaml:"strategy"`
+	SlowStartDuration time.Duration `yaml:"slow_start_duration"`
+	Sticky            bool          `yaml:"sticky"`        // Pin clients to a backend by cookie (http) or IP (tcp)
+	StickyCookie      string        `yaml:"sticky_cookie"` // Session cookie name in http mode
+	AffinityTTL       time.Duration `yaml:"affinity_ttl"`  // Send a returning TCP client IP back to its last backend
+
+	// Params are passed as is to the strategy, for strategies registered
+	// outside of this repository.
+	Params map[string]string `yaml:"params,omitempty"`
 }
 
 type HealthCheck struct {
 	Enabled            bool          `yaml:"enabled"`
+	Type               string        `yaml:"type"`
+	Path               string        `yaml:"path"`
+	Service            string        `yaml:"service"`
+	Send               string        `yaml:"send"`
+	Expect             string        `yaml:"expect"`
 	Interval           time.Duration `yaml:"interval"`
 	Timeout            time.Duration `yaml:"timeout"`
 	HealthyThreshold   int           `yaml:"healthy_threshold"`
 	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+	WaitForFirstCheck  bool          `yaml:"wait_for_first_check"`
+	FirstCheckTimeout  time.Duration `yaml:"first_check_timeout"`
+
+	// A backend changing state more than FlapThreshold times within
+	// FlapWindow is held down for FlapPenalty. Zero disables flap detection.
+	FlapThreshold int           `yaml:"flap_threshold"`
+	FlapWindow    time.Duration `yaml:"flap_window"`
+	FlapPenalty   time.Duration `yaml:"flap_penalty"`
+
+	// Checks slower than SlowThreshold, and failed ones, lower a backend's
+	// health score, which scales its weight. Zero disables the score.
+	SlowThreshold time.Duration `yaml:"slow_threshold"`
+
+	// Concurrency caps how many backends are checked at once.
+	Concurrency int `yaml:"concurrency"`
+
+	// SourceAddr is the local IP checks are made from, e.g. one on a
+	// management network. Empty lets the kernel choose.
+	SourceAddr string `yaml:"source_addr"`
+
+	// Params are passed as is to the probe, for health check types
+	// registered outside of this repository.
+	Params map[string]string `yaml:"params,omitempty"`
 }
 
+type ConnectionPool struct {
+	MaxIdle           int           `yaml:"max_idle"`
+	MinIdle           int           `yaml:"min_idle"`
+	MaxActive         int           `yaml:"max_active"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxConnLifetime   time.Duration `yaml:"max_conn_lifetime"`
+	BlockOnExhaustion bool          `yaml:"block_on_exhaustion"`
+	MaxWait           time.Duration `yaml:"max_wait"`
+	MaxQueue          int           `yaml:"max_queue"`
+
+	// RemovalTimeout bounds how long a backend leaving a running pool, e.g.
+	// because it dropped out of DNS, drains before it is dropped.
+	RemovalTimeout time.Duration `yaml:"removal_timeout"`
+
+	// Autosize lets max_active adapt to the load between its bounds.
+	Autosize *PoolAutosize `yaml:"autosize,omitempty"`
+}
+
+// PoolAutosize bounds an adaptive max_active, which then only sets where each
+// pool starts.
+type PoolAutosize struct {
+	MinActive int `yaml:"min_active"`
+	MaxActive int `yaml:"max_active"`
+}
+
+// UpstreamTLS makes connections to the backends TLS connections. The backend
+// certificate is verified against ServerName, which defaults to the host of
+// each upstream address.
+type UpstreamTLS struct {
+	Enabled            bool   `yaml:"enabled"`
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"`              // PEM bundle to verify backends with instead of the system roots
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Accept any backend certificate
+	ClientCert         string `yaml:"client_cert"`          // PEM certificate presented to backends requiring mutual TLS
+	ClientKey          string `yaml:"client_key"`
+}
+
+type DNS struct {
+	Enabled         bool          `yaml:"enabled"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+type Proxy struct {
+	MaxRetries       int           `yaml:"max_retries"`
+	RetryBaseDelay   time.Duration `yaml:"retry_base_delay"`
+	RetryMaxDelay    time.Duration `yaml:"retry_max_delay"`
+	RetryDelay       time.Duration `yaml:"retry_delay"` // Deprecated: use retry_base_delay
+	ConnectTimeout   time.Duration `yaml:"connect_timeout"`
+	RequestTimeout   time.Duration `yaml:"request_timeout"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	HalfCloseTimeout time.Duration `yaml:"half_close_timeout"`
+
+	// MaxConnectionDuration caps how long a TCP connection may be relayed in
+	// total. Unlike RequestTimeout, which only bounds finding a backend, it
+	// applies to the relay phase. Zero means no limit.
+	MaxConnectionDuration time.Duration `yaml:"max_connection_duration"`
+
+	// ErrorOnEarlyFailure answers with a 503 when the backend fails before
+	// sending anything back, instead of closing the client connection bare.
+	ErrorOnEarlyFailure bool `yaml:"error_on_early_failure"`
+
+	// OnNoBackends decides what happens to a client while no backend is
+	// available: reject it at once, or hold it for up to NoBackendsMaxWait.
+	OnNoBackends      string        `yaml:"on_no_backends"`
+	NoBackendsMaxWait time.Duration `yaml:"no_backends_max_wait"`
+
+	// BufferSize is the relay buffer per direction, in bytes. The socket
+	// buffers size the kernel buffers of client and backend connections;
+	// zero keeps the OS default.
+	BufferSize          int `yaml:"buffer_size"`
+	SocketReceiveBuffer int `yaml:"socket_receive_buffer"`
+	SocketSendBuffer    int `yaml:"socket_send_buffer"`
+	// MaxBufferedBytes caps how much of a relayed TCP connection zen holds
+	// in memory at once, both directions together. Zero leaves it at twice
+	// BufferSize.
+	MaxBufferedBytes int `yaml:"max_buffered_bytes"`
+	// AddRequestID sends every HTTP request's log ID to the backend as
+	// X-Request-Id, unless the client already set that header.
+	AddRequestID bool `yaml:"add_request_id"`
+	// MaxPreambleBytes caps the request line and headers of an HTTP mode
+	// request. TCP mode never reads before picking a backend, so it does
+	// not apply there. Zero keeps Go's default of 1MB.
+	MaxPreambleBytes int `yaml:"max_preamble_bytes"`
+	// Linger sets SO_LINGER, in seconds, on TCP mode connections closed
+	// after a relay: 0 resets them, a positive value lets close wait that
+	// long for unsent data. -1, the default, keeps the OS behaviour.
+	Linger *int `yaml:"linger"`
+	// HedgeConnect races every connect attempt against a second backend
+	// and keeps whichever connects first, for a lower tail connect latency.
+	HedgeConnect bool `yaml:"hedge_connect"`
+}
+
+// ErrorResponse decides what clients that cannot be served are sent: nothing
+// (none), a plain HTTP 503 (http) or the given Status and Body (custom).
+type ErrorResponse struct {
+	Mode   string `yaml:"mode"`
+	Status int    `yaml:"status"`
+	Body   string `yaml:"body"` // {reason} is replaced by the failure message
+}
+
+type Limits struct {
+	PerConnBytesPerSec int64 `yaml:"per_conn_bytes_per_sec"` // 0 = unlimited
+}
+
+// AccessLog thins out the per connection access log. Connections over either
+// threshold are always logged; SampleRate applies to the others.
+type AccessLog struct {
+	SampleRate     *float64      `yaml:"sample_rate"`     // Fraction of connections logged, 1 by default
+	SlowThreshold  time.Duration `yaml:"slow_threshold"`  // 0 = no duration threshold
+	BytesThreshold int64         `yaml:"bytes_threshold"` // 0 = no size threshold
+}
+
+// AccessControl filters clients by IP on every listener. Deny wins over
+// allow; with no allow networks, every client not denied may connect.
+type AccessControl struct {
+	Allow []string `yaml:"allow"` // CIDR networks, e.g. 10.0.0.0/8 or 192.0.2.7/32
+	Deny  []string `yaml:"deny"`
+}
+
+type Admin struct {
+	Enabled bool   `yaml:"enabled"`
+	Address string `yaml:"address"`
+}
+
+type Logging struct {
+	Level      string `yaml:"level"`       // debug, info (default), warn, error or fatal
+	TimeFormat string `yaml:"time_format"` // Go time layout, or rfc3339 / rfc3339nano
+	UTC        bool   `yaml:"utc"`
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+}
+
+// ParseConfig loads filePath, merged with the files it includes, into cfg,
+// then fills in defaults and validates the result.
 func ParseConfig(cfg *Config, filePath string) error {
-	f, err := os.Open(filePath)
+	node, err := loadConfigNode(filePath)
 	if err != nil {
 		logger.Error("Failed to read configuration file: %s", err)
 		return err
 	}
-	defer f.Close()
 
-	decoder := yaml.NewDecoder(f)
-	err = decoder.Decode(cfg)
+	err = node.Decode(cfg)
 	if err != nil {
 		logger.Error("Failed to decode configuration file: %s", err)
 		return err
 	}
 
+	setDefaultWeights(cfg.Upstream)
+	for _, route := range cfg.Routes {
+		setDefaultWeights(route.Upstream)
+	}
+
+	if cfg.Balancer == nil {
+		cfg.Balancer = &Balancer{}
+	}
+	if err = validateBalancer(cfg.Balancer); err != nil {
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
 	if cfg.HealthCheck == nil {
 		cfg.HealthCheck = &HealthCheck{
 			Enabled:            true,
+			Type:               HealthCheckTCP,
 			Interval:           30 * time.Second,
 			Timeout:            5 * time.Second,
 			HealthyThreshold:   2,
@@ -48,20 +350,530 @@ func ParseConfig(cfg *Config, filePath string) error {
 		}
 		logger.Info("Using default health check configuration")
 	} else if cfg.HealthCheck.Enabled {
-		if cfg.HealthCheck.Interval == 0 {
-			cfg.HealthCheck.Interval = 30 * time.Second
+		if err = validateHealthCheck(cfg.HealthCheck); err != nil {
+			logger.Error("Invalid configuration: %s", err)
+			return err
 		}
-		if cfg.HealthCheck.Timeout == 0 {
-			cfg.HealthCheck.Timeout = 5 * time.Second
+		logger.Info("Health check enabled with interval: %s", cfg.HealthCheck.Interval)
+	}
+
+	if cfg.UpstreamTLS == nil {
+		cfg.UpstreamTLS = &UpstreamTLS{}
+	} else if err = validateUpstreamTLS(cfg.UpstreamTLS); err != nil {
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
+	if cfg.Server.DrainGracePeriod == 0 {
+		cfg.Server.DrainGracePeriod = 10 * time.Second
+	}
+	if cfg.Server.ShutdownTimeout < 0 {
+		err = fmt.Errorf("server.shutdown_timeout must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Server.ShutdownTimeout == 0 {
+		cfg.Server.ShutdownTimeout = 10 * time.Second
+	}
+
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []*Listener{{
+			Name:     "default",
+			Address:  net.JoinHostPort("", cfg.Server.Port),
+			Mode:     cfg.Server.Mode,
+			Upstream: cfg.Upstream,
+			Routes:   cfg.Routes,
+
+			UpstreamFile:  cfg.UpstreamFile,
+			ProxyProtocol: cfg.Server.ProxyProtocol,
+		}}
+	}
+
+	for _, listener := range cfg.Listeners {
+		if err = validateListener(cfg, listener); err != nil {
+			logger.Error("Invalid configuration: %s", err)
+			return err
 		}
-		if cfg.HealthCheck.HealthyThreshold == 0 {
-			cfg.HealthCheck.HealthyThreshold = 2
+	}
+
+	if cfg.ConnectionPool == nil {
+		cfg.ConnectionPool = &ConnectionPool{}
+	}
+	if cfg.ConnectionPool.MaxIdle == 0 {
+		cfg.ConnectionPool.MaxIdle = 10
+	}
+	if cfg.ConnectionPool.MaxActive == 0 {
+		cfg.ConnectionPool.MaxActive = 100
+	}
+	if cfg.ConnectionPool.IdleTimeout == 0 {
+		cfg.ConnectionPool.IdleTimeout = 30 * time.Second
+	}
+	if cfg.ConnectionPool.IdleTimeout < time.Second {
+		err = fmt.Errorf("connection_pool.idle_timeout must be at least 1s, got %s", cfg.ConnectionPool.IdleTimeout)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.ConnectionPool.BlockOnExhaustion && cfg.ConnectionPool.MaxWait == 0 {
+		cfg.ConnectionPool.MaxWait = 1 * time.Second
+	}
+	if cfg.ConnectionPool.RemovalTimeout == 0 {
+		cfg.ConnectionPool.RemovalTimeout = 30 * time.Second
+	}
+	if cfg.ConnectionPool.RemovalTimeout < 0 {
+		err = fmt.Errorf("connection_pool.removal_timeout must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if autosize := cfg.ConnectionPool.Autosize; autosize != nil {
+		if autosize.MinActive == 0 {
+			autosize.MinActive = 1
 		}
-		if cfg.HealthCheck.UnhealthyThreshold == 0 {
-			cfg.HealthCheck.UnhealthyThreshold = 3
+		if autosize.MinActive < 0 || autosize.MaxActive < autosize.MinActive {
+			err = fmt.Errorf("connection_pool.autosize needs 0 < min_active <= max_active, got %d and %d",
+				autosize.MinActive, autosize.MaxActive)
+			logger.Error("Invalid configuration: %s", err)
+			return err
 		}
-		logger.Info("Health check enabled with interval: %s", cfg.HealthCheck.Interval)
+		cfg.ConnectionPool.MaxActive = min(max(cfg.ConnectionPool.MaxActive, autosize.MinActive), autosize.MaxActive)
+	}
+
+	if cfg.DNS == nil {
+		cfg.DNS = &DNS{}
+	}
+	if cfg.DNS.Enabled && cfg.DNS.RefreshInterval == 0 {
+		cfg.DNS.RefreshInterval = 30 * time.Second
+	}
+
+	if cfg.Logging == nil {
+		cfg.Logging = &Logging{}
+	}
+	if cfg.Logging.Level == "" {
+		cfg.Logging.Level = "info"
+	}
+	if _, err = logger.ParseLevel(cfg.Logging.Level); err != nil {
+		err = fmt.Errorf("logging.level: %w", err)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Logging.File != "" && cfg.Logging.MaxSizeMB == 0 {
+		cfg.Logging.MaxSizeMB = 100
+	}
+	switch cfg.Logging.TimeFormat {
+	case "rfc3339":
+		cfg.Logging.TimeFormat = time.RFC3339
+	case "rfc3339nano":
+		cfg.Logging.TimeFormat = time.RFC3339Nano
 	}
 
+	if cfg.Limits == nil {
+		cfg.Limits = &Limits{}
+	}
+	if cfg.Limits.PerConnBytesPerSec < 0 {
+		err = fmt.Errorf("limits.per_conn_bytes_per_sec must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
+	if cfg.AccessControl == nil {
+		cfg.AccessControl = &AccessControl{}
+	}
+	if err = validateNetworks("access_control.allow", cfg.AccessControl.Allow); err != nil {
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if err = validateNetworks("access_control.deny", cfg.AccessControl.Deny); err != nil {
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
+	if cfg.AccessLog == nil {
+		cfg.AccessLog = &AccessLog{}
+	}
+	if cfg.AccessLog.SampleRate == nil {
+		sampleRate := 1.0
+		cfg.AccessLog.SampleRate = &sampleRate
+	}
+	if rate := *cfg.AccessLog.SampleRate; rate < 0 || rate > 1 {
+		err = fmt.Errorf("access_log.sample_rate must be between 0 and 1, got %g", rate)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.AccessLog.SlowThreshold < 0 || cfg.AccessLog.BytesThreshold < 0 {
+		err = fmt.Errorf("access_log thresholds must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
+	if cfg.ErrorResponse == nil {
+		cfg.ErrorResponse = &ErrorResponse{}
+	}
+	switch cfg.ErrorResponse.Mode {
+	case "":
+		cfg.ErrorResponse.Mode = ErrorResponseNone
+	case ErrorResponseNone, ErrorResponseHTTP:
+	case ErrorResponseCustom:
+		if cfg.ErrorResponse.Status == 0 {
+			cfg.ErrorResponse.Status = 503
+		}
+		if cfg.ErrorResponse.Status < 100 || cfg.ErrorResponse.Status > 599 {
+			err = fmt.Errorf("error_response.status %d is not a valid HTTP status", cfg.ErrorResponse.Status)
+			logger.Error("Invalid configuration: %s", err)
+			return err
+		}
+	default:
+		err = fmt.Errorf("unknown error_response.mode %q", cfg.ErrorResponse.Mode)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+
+	if cfg.Admin == nil {
+		cfg.Admin = &Admin{}
+	}
+	if cfg.Admin.Address == "" {
+		cfg.Admin.Address = "127.0.0.1:9090"
+	}
+
+	if cfg.Proxy == nil {
+		cfg.Proxy = &Proxy{}
+	}
+	if cfg.Proxy.MaxRetries == 0 {
+		cfg.Proxy.MaxRetries = 3
+	}
+	if cfg.Proxy.RetryBaseDelay == 0 {
+		cfg.Proxy.RetryBaseDelay = cfg.Proxy.RetryDelay
+	}
+	if cfg.Proxy.RetryBaseDelay == 0 {
+		cfg.Proxy.RetryBaseDelay = 10 * time.Millisecond
+	}
+	if cfg.Proxy.RetryMaxDelay == 0 {
+		cfg.Proxy.RetryMaxDelay = max(time.Second, cfg.Proxy.RetryBaseDelay)
+	}
+	if cfg.Proxy.RetryMaxDelay < cfg.Proxy.RetryBaseDelay {
+		err = fmt.Errorf("proxy.retry_max_delay %s is below retry_base_delay %s", cfg.Proxy.RetryMaxDelay, cfg.Proxy.RetryBaseDelay)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.ConnectTimeout == 0 {
+		cfg.Proxy.ConnectTimeout = 2 * time.Second
+	}
+	if cfg.Proxy.RequestTimeout == 0 {
+		cfg.Proxy.RequestTimeout = 10 * time.Second
+	}
+	if cfg.Proxy.HandshakeTimeout == 0 {
+		cfg.Proxy.HandshakeTimeout = 5 * time.Second
+	}
+	if cfg.Proxy.IdleTimeout == 0 {
+		cfg.Proxy.IdleTimeout = 300 * time.Second
+	}
+	if cfg.Proxy.WriteTimeout == 0 {
+		cfg.Proxy.WriteTimeout = 30 * time.Second
+	}
+	if cfg.Proxy.HalfCloseTimeout == 0 {
+		cfg.Proxy.HalfCloseTimeout = 5 * time.Second
+	}
+	if cfg.Proxy.MaxConnectionDuration < 0 {
+		err = fmt.Errorf("proxy.max_connection_duration must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	switch cfg.Proxy.OnNoBackends {
+	case "":
+		cfg.Proxy.OnNoBackends = OnNoBackendsReject
+	case OnNoBackendsReject, OnNoBackendsWait:
+	default:
+		err = fmt.Errorf("unknown proxy.on_no_backends %q", cfg.Proxy.OnNoBackends)
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.NoBackendsMaxWait == 0 {
+		cfg.Proxy.NoBackendsMaxWait = 5 * time.Second
+	}
+
+	if cfg.Proxy.BufferSize == 0 {
+		cfg.Proxy.BufferSize = 32 * 1024
+	}
+	if cfg.Proxy.BufferSize < 0 || cfg.Proxy.SocketReceiveBuffer < 0 || cfg.Proxy.SocketSendBuffer < 0 {
+		err = fmt.Errorf("proxy.buffer_size, socket_receive_buffer and socket_send_buffer must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.MaxBufferedBytes < 0 || cfg.Proxy.MaxBufferedBytes == 1 {
+		err = fmt.Errorf("proxy.max_buffered_bytes must be 0 or at least 2, one byte per direction")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.Linger == nil {
+		linger := -1
+		cfg.Proxy.Linger = &linger
+	}
+	if *cfg.Proxy.Linger < -1 {
+		err = fmt.Errorf("proxy.linger must be -1 for the OS default, 0 or a number of seconds")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.MaxPreambleBytes < 0 {
+		err = fmt.Errorf("proxy.max_preamble_bytes must not be negative")
+		logger.Error("Invalid configuration: %s", err)
+		return err
+	}
+	if cfg.Proxy.MaxPreambleBytes > 0 {
+		httpListeners := 0
+		for _, listener := range cfg.Listeners {
+			if listener.Mode == ModeHTTP {
+				httpListeners++
+			}
+		}
+		if httpListeners == 0 {
+			logger.Warn("proxy.max_preamble_bytes only applies to http mode listeners and has no effect")
+		}
+	}
+
+	return nil
+}
+
+func setDefaultWeights(upstreams []Upstream) {
+	for i := range upstreams {
+		if upstreams[i].Weight <= 0 {
+			upstreams[i].Weight = 1
+		}
+	}
+}
+
+// validateUpstreams checks every upstream, and its health_address when set,
+// is a host:port pair, and that priorities are 0 or more.
+func validateUpstreams(upstreams []Upstream) error {
+	for _, upstream := range upstreams {
+		if upstream.Priority < 0 {
+			return fmt.Errorf("upstream %q: priority must be 0 or more", upstream.Address)
+		}
+		if err := validateAddress(upstream.Address); err != nil {
+			return fmt.Errorf("upstream %q: %w", upstream.Address, err)
+		}
+		if upstream.HealthAddress == "" {
+			continue
+		}
+		if err := validateAddress(upstream.HealthAddress); err != nil {
+			return fmt.Errorf("upstream %q: health_address %q: %w", upstream.Address, upstream.HealthAddress, err)
+		}
+	}
+	return nil
+}
+
+// validateAddress checks address is a host:port pair. A bare IPv6 address
+// would be ambiguous about where the port starts, so it must be bracketed,
+// e.g. [2001:db8::1]:8080.
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return fmt.Errorf("IPv6 addresses must be written as [address]:port")
+		}
+		return err
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("both host and port are required")
+	}
+	return nil
+}
+
+// validateListener fills in listener defaults, inheriting the top level
+// balancer and health check settings when the listener has none of its own.
+func validateListener(cfg *Config, listener *Listener) error {
+	if listener.Address == "" {
+		return fmt.Errorf("listener %q has no address", listener.Name)
+	}
+
+	switch listener.Mode {
+	case "":
+		listener.Mode = ModeTCP
+	case ModeTCP, ModeHTTP:
+	default:
+		return fmt.Errorf("listener %q: unknown mode %q", listener.Name, listener.Mode)
+	}
+
+	if listener.UpstreamFile != "" {
+		if err := loadUpstreamFile(cfg, listener); err != nil {
+			return fmt.Errorf("listener %q: %w", listener.Name, err)
+		}
+	}
+
+	setDefaultWeights(listener.Upstream)
+	for _, route := range listener.Routes {
+		setDefaultWeights(route.Upstream)
+	}
+
+	if err := validateUpstreams(listener.Upstream); err != nil {
+		return fmt.Errorf("listener %q: %w", listener.Name, err)
+	}
+	for _, route := range listener.Routes {
+		if err := validateUpstreams(route.Upstream); err != nil {
+			return fmt.Errorf("listener %q: %w", listener.Name, err)
+		}
+	}
+
+	if listener.Balancer == nil {
+		listener.Balancer = cfg.Balancer
+	} else if err := validateBalancer(listener.Balancer); err != nil {
+		return fmt.Errorf("listener %q: %w", listener.Name, err)
+	}
+
+	if listener.HealthCheck == nil {
+		listener.HealthCheck = cfg.HealthCheck
+	} else if listener.HealthCheck.Enabled {
+		if err := validateHealthCheck(listener.HealthCheck); err != nil {
+			return fmt.Errorf("listener %q: %w", listener.Name, err)
+		}
+	}
+
+	if listener.UpstreamTLS == nil {
+		listener.UpstreamTLS = cfg.UpstreamTLS
+	} else if err := validateUpstreamTLS(listener.UpstreamTLS); err != nil {
+		return fmt.Errorf("listener %q: %w", listener.Name, err)
+	}
+
+	if listener.UpstreamSourceAddr == "" {
+		listener.UpstreamSourceAddr = cfg.UpstreamSourceAddr
+	}
+	if err := validateSourceAddr("upstream_source_addr", listener.UpstreamSourceAddr); err != nil {
+		return fmt.Errorf("listener %q: %w", listener.Name, err)
+	}
+
+	return nil
+}
+
+// loadUpstreamFile replaces the listener's upstream with the contents of
+// its upstream file.
+func loadUpstreamFile(cfg *Config, listener *Listener) error {
+	if len(listener.Upstream) > 0 {
+		return fmt.Errorf("upstream and upstream_file cannot be used together")
+	}
+	if cfg.DNS != nil && cfg.DNS.Enabled {
+		return fmt.Errorf("upstream_file cannot be used with dns.enabled")
+	}
+
+	upstreams, err := backend.ReadUpstreamFile(listener.UpstreamFile)
+	if err != nil {
+		return fmt.Errorf("reading upstream_file: %w", err)
+	}
+	if len(upstreams) == 0 {
+		return fmt.Errorf("upstream_file %s lists no valid upstream", listener.UpstreamFile)
+	}
+
+	for _, upstream := range upstreams {
+		listener.Upstream = append(listener.Upstream, Upstream{Address: upstream.Address, Weight: upstream.Weight})
+	}
+	return nil
+}
+
+// validateSourceAddr checks that address, when set, is an IP assigned to
+// this host by binding to it once. key names the setting in errors.
+func validateSourceAddr(key, address string) error {
+	if address == "" {
+		return nil
+	}
+
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("%s %q is not an IP address", key, address)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return fmt.Errorf("%s %q cannot be bound: %w", key, address, err)
+	}
+	ln.Close()
+	return nil
+}
+
+// validateNetworks checks that every entry of an access control list is a
+// network in CIDR notation. A bare IP is refused rather than guessed at.
+func validateNetworks(key string, networks []string) error {
+	for _, network := range networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			if net.ParseIP(network) != nil {
+				return fmt.Errorf("%s %q needs a prefix length, such as /32 or /128 for a single address", key, network)
+			}
+			return fmt.Errorf("%s %q is not a CIDR network", key, network)
+		}
+	}
+	return nil
+}
+
+func validateUpstreamTLS(upstreamTLS *UpstreamTLS) error {
+	if (upstreamTLS.ClientCert == "") != (upstreamTLS.ClientKey == "") {
+		return fmt.Errorf("upstream_tls.client_cert and upstream_tls.client_key must be set together")
+	}
+	if upstreamTLS.Enabled && upstreamTLS.InsecureSkipVerify {
+		logger.Warn("upstream_tls.insecure_skip_verify is set, backend certificates will not be verified")
+	}
+	return nil
+}
+
+func validateBalancer(balancer *Balancer) error {
+	if balancer.Strategy == "" {
+		balancer.Strategy = zenbalancer.StrategyRoundRobin
+	}
+	if !zenbalancer.IsRegistered(balancer.Strategy) {
+		return fmt.Errorf("unknown balancer strategy %q, available: %s",
+			balancer.Strategy, strings.Join(zenbalancer.Strategies(), ", "))
+	}
+	if balancer.AffinityTTL < 0 {
+		return fmt.Errorf("balancer.affinity_ttl must not be negative")
+	}
+	if balancer.Sticky && balancer.AffinityTTL > 0 {
+		return fmt.Errorf("balancer.sticky and balancer.affinity_ttl cannot be used together")
+	}
+	if balancer.Sticky && balancer.StickyCookie == "" {
+		balancer.StickyCookie = "zen_session"
+	}
+	return nil
+}
+
+func validateHealthCheck(hc *HealthCheck) error {
+	if hc.Interval == 0 {
+		hc.Interval = 30 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 5 * time.Second
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	if hc.FirstCheckTimeout == 0 {
+		hc.FirstCheckTimeout = 10 * time.Second
+	}
+	if hc.FlapThreshold < 0 || hc.FlapWindow < 0 || hc.FlapPenalty < 0 {
+		return fmt.Errorf("health check flap_threshold, flap_window and flap_penalty must not be negative")
+	}
+	if hc.FlapThreshold > 0 && hc.FlapWindow == 0 {
+		hc.FlapWindow = 10 * hc.Interval
+	}
+	if hc.FlapThreshold > 0 && hc.FlapPenalty == 0 {
+		hc.FlapPenalty = hc.FlapWindow
+	}
+	if hc.Concurrency == 0 {
+		hc.Concurrency = 64
+	}
+	if hc.Concurrency < 0 {
+		return fmt.Errorf("health check concurrency must not be negative")
+	}
+	if hc.SlowThreshold < 0 || hc.SlowThreshold >= hc.Timeout {
+		return fmt.Errorf("health check slow_threshold must not be negative and must be shorter than timeout")
+	}
+	if err := validateSourceAddr("health_check.source_addr", hc.SourceAddr); err != nil {
+		return err
+	}
+
+	if hc.Type == "" {
+		hc.Type = HealthCheckTCP
+	}
+	if !backend.IsProbeRegistered(hc.Type) {
+		return fmt.Errorf("unknown health check type %q, available: %s",
+			hc.Type, strings.Join(backend.ProbeTypes(), ", "))
+	}
+	if hc.Type == HealthCheckSend && (hc.Send == "" || hc.Expect == "") {
+		return fmt.Errorf("health check type %q requires send and expect", HealthCheckSend)
+	}
 	return nil
 }
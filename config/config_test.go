@@ -0,0 +1,41 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr string
+	}{
+		{"127.0.0.1:8080", ""},
+		{"backend.internal:8080", ""},
+		{"[::1]:8080", ""},
+		{"[2001:db8::1]:8080", ""},
+		{"[fe80::1%eth0]:8080", ""},
+		{"2001:db8::1:8080", "must be written as [address]:port"},
+		{"::1", "must be written as [address]:port"},
+		{"[2001:db8::1]", "missing port"},
+		{"127.0.0.1", "missing port"},
+		{":8080", "both host and port are required"},
+		{"[::1]:", "both host and port are required"},
+	}
+	for _, test := range tests {
+		err := validateAddress(test.address)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", test.address, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%q: error %v, want one containing %q", test.address, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateUpstreamsChecksHealthAddress(t *testing.T) {
+	err := validateUpstreams([]Upstream{{Address: "[2001:db8::1]:8080", HealthAddress: "2001:db8::1:9000"}})
+	if err == nil || !strings.Contains(err.Error(), "health_address") {
+		t.Fatalf("got %v, want the bare IPv6 health_address rejected", err)
+	}
+}
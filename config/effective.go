@@ -0,0 +1,109 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"strings"
+	"zen/utils/logger"
+)
+
+// redactedValue replaces secrets in Redacted output.
+const redactedValue = "[redacted]"
+
+// secretKeys are config keys whose values are never exposed. Health check
+// send payloads are included because they often carry credentials, such as
+// a Redis AUTH command.
+var secretKeys = []string{"password", "secret", "token", "send"}
+
+// LogEffective logs the configuration actually in use, defaults included.
+// Only settings are logged, never the contents of secrets such as key files.
+func (cfg *Config) LogEffective() {
+	logger.Info("Effective configuration:")
+	logger.Info("  server: maintenance=%t reuse_port=%t drain_grace_period=%s shutdown_timeout=%s",
+		cfg.Server.Maintenance, cfg.Server.ReusePort, cfg.Server.DrainGracePeriod, cfg.Server.ShutdownTimeout)
+	for _, l := range cfg.Listeners {
+		logger.Info("  listener %s: address=%s mode=%s upstream=%d servers upstream_file=%q routes=%d balancer=%s health_check=%t upstream_tls=%t upstream_source_addr=%q proxy_protocol=%t",
+			l.Name, l.Address, l.Mode, len(l.Upstream), l.UpstreamFile, len(l.Routes), l.Balancer.Strategy, l.HealthCheck.Enabled, l.UpstreamTLS.Enabled, l.UpstreamSourceAddr, l.ProxyProtocol)
+	}
+	logger.Info("  balancer: strategy=%s slow_start_duration=%s sticky=%t sticky_cookie=%q affinity_ttl=%s",
+		cfg.Balancer.Strategy, cfg.Balancer.SlowStartDuration, cfg.Balancer.Sticky, cfg.Balancer.StickyCookie, cfg.Balancer.AffinityTTL)
+
+	hc := cfg.HealthCheck
+	if hc.Enabled {
+		logger.Info("  health_check: type=%s interval=%s timeout=%s healthy_threshold=%d unhealthy_threshold=%d wait_for_first_check=%t flap_threshold=%d flap_window=%s flap_penalty=%s slow_threshold=%s concurrency=%d source_addr=%q",
+			hc.Type, hc.Interval, hc.Timeout, hc.HealthyThreshold, hc.UnhealthyThreshold, hc.WaitForFirstCheck, hc.FlapThreshold, hc.FlapWindow, hc.FlapPenalty, hc.SlowThreshold, hc.Concurrency, hc.SourceAddr)
+	} else {
+		logger.Info("  health_check: disabled")
+	}
+
+	if t := cfg.UpstreamTLS; t.Enabled {
+		logger.Info("  upstream_tls: server_name=%q ca_file=%q insecure_skip_verify=%t client_cert=%q",
+			t.ServerName, t.CAFile, t.InsecureSkipVerify, t.ClientCert)
+	} else {
+		logger.Info("  upstream_tls: disabled")
+	}
+
+	cp := cfg.ConnectionPool
+	logger.Info("  connection_pool: max_idle=%d min_idle=%d max_active=%d idle_timeout=%s max_conn_lifetime=%s block_on_exhaustion=%t max_wait=%s max_queue=%d removal_timeout=%s",
+		cp.MaxIdle, cp.MinIdle, cp.MaxActive, cp.IdleTimeout, cp.MaxConnLifetime, cp.BlockOnExhaustion, cp.MaxWait, cp.MaxQueue, cp.RemovalTimeout)
+	if cp.Autosize != nil {
+		logger.Info("  connection_pool.autosize: min_active=%d max_active=%d", cp.Autosize.MinActive, cp.Autosize.MaxActive)
+	}
+
+	p := cfg.Proxy
+	logger.Info("  proxy: max_retries=%d retry_base_delay=%s retry_max_delay=%s connect_timeout=%s request_timeout=%s handshake_timeout=%s idle_timeout=%s write_timeout=%s half_close_timeout=%s max_connection_duration=%s error_on_early_failure=%t on_no_backends=%s no_backends_max_wait=%s buffer_size=%d socket_receive_buffer=%d socket_send_buffer=%d max_buffered_bytes=%d add_request_id=%t max_preamble_bytes=%d linger=%d hedge_connect=%t",
+		p.MaxRetries, p.RetryBaseDelay, p.RetryMaxDelay, p.ConnectTimeout, p.RequestTimeout, p.HandshakeTimeout, p.IdleTimeout, p.WriteTimeout, p.HalfCloseTimeout, p.MaxConnectionDuration,
+		p.ErrorOnEarlyFailure, p.OnNoBackends, p.NoBackendsMaxWait, p.BufferSize, p.SocketReceiveBuffer, p.SocketSendBuffer, p.MaxBufferedBytes, p.AddRequestID, p.MaxPreambleBytes, *p.Linger, p.HedgeConnect)
+
+	logger.Info("  error_response: mode=%s status=%d", cfg.ErrorResponse.Mode, cfg.ErrorResponse.Status)
+	logger.Info("  access_control: allow=%v deny=%v", cfg.AccessControl.Allow, cfg.AccessControl.Deny)
+	logger.Info("  limits: per_conn_bytes_per_sec=%d", cfg.Limits.PerConnBytesPerSec)
+	logger.Info("  access_log: sample_rate=%g slow_threshold=%s bytes_threshold=%d",
+		*cfg.AccessLog.SampleRate, cfg.AccessLog.SlowThreshold, cfg.AccessLog.BytesThreshold)
+	logger.Info("  dns: enabled=%t refresh_interval=%s", cfg.DNS.Enabled, cfg.DNS.RefreshInterval)
+	logger.Info("  admin: enabled=%t address=%s", cfg.Admin.Enabled, cfg.Admin.Address)
+	logger.Info("  logging: level=%s file=%q time_format=%q utc=%t",
+		cfg.Logging.Level, cfg.Logging.File, cfg.Logging.TimeFormat, cfg.Logging.UTC)
+}
+
+// Redacted returns the configuration keyed like the YAML file, with
+// durations rendered as strings such as "30s" and secrets replaced.
+func (cfg *Config) Redacted() (map[string]any, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+
+	redact(tree)
+	return tree, nil
+}
+
+func redact(node any) {
+	switch value := node.(type) {
+	case map[string]any:
+		for key, child := range value {
+			if isSecretKey(key) && child != nil && child != "" {
+				value[key] = redactedValue
+				continue
+			}
+			redact(child)
+		}
+	case []any:
+		for _, child := range value {
+			redact(child)
+		}
+	}
+}
+
+func isSecretKey(key string) bool {
+	for _, secret := range secretKeys {
+		if key == secret || strings.HasSuffix(key, "_"+secret) {
+			return true
+		}
+	}
+	return false
+}
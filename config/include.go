@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// includeKey is the top level key listing the files a configuration file
+// builds on.
+const includeKey = "include"
+
+// Tags choosing how a list is merged with the one from earlier files.
+// Without a tag a list replaces the earlier one.
+const (
+	tagAppend  = "!append"
+	tagReplace = "!replace"
+)
+
+// loadConfigNode reads a configuration file and the files it includes into
+// one YAML mapping. Included files are merged first, in the order listed,
+// and the including file last, so later files win:
+//
+//   - mappings are merged key by key, recursively
+//   - scalars and lists replace what earlier files set
+//   - a list tagged !append is added after the earlier list instead
+//
+// Include paths are relative to the file that lists them. Only the top
+// level of a file may have an include key.
+func loadConfigNode(path string) (*yaml.Node, error) {
+	node, err := loadWithIncludes(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resolveMergeTags(node)
+	return node, nil
+}
+
+// loadWithIncludes loads path on top of its includes. stack holds the files
+// being loaded, to catch an include cycle.
+func loadWithIncludes(path string, stack []string) (*yaml.Node, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, loading := range stack {
+		if loading == absolute {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), absolute)
+		}
+	}
+	stack = append(stack, absolute)
+
+	root, err := readMapping(path)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := takeIncludes(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(includes) == 0 {
+		return root, nil
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		included, err := loadWithIncludes(include, stack)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeNodes(merged, included)
+	}
+	return mergeNodes(merged, root), nil
+}
+
+// readMapping parses path, which must hold a mapping. An empty file is an
+// empty mapping.
+func readMapping(path string) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: top level must be a mapping", path)
+	}
+	return root, nil
+}
+
+// takeIncludes removes the include key from a top level mapping and returns
+// the files it lists. A single file may be given without a list.
+func takeIncludes(root *yaml.Node) ([]string, error) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != includeKey {
+			continue
+		}
+		value := root.Content[i+1]
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+
+		var includes []string
+		switch value.Kind {
+		case yaml.ScalarNode:
+			includes = []string{value.Value}
+		case yaml.SequenceNode:
+			if err := value.Decode(&includes); err != nil {
+				return nil, fmt.Errorf("include must list file paths: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("include must list file paths")
+		}
+		return includes, nil
+	}
+	return nil, nil
+}
+
+// mergeNodes merges src on top of dst and returns the result, reusing the
+// nodes of both.
+func mergeNodes(dst, src *yaml.Node) *yaml.Node {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode && src.Tag != tagReplace:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			if existing := mappingValue(dst, key.Value); existing >= 0 {
+				dst.Content[existing] = mergeNodes(dst.Content[existing], value)
+			} else {
+				dst.Content = append(dst.Content, key, value)
+			}
+		}
+		return dst
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode && src.Tag == tagAppend:
+		dst.Content = append(dst.Content, src.Content...)
+		return dst
+	default:
+		return src
+	}
+}
+
+// mappingValue returns the index of the value stored under key in a
+// mapping, or -1.
+func mappingValue(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// resolveMergeTags drops the merge tags once merging is done, so the nodes
+// decode as plain lists and mappings.
+func resolveMergeTags(node *yaml.Node) {
+	if node.Tag == tagAppend || node.Tag == tagReplace {
+		switch node.Kind {
+		case yaml.SequenceNode:
+			node.Tag = "!!seq"
+		case yaml.MappingNode:
+			node.Tag = "!!map"
+		default:
+			node.Tag = ""
+		}
+	}
+	for _, child := range node.Content {
+		resolveMergeTags(child)
+	}
+}
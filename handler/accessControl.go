@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// deniedConnections counts the client connections closed by access control,
+// across all listeners.
+var deniedConnections atomic.Uint64
+
+// AccessControl decides which client IPs may connect. A client in a deny
+// network is refused even when an allow network also holds it. Once any
+// allow network is given, clients outside all of them are refused too.
+type AccessControl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewAccessControl parses the allow and deny networks, written in CIDR
+// notation. It returns nil when both are empty, which allows every client.
+func NewAccessControl(allow, deny []string) (*AccessControl, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	ac := &AccessControl{}
+	if ac.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if ac.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Allows reports whether a client at ip may connect. A nil AccessControl
+// allows everyone.
+func (ac *AccessControl) Allows(ip net.IP) bool {
+	if ac == nil {
+		return true
+	}
+	for _, network := range ac.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(ac.allow) == 0 {
+		return true
+	}
+	for _, network := range ac.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAddress is Allows for a client address in host:port form, as
+// RemoteAddr gives it for connections and HTTP requests alike. Addresses that
+// carry no IP, such as those of Unix sockets, are allowed.
+func (ac *AccessControl) allowsAddress(address string) bool {
+	if ac == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	return ac.Allows(ip)
+}
+
+// DeniedConnectionCount returns the number of client connections refused by
+// access control since startup.
+func DeniedConnectionCount() uint64 {
+	return deniedConnections.Load()
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+)
+
+func TestAccessControlAllows(t *testing.T) {
+	ac, err := NewAccessControl([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.0.13.0/24"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.0.13.7", false}, // deny wins over allow
+		{"192.0.2.1", false}, // outside every allow network
+		{"2001:db8::1", true},
+		{"::ffff:10.1.2.3", true}, // IPv4-mapped
+		{"::ffff:10.0.13.7", false},
+	}
+	for _, test := range tests {
+		if got := ac.Allows(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("Allows(%s) = %t, want %t", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestAccessControlDenyOnly(t *testing.T) {
+	ac, err := NewAccessControl(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+	if !ac.Allows(net.ParseIP("198.51.100.1")) {
+		t.Error("a client not denied was refused without allow networks")
+	}
+	if ac.Allows(net.ParseIP("192.0.2.1")) {
+		t.Error("a denied client was allowed")
+	}
+}
+
+func TestNewAccessControl(t *testing.T) {
+	ac, err := NewAccessControl(nil, nil)
+	if err != nil || ac != nil {
+		t.Fatalf("NewAccessControl(nil, nil) = %v, %v, want nil, nil", ac, err)
+	}
+	if !ac.allowsAddress("192.0.2.1:1234") {
+		t.Error("a nil AccessControl refused a client")
+	}
+
+	if _, err := NewAccessControl([]string{"10.0.0.1"}, nil); err == nil {
+		t.Error("a bare IP was accepted as a network")
+	}
+}
+
+func TestTCPModeDeniesClient(t *testing.T) {
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		_, err := conn.Write([]byte("served"))
+		return 0, err
+	})
+
+	config := testProxyConfig()
+	ac, err := NewAccessControl(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+	config.AccessControl = ac
+	address, _ := startProxy(t, config, b.Address())
+
+	denied := DeniedConnectionCount()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var buffer [16]byte
+	if n, err := conn.Read(buffer[:]); n != 0 || err == nil {
+		t.Fatalf("denied client read %q, %v; want the connection closed", buffer[:n], err)
+	}
+	if got := DeniedConnectionCount() - denied; got != 1 {
+		t.Errorf("denied count rose by %d, want 1", got)
+	}
+	if accepted := b.Accepted(); accepted != 0 {
+		t.Errorf("backend accepted %d connections for a denied client", accepted)
+	}
+}
+
+func TestHTTPModeDeniesClient(t *testing.T) {
+	ac, err := NewAccessControl(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+	config := testProxyConfig()
+	config.AccessControl = ac
+
+	// No backends: a request that gets past access control is answered 503
+	pool := backend.NewBackendPool(nil, nil)
+	t.Cleanup(pool.Close)
+	h := NewHTTPHandler(NewConnectionHandler(balancer.NewRoundRobin(pool), config), nil)
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:40000", http.StatusForbidden},
+		{"[::ffff:127.0.0.1]:40000", http.StatusForbidden},
+		{"192.0.2.1:40000", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		denied := DeniedConnectionCount()
+
+		request := httptest.NewRequest(http.MethodGet, "http://zen.test/", nil)
+		request.RemoteAddr = test.remoteAddr
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.remoteAddr, recorder.Code, test.want)
+		}
+		wantDenied := uint64(0)
+		if test.want == http.StatusForbidden {
+			wantDenied = 1
+		}
+		if got := DeniedConnectionCount() - denied; got != wantDenied {
+			t.Errorf("%s: denied count rose by %d, want %d", test.remoteAddr, got, wantDenied)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogConfig decides which connections get an access log line. Every
+// connection lasting at least SlowThreshold or moving at least BytesThreshold
+// bytes is logged; of the rest, a SampleRate fraction is.
+type AccessLogConfig struct {
+	SampleRate     float64
+	SlowThreshold  time.Duration // 0 disables the duration check
+	BytesThreshold int64         // 0 disables the size check
+}
+
+// accessLogSampler picks connections to log. Sampling is deterministic: the
+// nth connection is logged whenever n*rate crosses an integer, which spreads
+// the logged ones evenly without drawing a random number per connection.
+type accessLogSampler struct {
+	config AccessLogConfig
+	count  atomic.Uint64
+}
+
+func newAccessLogSampler(config *AccessLogConfig) *accessLogSampler {
+	if config == nil {
+		return nil
+	}
+	return &accessLogSampler{config: *config}
+}
+
+// shouldLog reports whether a finished connection is logged. A nil sampler
+// logs everything.
+func (s *accessLogSampler) shouldLog(duration time.Duration, bytes int64) bool {
+	if s == nil || s.config.SampleRate >= 1 {
+		return true
+	}
+	if s.config.SlowThreshold > 0 && duration >= s.config.SlowThreshold {
+		return true
+	}
+	if s.config.BytesThreshold > 0 && bytes >= s.config.BytesThreshold {
+		return true
+	}
+
+	n := s.count.Add(1)
+	return uint64(float64(n)*s.config.SampleRate) != uint64(float64(n-1)*s.config.SampleRate)
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/utils/testutil"
+)
+
+// BenchmarkHandleConnection measures a whole proxied connection: accept,
+// backend selection, the relay and teardown, one echo round trip each.
+func BenchmarkHandleConnection(b *testing.B) {
+	echo, err := testutil.NewEchoBackend()
+	if err != nil {
+		b.Fatalf("start backend: %s", err)
+	}
+	b.Cleanup(func() { echo.Close() })
+	address, _ := startProxy(b, testProxyConfig(), echo.Address())
+
+	payload := make([]byte, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := testutil.RoundTrip(address, payload)
+		if err != nil {
+			b.Fatalf("round trip: %s", err)
+		}
+		if len(response) != len(payload) {
+			b.Fatalf("got %d bytes back, want %d", len(response), len(payload))
+		}
+	}
+}
+
+// BenchmarkRelayEcho measures throughput and latency of one long-lived
+// proxied connection, one echoed chunk per iteration.
+func BenchmarkRelayEcho(b *testing.B) {
+	echo, err := testutil.NewEchoBackend()
+	if err != nil {
+		b.Fatalf("start backend: %s", err)
+	}
+	b.Cleanup(func() { echo.Close() })
+	address, _ := startProxy(b, testProxyConfig(), echo.Address())
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		b.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	chunk := make([]byte, 16*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatalf("write: %s", err)
+		}
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			b.Fatalf("read: %s", err)
+		}
+	}
+}
+
+// BenchmarkCopyData measures one relay direction into a sink backend, with
+// and without splicing.
+func BenchmarkCopyData(b *testing.B) {
+	b.Run("buffered", func(b *testing.B) { benchmarkCopyData(b, defaultBufferSize, 0, false) })
+	b.Run("splice", func(b *testing.B) {
+		if !spliceSupported {
+			b.Skip("splice is not supported on this platform")
+		}
+		benchmarkCopyData(b, defaultBufferSize, 0, true)
+	})
+}
+
+// BenchmarkCopyDataBufferSize compares relay buffer sizes on the buffered
+// path, with the OS default socket buffers and with 1MB ones.
+func BenchmarkCopyDataBufferSize(b *testing.B) {
+	for _, socketBuffer := range []int{0, 1 << 20} {
+		for _, bufferSize := range []int{4 * 1024, 32 * 1024, 256 * 1024} {
+			name := fmt.Sprintf("buffer=%dk/socket=%dk", bufferSize/1024, socketBuffer/1024)
+			b.Run(name, func(b *testing.B) { benchmarkCopyData(b, bufferSize, socketBuffer, false) })
+		}
+	}
+}
+
+// benchmarkCopyData pushes b.N chunks through copyData from a loopback
+// connection into a sink backend. A socketBuffer above zero is set as both
+// kernel buffer sizes of the relay's connections. Without splice, src is
+// wrapped so the relay cannot see the TCP connection behind it.
+func benchmarkCopyData(b *testing.B, bufferSize, socketBuffer int, splice bool) {
+	sink, err := testutil.NewSinkBackend()
+	if err != nil {
+		b.Fatalf("start backend: %s", err)
+	}
+	b.Cleanup(func() { sink.Close() })
+
+	dst, err := net.Dial("tcp", sink.Address())
+	if err != nil {
+		b.Fatalf("dial: %s", err)
+	}
+	defer dst.Close()
+	writer, src := loopbackPair(b)
+	defer src.Close()
+	for _, conn := range []net.Conn{dst, src} {
+		if err := backend.SetSocketBuffers(conn, socketBuffer, socketBuffer); err != nil {
+			b.Fatalf("set socket buffers: %s", err)
+		}
+	}
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	go func() {
+		defer writer.Close()
+		for i := 0; i < b.N; i++ {
+			if _, err := writer.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	var source net.Conn = src
+	if !splice {
+		source = struct{ net.Conn }{src}
+	}
+	ch := NewConnectionHandler(nil, &ProxyConfig{BufferSize: bufferSize, WriteTimeout: time.Minute})
+	idle := newIdleTimer(time.Minute, src, dst)
+	defer idle.stop()
+	var lastActivity atomic.Int64
+
+	b.ResetTimer()
+	written, err := ch.copyData(context.Background(), dst, source, idle, nil, &lastActivity)
+	if err != io.EOF {
+		b.Fatalf("copyData: %v", err)
+	}
+	if want := int64(b.N) * int64(len(chunk)); written != want {
+		b.Fatalf("copied %d bytes, want %d", written, want)
+	}
+}
+
+// loopbackPair returns both ends of a loopback TCP connection.
+func loopbackPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatalf("accept: %s", err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
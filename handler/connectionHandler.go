@@ -2,174 +2,563 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
-	"sync"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 	"zen/backend"
 	"zen/balancer"
 	"zen/utils/logger"
+	"zen/utils/recovery"
 )
 
+// A backend whose pool is exhausted exhaustionThreshold times in a row is
+// skipped for exhaustionCooldown while other backends are available.
+const (
+	exhaustionThreshold = 3
+	exhaustionCooldown  = 5 * time.Second
+)
+
+// defaultBufferSize is the relay buffer size when none is configured.
+const defaultBufferSize = 32 * 1024
+
+// maxConsecutiveEmptyReads is how many reads in a row may return no data
+// and no error before a relay gives up on its source, as bufio does.
+const maxConsecutiveEmptyReads = 100
+
+// noBackendsPollInterval is how often a waiting client checks for a recovered backend.
+const noBackendsPollInterval = 50 * time.Millisecond
+
+type copyDirection string
+
+const (
+	clientToBackend copyDirection = "client to backend"
+	backendToClient copyDirection = "backend to client"
+)
+
+type copyResult struct {
+	direction copyDirection
+	bytes     int64
+	err       error
+}
+
 type ConnectionHandler struct {
 	balancer         balancer.LoadBalancer
 	maxRetries       int
-	retryDelay       time.Duration
+	retryBaseDelay   time.Duration
+	retryMaxDelay    time.Duration
 	connectTimeout   time.Duration
 	requestTimeout   time.Duration
 	handshakeTimeout time.Duration
 	proxyIdleTimeout time.Duration
+	writeTimeout     time.Duration
+
+	errorOnEarlyFailure bool
+	bytesPerSecond      int64
+	stickyCookie        string
+	noBackendsWait      time.Duration
+	errorResponse       *ErrorResponse
+	halfCloseTimeout    time.Duration
+	maxDuration         time.Duration
+	accessLog           *accessLogSampler
+	bufferSize          int
+	addRequestID        bool
+	linger              int
+	hedgeConnect        bool
+	accessControl       *AccessControl
+	checker             BackendChecker
 }
 
-func NewConnectionHandler(balancer balancer.LoadBalancer) *ConnectionHandler {
-	return &ConnectionHandler{
+// BackendChecker runs an out-of-band health check of a backend, as
+// backend.HealthChecker.CheckNow does.
+type BackendChecker interface {
+	CheckNow(address string)
+}
+
+type ProxyConfig struct {
+	MaxRetries       int
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	ConnectTimeout   time.Duration
+	RequestTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+	WriteTimeout     time.Duration
+
+	// HalfCloseTimeout bounds how long one direction keeps relaying after
+	// the other has reached EOF.
+	HalfCloseTimeout time.Duration
+
+	// MaxConnectionDuration closes a relayed connection this long after it
+	// was established, however active it is. Zero means no limit.
+	MaxConnectionDuration time.Duration
+
+	// ErrorOnEarlyFailure sends the 503 response to the client when the
+	// backend breaks before any of its bytes reached the client.
+	ErrorOnEarlyFailure bool
+
+	// BytesPerSecond caps each direction of a relayed connection. Zero means unlimited.
+	BytesPerSecond int64
+
+	// StickyCookie names the cookie that pins HTTP clients to a backend when
+	// the balancer supports keyed selection. TCP connections are keyed by client IP.
+	StickyCookie string
+
+	// NoBackendsWait holds a client for up to this long while no backend is
+	// available instead of rejecting it right away. Zero rejects immediately.
+	NoBackendsWait time.Duration
+
+	// ErrorResponse is what a client is told when it cannot be served. Nil
+	// closes raw TCP connections without writing anything.
+	ErrorResponse *ErrorResponse
+
+	// AccessLog samples the access log. Nil logs every connection.
+	AccessLog *AccessLogConfig
+
+	// BufferSize is the size of the buffer each relay direction copies
+	// through. Zero uses 32KB.
+	BufferSize int
+
+	// MaxBufferedBytes caps the bytes of one connection held in memory at
+	// once, both directions together. Each direction gets half of it, so
+	// it shrinks BufferSize when that is larger. Zero means no cap.
+	MaxBufferedBytes int
+
+	// AddRequestID sends each HTTP request's log ID to the backend as
+	// X-Request-Id when the client did not set one.
+	AddRequestID bool
+
+	// Linger is the SO_LINGER timeout in seconds set on relayed TCP
+	// connections for their close at teardown. Negative keeps the OS
+	// default, zero sends a reset instead of a FIN.
+	Linger int
+
+	// HedgeConnect dials two backends at once on every attempt and relays
+	// to whichever connects first.
+	HedgeConnect bool
+
+	// AccessControl refuses clients by IP before a backend is picked. Nil
+	// allows every client.
+	AccessControl *AccessControl
+}
+
+// ErrorResponse is an HTTP response sent to clients that cannot be served.
+// An empty Body uses a message describing the failure; otherwise every
+// {reason} in Body is replaced by that message.
+type ErrorResponse struct {
+	Status int
+	Body   string
+}
+
+func NewConnectionHandler(balancer balancer.LoadBalancer, config *ProxyConfig) *ConnectionHandler {
+	if config == nil {
+		config = &ProxyConfig{
+			MaxRetries:       3,
+			RetryBaseDelay:   10 * time.Millisecond,
+			RetryMaxDelay:    time.Second,
+			ConnectTimeout:   2 * time.Second,
+			RequestTimeout:   10 * time.Second,
+			HandshakeTimeout: 5 * time.Second,
+			IdleTimeout:      300 * time.Second,
+			WriteTimeout:     30 * time.Second,
+			HalfCloseTimeout: 5 * time.Second,
+			Linger:           -1,
+		}
+	}
+
+	ch := &ConnectionHandler{
 		balancer:         balancer,
-		maxRetries:       3,
-		retryDelay:       10 * time.Millisecond,
-		connectTimeout:   2 * time.Second,
-		requestTimeout:   10 * time.Second,
-		handshakeTimeout: 5 * time.Second,
-		proxyIdleTimeout: 300 * time.Second,
+		maxRetries:       config.MaxRetries,
+		retryBaseDelay:   config.RetryBaseDelay,
+		retryMaxDelay:    config.RetryMaxDelay,
+		connectTimeout:   config.ConnectTimeout,
+		requestTimeout:   config.RequestTimeout,
+		handshakeTimeout: config.HandshakeTimeout,
+		proxyIdleTimeout: config.IdleTimeout,
+		writeTimeout:     config.WriteTimeout,
+
+		errorOnEarlyFailure: config.ErrorOnEarlyFailure,
+		bytesPerSecond:      config.BytesPerSecond,
+		stickyCookie:        config.StickyCookie,
+		noBackendsWait:      config.NoBackendsWait,
+		errorResponse:       config.ErrorResponse,
+		halfCloseTimeout:    config.HalfCloseTimeout,
+		maxDuration:         config.MaxConnectionDuration,
+		accessLog:           newAccessLogSampler(config.AccessLog),
+		bufferSize:          config.BufferSize,
+		addRequestID:        config.AddRequestID,
+		linger:              config.Linger,
+		hedgeConnect:        config.HedgeConnect,
+		accessControl:       config.AccessControl,
+	}
+	if ch.bufferSize <= 0 {
+		ch.bufferSize = defaultBufferSize
+	}
+	if config.MaxBufferedBytes > 0 {
+		ch.bufferSize = max(min(ch.bufferSize, config.MaxBufferedBytes/2), 1)
 	}
+	return ch
 }
 
 func (ch *ConnectionHandler) HandleConnection(clientConnection net.Conn) {
+	// Behind a PROXY protocol listener, RemoteAddr is the client declared
+	// in the header, so everything below keys on the real client.
+	if proxied, ok := clientConnection.(*proxyProtocolConn); ok && proxied.handshake() != nil {
+		clientConnection.Close()
+		return
+	}
+
+	if !ch.accessControl.allowsAddress(clientConnection.RemoteAddr().String()) {
+		deniedConnections.Add(1)
+		logger.Debug("Denied connection from %s by access control", clientConnection.RemoteAddr())
+		clientConnection.Close()
+		return
+	}
+
 	address := clientConnection.RemoteAddr().String()
-	logger.Info("New connection from %s", address)
+	id := newConnectionID()
+	logger.Info("[%s] New connection from %s", id, address)
+
+	tracked := registry.register(id, address)
+	defer registry.unregister(tracked)
+
+	// Each connection is closed exactly once: below on every path out of
+	// the handler, or here after a panic that struck before that. The relay
+	// timers and StopRelays only expire deadlines.
+	var backendConnection net.Conn
+	closed := false
+	defer func() {
+		if value := recover(); value != nil {
+			recovery.Report("connection from "+address, value)
+			if closed {
+				return
+			}
+			if backendConnection != nil {
+				discard(backendConnection)
+			}
+			clientConnection.Close()
+		}
+	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), ch.requestTimeout)
-	defer cancel()
+	if InMaintenance() {
+		logger.Debug("[%s] Rejecting connection from %s: maintenance mode", id, address)
+		ch.sendErrorResponse(clientConnection, "Service under maintenance")
+		clientConnection.Close()
+		return
+	}
 
 	// This prevents clients from holding connections without sending data
 	clientConnection.SetReadDeadline(time.Now().Add(ch.handshakeTimeout))
 
-	backendConnection, selectedBackend, err := ch.getBackendConnectionWithRetry(ctx)
+	var stickyKey string
+	if ch.isSticky() {
+		stickyKey, _, _ = net.SplitHostPort(address)
+	}
+
+	// requestTimeout bounds finding a backend only; the relay that follows
+	// is bounded by the idle timeout and maxDuration.
+	ctx, cancel := context.WithTimeout(withConnectionID(context.Background(), id), ch.requestTimeout)
+	backendConnection, selectedBackend, err := ch.getBackendConnectionWithRetry(ctx, stickyKey)
+	cancel()
 	if err != nil {
-		logger.Error("Failed to establish connection to any backend for %s: %s", address, err)
+		logger.Error("[%s] Failed to establish connection to any backend for %s: %s", id, address, err)
 		ch.sendErrorResponse(clientConnection, "Service temporarily unavailable")
 		clientConnection.Close()
 		return
 	}
 
-	logger.Info("Successfully connected to backend %s for client %s", selectedBackend.Address, address)
+	logger.Info("[%s] Successfully connected to backend %s for client %s", id, selectedBackend.Address, address)
+	selectedBackend.IncrementActive()
+	defer selectedBackend.DecrementActive()
+	tracked.backend.Store(selectedBackend.Address)
+
+	// From here on client bytes may reach the backend. A failure during the
+	// relay is surfaced to the client by closing the connection; it is never
+	// retried against another backend, which could replay a non-idempotent request.
 
 	ch.setProxyTimeouts(clientConnection, backendConnection)
 
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(2)
+	// Set up front so every way the relay can end, the idle and lifetime
+	// timers included, closes both sides the configured way.
+	if ch.linger >= 0 {
+		setLinger(clientConnection, ch.linger)
+		setLinger(backendConnection, ch.linger)
+	}
+
+	startTime := time.Now()
+	results := make(chan copyResult, 2)
+	idle := newIdleTimer(ch.proxyIdleTimeout, clientConnection, backendConnection)
+	lifetime := newLifetimeTimer(ch.maxDuration, clientConnection, backendConnection)
 
-	var clientToBackendErr, backendToClientErr error
+	go ch.relay(relayCtx, backendConnection, clientConnection, clientToBackend, idle, lifetime, tracked, results)
+	go ch.relay(relayCtx, clientConnection, backendConnection, backendToClient, idle, lifetime, tracked, results)
 
-	go copyData(backendConnection, clientConnection, &waitGroup, &backendToClientErr)
-	go copyData(clientConnection, backendConnection, &waitGroup, &clientToBackendErr)
+	first := <-results
 
-	waitGroup.Wait()
+	// Once one side has half-closed, the other may keep sending, e.g. the
+	// backend its response after the client shut down its write side, as
+	// long as it never goes quiet for halfCloseTimeout. Hitting that ends
+	// the relay without an error being logged.
+	if first.err == io.EOF && !idle.expired() && !lifetime.expired() {
+		lingering := backendConnection
+		if first.direction == backendToClient {
+			lingering = clientConnection
+		}
+		idle.startHalfClose(ch.halfCloseTimeout, lingering)
+	}
 
-	if clientToBackendErr != nil && clientToBackendErr != io.EOF {
-		logger.Debug("Error copying client to backend for %s: %s", address, clientToBackendErr)
+	// After a real failure, such as a backend reset mid-stream, there is
+	// nothing left to wait for: the other direction is ended right away
+	// instead of at the idle timeout, which closes the client promptly.
+	failed := isBackendFailure(first.err)
+	if failed {
+		now := time.Now()
+		clientConnection.SetDeadline(now)
+		backendConnection.SetDeadline(now)
 	}
-	if backendToClientErr != nil && backendToClientErr != io.EOF {
-		logger.Debug("Error copying backend to client for %s: %s", address, backendToClientErr)
+
+	second := <-results
+	idle.stop()
+	lifetime.stop()
+
+	if (failed || idle.halfCloseExpired()) && isTimeout(second.err) {
+		second.err = nil
 	}
 
-	logger.Debug("Closing connection from %s", address)
-	backendConnection.Close()
+	var bytesSent, bytesReceived int64
+	for _, result := range []copyResult{first, second} {
+		if result.direction == clientToBackend {
+			bytesSent = result.bytes
+		} else {
+			bytesReceived = result.bytes
+		}
+
+		if result.err != nil && result.err != io.EOF {
+			logger.Debug("[%s] Error copying %s for %s: %s", id, result.direction, address, result.err)
+		}
+	}
+
+	if backendFailedMidStream(first, second, bytesSent) {
+		logger.Warn("[%s] Backend %s failed mid-stream for %s after %d bytes sent, not retrying",
+			id, selectedBackend.Address, address, bytesSent)
+	}
+
+	if (bytesSent == 0) != (bytesReceived == 0) {
+		logger.Debug("[%s] Asymmetric transfer for %s: sent=%d received=%d", id, address, bytesSent, bytesReceived)
+	}
+
+	// A relayed stream belongs to one client. Once either side has ended
+	// it, with a FIN, an error or a timer, the backend has seen that end and
+	// cannot serve another client, so the connection is never pooled.
+	logger.Debug("[%s] Closing connection from %s", id, address)
+	discard(backendConnection)
 	clientConnection.Close()
+	closed = true
+
+	reason := closeReason(first, second, idle.expired())
+	if lifetime.expired() {
+		reason = "max connection duration"
+	}
+
+	duration := time.Since(startTime)
+	if ch.accessLog.shouldLog(duration, bytesSent+bytesReceived) {
+		logger.Info("[%s] Access: client=%s backend=%s sent=%d received=%d duration=%s reason=%s",
+			id, address, selectedBackend.Address, bytesSent, bytesReceived, duration, reason)
+	}
 }
 
-func (ch *ConnectionHandler) getBackendConnectionWithRetry(ctx context.Context) (net.Conn, *backend.Backend, error) {
+// SetBackendChecker has failed connects to a backend trigger an immediate
+// health check of it, so a dead backend stops being picked before the next
+// regular check. Without one, only regular checks notice.
+func (ch *ConnectionHandler) SetBackendChecker(checker BackendChecker) {
+	ch.checker = checker
+}
+
+// getBackendConnectionWithRetry covers the connect phase only: it may try
+// several backends because nothing has been forwarded yet. Callers must not
+// call it again for a client once relaying has started. A non-empty
+// stickyKey picks the first backend by key; retries fall back to the balancer.
+func (ch *ConnectionHandler) getBackendConnectionWithRetry(ctx context.Context, stickyKey string) (net.Conn, *backend.Backend, error) {
 	var lastErr error
 	triedBackends := make(map[string]bool)
+	id := connectionIDFrom(ctx)
+
+	if inFDCooldown() {
+		return nil, nil, ErrOutOfFileDescriptors
+	}
+
+	if ch.noBackendsWait > 0 {
+		ch.waitForAvailableBackend(ctx)
+	}
 
 	for attempt := 1; attempt <= ch.maxRetries; attempt++ {
 		select {
 		case <-ctx.Done():
+			retryStats.exhausted.Add(1)
 			return nil, nil, fmt.Errorf("request timeout after %d attempts", attempt-1)
 		default:
 		}
 
-		backendServer, err := ch.balancer.Next()
+		if attempt > 1 {
+			retryStats.retries.Add(1)
+		}
+
+		backendServer, err := ch.nextBackend(stickyKey, attempt)
 		if err != nil {
 			lastErr = err
-			logger.Debug("Attempt %d: No available backends: %s", attempt, err)
+			logger.Debug("[%s] Attempt %d: No available backends: %s", id, attempt, err)
 			if attempt < ch.maxRetries {
-				ch.sleepWithContext(ctx, ch.retryDelay)
+				ch.sleepWithContext(ctx, ch.retryBackoff(attempt))
 			}
 			continue
 		}
 
 		if triedBackends[backendServer.Address] {
-			logger.Debug("Attempt %d: Skipping already tried backend %s", attempt, backendServer.Address)
+			logger.Debug("[%s] Attempt %d: Skipping already tried backend %s", id, attempt, backendServer.Address)
 
 			availableCount := ch.balancer.GetAvailableCount()
 			if len(triedBackends) >= availableCount {
-				logger.Debug("All %d available backends have been tried", availableCount)
+				logger.Debug("[%s] All %d available backends have been tried", id, availableCount)
 				break
 			}
 
 			if attempt < ch.maxRetries {
-				ch.sleepWithContext(ctx, ch.retryDelay)
+				ch.sleepWithContext(ctx, ch.retryBackoff(attempt))
 			}
 			continue
 		}
 
 		triedBackends[backendServer.Address] = true
 
-		logger.Debug("Attempt %d: Trying backend %s", attempt, backendServer.Address)
+		if backendServer.InCooldown() && len(triedBackends) < ch.balancer.GetAvailableCount() {
+			logger.Debug("[%s] Attempt %d: Skipping backend %s, cooling down after pool exhaustion", id, attempt, backendServer.Address)
+			continue
+		}
+
+		logger.Debug("[%s] Attempt %d: Trying backend %s", id, attempt, backendServer.Address)
 
-		conn, err := ch.getConnectionWithContext(ctx, backendServer)
+		var conn net.Conn
+		if ch.hedgeConnect && !(stickyKey != "" && attempt == 1 && ch.isSticky()) {
+			// A keyed first pick is where the client belongs, so it is not raced
+			conn, backendServer, err = ch.hedgedConnection(ctx, backendServer, triedBackends)
+		} else {
+			conn, err = ch.getConnectionWithContext(ctx, backendServer)
+		}
+		if errors.Is(err, backend.ErrPoolExhausted) {
+			// The backend is saturated rather than down: move on to another
+			// one right away instead of backing off and hammering it again.
+			lastErr = err
+			retryStats.failure(backendServer.Address)
+			logger.Warn("[%s] Attempt %d: Connection pool for backend %s exhausted (proxy side limit, backend not marked down)", id, attempt, backendServer.Address)
+			if backendServer.RecordExhaustion(exhaustionThreshold, exhaustionCooldown) {
+				logger.Warn("Backend %s exhausted its pool %d times in a row, deprioritizing it for %s",
+					backendServer.Address, exhaustionThreshold, exhaustionCooldown)
+			}
+			continue
+		}
+		if isFDExhausted(err) {
+			// Every backend would fail the same way: the limit is ours
+			startFDCooldown(backendServer.Address, err)
+			return nil, nil, ErrOutOfFileDescriptors
+		}
 		if err != nil {
 			lastErr = err
-			logger.Debug("Attempt %d: Failed to connect to backend %s: %s", attempt, backendServer.Address, err)
+			retryStats.failure(backendServer.Address)
+			logger.Debug("[%s] Attempt %d: Failed to connect to backend %s: %s", id, attempt, backendServer.Address, err)
+			if ch.checker != nil && ctx.Err() == nil {
+				ch.checker.CheckNow(backendServer.Address)
+			}
 
 			if attempt < ch.maxRetries {
-				ch.sleepWithContext(ctx, ch.retryDelay)
+				ch.sleepWithContext(ctx, ch.retryBackoff(attempt))
 			}
 			continue
 		}
 
-		logger.Debug("Attempt %d: Successfully connected to backend %s", attempt, backendServer.Address)
+		backendServer.ResetExhaustion()
+		if pinning, ok := ch.balancer.(balancer.PinningBalancer); ok && stickyKey != "" {
+			pinning.Pin(stickyKey, backendServer)
+		}
+		logger.Debug("[%s] Attempt %d: Successfully connected to backend %s", id, attempt, backendServer.Address)
+		retryStats.success(attempt - 1)
+		if attempt > 1 {
+			logger.Info("[%s] Connected to backend %s after %d retries", id, backendServer.Address, attempt-1)
+		}
 		return conn, backendServer, nil
 	}
 
+	retryStats.exhausted.Add(1)
 	return nil, nil, fmt.Errorf("all backends failed after %d attempts: %w", ch.maxRetries, lastErr)
 }
 
-func (ch *ConnectionHandler) getConnectionWithContext(ctx context.Context, backend *backend.Backend) (net.Conn, error) {
-	type connResult struct {
-		conn net.Conn
-		err  error
+// waitForAvailableBackend blocks while the balancer has no available backend,
+// until one recovers, noBackendsWait passes or ctx is done.
+func (ch *ConnectionHandler) waitForAvailableBackend(ctx context.Context) {
+	if ch.balancer.GetAvailableCount() > 0 {
+		return
 	}
 
-	resultChan := make(chan connResult, 1)
+	logger.Debug("[%s] No available backends, waiting up to %s for one to recover", connectionIDFrom(ctx), ch.noBackendsWait)
+	deadline := time.NewTimer(ch.noBackendsWait)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(noBackendsPollInterval)
+	defer ticker.Stop()
 
-	go func() {
-		conn, err := backend.ConnectionPool.Get()
+	for {
 		select {
-		case resultChan <- connResult{conn: conn, err: err}:
-		case <-ctx.Done():
-			if conn != nil {
-				conn.Close()
+		case <-ticker.C:
+			if ch.balancer.GetAvailableCount() > 0 {
+				return
 			}
+		case <-deadline.C:
+			return
+		case <-ctx.Done():
+			return
 		}
-	}()
+	}
+}
 
-	timeout := ch.connectTimeout
-	if deadline, ok := ctx.Deadline(); ok {
-		if remaining := time.Until(deadline); remaining < timeout {
-			timeout = remaining
-		}
+func (ch *ConnectionHandler) nextBackend(stickyKey string, attempt int) (*backend.Backend, error) {
+	if keyed, ok := ch.balancer.(balancer.KeyedBalancer); ok && stickyKey != "" && attempt == 1 {
+		return keyed.NextForKey(stickyKey)
 	}
+	return ch.balancer.Next()
+}
 
-	select {
-	case result := <-resultChan:
-		return result.conn, result.err
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("backend connection timeout (%v)", timeout)
-	case <-ctx.Done():
-		return nil, ctx.Err()
+func (ch *ConnectionHandler) isSticky() bool {
+	_, ok := ch.balancer.(balancer.KeyedBalancer)
+	return ok
+}
+
+func (ch *ConnectionHandler) getConnectionWithContext(ctx context.Context, backend *backend.Backend) (net.Conn, error) {
+	connectCtx, cancel := context.WithTimeout(ctx, ch.connectTimeout)
+	defer cancel()
+
+	return backend.ConnectionPool.GetContext(connectCtx)
+}
+
+// retryBackoff returns how long to wait after the given failed attempt:
+// exponential backoff from retryBaseDelay capped at retryMaxDelay, with full
+// jitter so clients failing together do not retry together. When base and
+// max are equal the delay is fixed.
+func (ch *ConnectionHandler) retryBackoff(attempt int) time.Duration {
+	if ch.retryBaseDelay >= ch.retryMaxDelay {
+		return ch.retryBaseDelay
+	}
+
+	ceiling := ch.retryBaseDelay
+	for i := 1; i < attempt && ceiling < ch.retryMaxDelay; i++ {
+		ceiling *= 2
 	}
+	ceiling = min(ceiling, ch.retryMaxDelay)
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
 }
 
 func (ch *ConnectionHandler) sleepWithContext(ctx context.Context, duration time.Duration) {
@@ -179,56 +568,224 @@ func (ch *ConnectionHandler) sleepWithContext(ctx context.Context, duration time
 	}
 }
 
-func copyData(source net.Conn, target net.Conn, waitGroup *sync.WaitGroup, connectionError *error) {
-	defer waitGroup.Done()
+func (ch *ConnectionHandler) relay(ctx context.Context, dst, src net.Conn, direction copyDirection, idle *idleTimer, lifetime *lifetimeTimer, tracked *trackedConnection, results chan<- copyResult) {
+	// A panic still has to produce a result, or HandleConnection would wait forever
+	defer func() {
+		if value := recover(); value != nil {
+			recovery.Report("relay "+string(direction), value)
+			results <- copyResult{direction: direction, err: fmt.Errorf("relay panicked: %v", value)}
+		}
+	}()
 
-	buffer := make([]byte, 32*1024)
+	n, err := ch.copyData(ctx, dst, src, idle, newRateLimiter(ch.bytesPerSecond), tracked.activity(direction))
 
-	for {
-		source.SetReadDeadline(time.Now().Add(300 * time.Second))
+	// Nothing has been written to the client yet, so it can still be told
+	// what went wrong before its write side is closed.
+	if direction == backendToClient && n == 0 && ch.errorOnEarlyFailure && isBackendFailure(err) && !idle.expired() {
+		logger.Debug("[%s] Backend failed before responding to %s, sending error response", tracked.logID, dst.RemoteAddr())
+		dst.SetWriteDeadline(time.Now().Add(ch.writeTimeout))
+		ch.sendErrorResponse(dst, "Service temporarily unavailable")
+	}
 
-		n, err := source.Read(buffer)
-		if err != nil {
-			*connectionError = err
-			break
-		}
+	// A relay ended by a timer is torn down, not half-closed, so the close
+	// that follows reaches the peer as configured, e.g. as a reset.
+	forced := idle.expired() || lifetime.expired()
+	if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok && !forced {
+		halfCloser.CloseWrite()
+	}
+
+	results <- copyResult{direction: direction, bytes: n, err: err}
+}
+
+// copyData relays src into dst until either side fails or ctx is done,
+// recording the time of every read in lastActivity. A non-nil limiter
+// throttles the copy; reads are capped to its rate so the buffer is never
+// filled faster than it can be drained. Between two raw TCP connections on
+// Linux the bytes are spliced in the kernel instead, see spliceData.
+//
+// Backpressure comes from the copy being synchronous: src is not read again
+// until the previous chunk has been written to dst. A slow dst blocks the
+// write, the kernel buffers behind src fill up and TCP flow control stops
+// the fast peer. A direction therefore never holds more than one buffer,
+// and any queue added between the read and the write must stay bounded the
+// same way.
+func (ch *ConnectionHandler) copyData(ctx context.Context, dst, src net.Conn, idle *idleTimer, limiter *rateLimiter, lastActivity *atomic.Int64) (int64, error) {
+	stop := context.AfterFunc(ctx, func() {
+		now := time.Now()
+		src.SetReadDeadline(now)
+		dst.SetWriteDeadline(now)
+	})
+	defer stop()
+
+	var written int64
+	var err error
+	if dstTCP, srcTCP, ok := spliceable(dst, src); ok {
+		written, err = ch.spliceData(ctx, dstTCP, srcTCP, idle, limiter, lastActivity)
+	} else {
+		written, err = ch.bufferedCopy(ctx, dst, src, idle, limiter, lastActivity)
+	}
+
+	if ctx.Err() != nil && isTimeout(err) {
+		err = errRelayStopped
+	}
+	return written, err
+}
+
+// bufferedCopy is copyData through a userspace buffer. Only reads that
+// return data count as activity: the idle timer and lastActivity are left
+// alone by empty reads, and a source that keeps returning no data and no
+// error fails with io.ErrNoProgress instead of spinning forever. Data that
+// comes with an error, such as the last bytes before EOF, is still written.
+func (ch *ConnectionHandler) bufferedCopy(ctx context.Context, dst, src net.Conn, idle *idleTimer, limiter *rateLimiter, lastActivity *atomic.Int64) (int64, error) {
+	buffer := make([]byte, limiter.chunkSize(ch.bufferSize))
+
+	var written int64
+	emptyReads := 0
+
+	for {
+		n, err := src.Read(buffer)
 
 		if n > 0 {
-			target.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			emptyReads = 0
+			idle.touch()
+			lastActivity.Store(time.Now().UnixNano())
+			limiter.wait(n)
+
+			// Checked after the deadline is pushed out, so a stop that came
+			// in between cannot be overwritten by it.
+			dst.SetWriteDeadline(time.Now().Add(ch.writeTimeout))
+			if ctx.Err() != nil {
+				return written, errRelayStopped
+			}
 
-			_, writeErr := target.Write(buffer[:n])
+			w, writeErr := dst.Write(buffer[:n])
+			written += int64(w)
 			if writeErr != nil {
-				*connectionError = writeErr
-				break
+				return written, writeErr
+			}
+		} else if err == nil {
+			emptyReads++
+			if emptyReads >= maxConsecutiveEmptyReads {
+				return written, io.ErrNoProgress
 			}
 		}
+
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// closeReason classifies why a relayed connection ended. An idle teardown,
+// errors and timeouts on either direction take precedence over a clean EOF;
+// otherwise the side that finished first is the one that closed the connection.
+func closeReason(first, second copyResult, idleTimedOut bool) string {
+	if idleTimedOut {
+		return "idle timeout"
+	}
+
+	for _, result := range []copyResult{first, second} {
+		if result.err == errRelayStopped {
+			return "shutdown"
+		}
+	}
+
+	for _, result := range []copyResult{first, second} {
+		if isTimeout(result.err) {
+			return "timeout"
+		}
+	}
+
+	for _, result := range []copyResult{first, second} {
+		if result.err != nil && result.err != io.EOF {
+			return "error"
+		}
+	}
+
+	if first.direction == clientToBackend {
+		return "client EOF"
+	}
+	return "backend EOF"
+}
+
+// backendFailedMidStream reports whether the backend side broke with an error
+// after client bytes had already been forwarded to it.
+func backendFailedMidStream(first, second copyResult, bytesSent int64) bool {
+	if bytesSent == 0 {
+		return false
 	}
 
-	if tcpConnection, ok := target.(*net.TCPConn); ok {
-		tcpConnection.CloseWrite()
+	for _, result := range []copyResult{first, second} {
+		if result.direction == backendToClient && isBackendFailure(result.err) {
+			return true
+		}
 	}
+	return false
+}
+
+// isBackendFailure reports whether err is a real failure rather than a clean
+// EOF, one of the deadlines the relay sets on purpose or a shutdown.
+func isBackendFailure(err error) bool {
+	return err != nil && err != io.EOF && err != errRelayStopped && !isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func (ch *ConnectionHandler) getAvailableBackendCount() int {
 	return ch.balancer.GetAvailableCount()
 }
 
+// sendErrorResponse writes the configured error response to a raw TCP
+// client. Without one nothing is written: injecting HTTP into a stream of
+// another protocol would only confuse the client.
 func (ch *ConnectionHandler) sendErrorResponse(conn net.Conn, message string) {
-	errorMsg := fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\n"+
+	if ch.errorResponse == nil {
+		return
+	}
+
+	status, body := ch.errorResponse.render(message)
+	errorMsg := fmt.Sprintf("HTTP/1.1 %d %s\r\n"+
 		"Content-Type: text/plain\r\n"+
 		"Content-Length: %d\r\n"+
 		"Connection: close\r\n\r\n"+
-		"%s", len(message), message)
+		"%s", status, http.StatusText(status), len(body), body)
 
 	conn.Write([]byte(errorMsg))
 }
 
+// writeHTTPError answers an HTTP mode request that cannot be served. HTTP
+// clients always get a response; a configured one replaces the default 503.
+func (ch *ConnectionHandler) writeHTTPError(w http.ResponseWriter, message string) {
+	if ch.errorResponse == nil {
+		http.Error(w, message, http.StatusServiceUnavailable)
+		return
+	}
+
+	status, body := ch.errorResponse.render(message)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+func (r *ErrorResponse) render(message string) (int, string) {
+	status := r.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+
+	if r.Body == "" {
+		return status, message
+	}
+	return status, strings.ReplaceAll(r.Body, "{reason}", message)
+}
+
+// setProxyTimeouts clears the handshake deadlines before relaying. Idleness
+// during the relay is enforced by the shared idleTimer instead of read deadlines.
 func (ch *ConnectionHandler) setProxyTimeouts(clientConn, backendConn net.Conn) {
 	clientConn.SetDeadline(time.Time{})
 	backendConn.SetDeadline(time.Time{})
-
-	idleDeadline := time.Now().Add(ch.proxyIdleTimeout)
-
-	clientConn.SetReadDeadline(idleDeadline)
-	backendConn.SetReadDeadline(idleDeadline)
 }
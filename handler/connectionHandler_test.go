@@ -0,0 +1,581 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+	"zen/utils/recovery"
+	"zen/utils/testutil"
+)
+
+// testProxyConfig returns short timeouts so failing tests end quickly.
+func testProxyConfig() *ProxyConfig {
+	return &ProxyConfig{
+		MaxRetries:       1,
+		RetryBaseDelay:   time.Millisecond,
+		RetryMaxDelay:    time.Millisecond,
+		ConnectTimeout:   time.Second,
+		RequestTimeout:   2 * time.Second,
+		HandshakeTimeout: 2 * time.Second,
+		IdleTimeout:      5 * time.Second,
+		WriteTimeout:     5 * time.Second,
+		HalfCloseTimeout: 5 * time.Second,
+		Linger:           -1,
+	}
+}
+
+// startProxy serves HandleConnection on a loopback port in front of a pool
+// of address and returns the port's address and the backend.
+func startProxy(t testing.TB, config *ProxyConfig, address string) (string, *backend.Backend) {
+	t.Helper()
+
+	pool := backend.NewBackendPool([]backend.Upstream{{Address: address, Weight: 1}}, &backend.ConnectionPoolSettings{
+		MaxIdle:     4,
+		MaxActive:   16,
+		IdleTimeout: time.Minute,
+	})
+	t.Cleanup(pool.Close)
+	proxy := NewConnectionHandler(balancer.NewRoundRobin(pool), config)
+	return serveProxy(t, proxy), pool.GetAllBackends()[0]
+}
+
+// serveProxy runs proxy on a loopback port until the test ends and returns
+// the port's address.
+func serveProxy(t testing.TB, proxy *ConnectionHandler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	serveListener(t, proxy, ln)
+	return ln.Addr().String()
+}
+
+// serveListener runs proxy on every connection ln accepts until the test ends.
+func serveListener(t testing.TB, proxy *ConnectionHandler, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.HandleConnection(conn)
+		}
+	}()
+}
+
+// startBackend starts a testutil backend running handler and closes it when
+// the test ends.
+func startBackend(t testing.TB, handler func(net.Conn) (int64, error)) *testutil.Backend {
+	t.Helper()
+
+	b, err := testutil.NewBackend(handler)
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// waitFor polls condition until it holds or a second has passed.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHalfCloseRelaysResponseSentAfterClientFIN(t *testing.T) {
+	chunk := []byte("part of a response\n")
+	const chunks = 6
+
+	// The backend only answers once it has seen the client's FIN, and then
+	// takes longer than the half-close timeout in total, but never goes
+	// quiet for that long.
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			return int64(len(request)), err
+		}
+		for i := 0; i < chunks; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if _, err := conn.Write(chunk); err != nil {
+				return int64(len(request)), err
+			}
+		}
+		return int64(len(request)), nil
+	})
+
+	config := testProxyConfig()
+	config.HalfCloseTimeout = 300 * time.Millisecond
+	address, selected := startProxy(t, config, b.Address())
+
+	response, err := testutil.RoundTrip(address, []byte("request"))
+	if err != nil {
+		t.Fatalf("round trip: %s", err)
+	}
+	if want := bytes.Repeat(chunk, chunks); !bytes.Equal(response, want) {
+		t.Fatalf("got %d bytes %q, want the full %d byte response", len(response), response, len(want))
+	}
+
+	// The backend connection saw the client's FIN and must not be reused.
+	waitFor(t, "the backend connection to be released", func() bool {
+		return selected.ConnectionPool.Stats().Active == 0
+	})
+	if idle := selected.ConnectionPool.Stats().Idle; idle != 0 {
+		t.Fatalf("%d half-closed connections went back to the pool", idle)
+	}
+}
+
+func TestHalfCloseTimeoutEndsQuietBackend(t *testing.T) {
+	release := make(chan struct{})
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		request, _ := io.ReadAll(conn)
+		conn.Write([]byte("partial"))
+		<-release
+		return int64(len(request)), nil
+	})
+	defer close(release)
+
+	config := testProxyConfig()
+	config.HalfCloseTimeout = 200 * time.Millisecond
+	address, selected := startProxy(t, config, b.Address())
+
+	start := time.Now()
+	response, err := testutil.RoundTrip(address, []byte("request"))
+	if err != nil {
+		t.Fatalf("round trip: %s", err)
+	}
+	if string(response) != "partial" {
+		t.Fatalf("got %q, want %q", response, "partial")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("relay took %s to end after the backend went quiet", elapsed)
+	}
+
+	waitFor(t, "the backend connection to be released", func() bool {
+		return selected.ConnectionPool.Stats().Active == 0
+	})
+	if idle := selected.ConnectionPool.Stats().Idle; idle != 0 {
+		t.Fatalf("a connection with an unread response went back to the pool")
+	}
+}
+
+func TestBackendResetMidStreamClosesClient(t *testing.T) {
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		var request [7]byte
+		n, err := io.ReadFull(conn, request[:])
+		if err != nil {
+			return int64(n), err
+		}
+		conn.Write([]byte("partial"))
+		// Closing with linger 0 sends a reset instead of a FIN
+		conn.(*net.TCPConn).SetLinger(0)
+		return int64(n), nil
+	})
+	address, selected := startProxy(t, testProxyConfig(), b.Address())
+
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	// The client keeps its write side open: only the backend's failure can
+	// end the relay.
+	received, err := io.ReadAll(client)
+	if isTimeout(err) {
+		t.Fatal("the client was left open after the backend reset")
+	}
+	if string(received) != "partial" {
+		t.Fatalf("client got %q, want the bytes sent before the reset", received)
+	}
+
+	waitFor(t, "the backend connection to be released", func() bool {
+		return selected.ConnectionPool.Stats().Active == 0
+	})
+	if idle := selected.ConnectionPool.Stats().Idle; idle != 0 {
+		t.Fatal("the reset backend connection went back to the pool")
+	}
+}
+
+// panickingBalancer panics on its first selection and then hands out
+// backends like the balancer it wraps.
+type panickingBalancer struct {
+	balancer.LoadBalancer
+	panicked atomic.Bool
+}
+
+func (p *panickingBalancer) Next() (*backend.Backend, error) {
+	if p.panicked.CompareAndSwap(false, true) {
+		panic("balancer bug")
+	}
+	return p.LoadBalancer.Next()
+}
+
+func TestPanicInConnectionIsRecovered(t *testing.T) {
+	echo, err := testutil.NewEchoBackend()
+	if err != nil {
+		t.Fatalf("start backend: %s", err)
+	}
+	t.Cleanup(func() { echo.Close() })
+
+	pool := backend.NewBackendPool([]backend.Upstream{{Address: echo.Address(), Weight: 1}}, &backend.ConnectionPoolSettings{
+		MaxIdle:     4,
+		MaxActive:   16,
+		IdleTimeout: time.Minute,
+	})
+	t.Cleanup(pool.Close)
+	lb := &panickingBalancer{LoadBalancer: balancer.NewRoundRobin(pool)}
+	address := serveProxy(t, NewConnectionHandler(lb, testProxyConfig()))
+
+	panics := recovery.Count()
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("request"))
+	if response, err := io.ReadAll(client); len(response) != 0 || isTimeout(err) {
+		t.Fatalf("the panicking connection got %q, %v; want it closed", response, err)
+	}
+	if got := recovery.Count() - panics; got != 1 {
+		t.Fatalf("%d panics recovered, want 1", got)
+	}
+
+	// The process, and the proxy with it, keeps serving
+	response, err := testutil.RoundTrip(address, []byte("request"))
+	if err != nil {
+		t.Fatalf("round trip after the panic: %s", err)
+	}
+	if string(response) != "request" {
+		t.Fatalf("got %q after the panic, want the echo", response)
+	}
+}
+
+func TestRelayToIPv6Upstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	address, selected := startProxy(t, testProxyConfig(), ln.Addr().String())
+	response, err := testutil.RoundTrip(address, []byte("over IPv6"))
+	if err != nil {
+		t.Fatalf("round trip: %s", err)
+	}
+	if string(response) != "over IPv6" {
+		t.Fatalf("got %q, want the echo", response)
+	}
+	if stats := selected.ConnectionPool.Stats(); stats.TotalDials != 1 {
+		t.Fatalf("%d dials to %s, want 1", stats.TotalDials, selected.Address)
+	}
+}
+
+func TestSlowConsumerDoesNotGrowMemory(t *testing.T) {
+	const total = 256 << 20
+	var written atomic.Int64
+
+	// The backend sends as fast as it is let, far more than any buffer
+	// between it and the client holds.
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		var request [2]byte
+		if _, err := io.ReadFull(conn, request[:]); err != nil {
+			return 0, err
+		}
+		chunk := make([]byte, 64*1024)
+		for written.Load() < total {
+			n, err := conn.Write(chunk)
+			written.Add(int64(n))
+			if err != nil {
+				return 2, err
+			}
+		}
+		return 2, nil
+	})
+
+	config := testProxyConfig()
+	config.MaxBufferedBytes = 64 * 1024
+	address, _ := startProxy(t, config, b.Address())
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	client, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+	client.(*net.TCPConn).SetReadBuffer(64 * 1024)
+	if _, err := client.Write([]byte("go")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// The client reads nothing; TCP flow control has to stop the backend
+	var last int64
+	for stalled := 0; stalled < 5; {
+		time.Sleep(100 * time.Millisecond)
+		if n := written.Load(); n == last {
+			stalled++
+		} else {
+			last, stalled = n, 0
+		}
+	}
+
+	var during runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&during)
+
+	if last >= total/4 {
+		t.Errorf("the backend wrote %d bytes to a client that read nothing", last)
+	}
+	if growth := int64(during.HeapAlloc) - int64(before.HeapAlloc); growth > 4<<20 {
+		t.Errorf("heap grew by %d bytes while the client stalled", growth)
+	}
+}
+
+// readResult is one scripted return of scriptedConn.Read.
+type readResult struct {
+	data string
+	err  error
+}
+
+// scriptedConn returns its reads in order and then (0, nil) forever. Writes
+// are collected and fail with writeErr once failAfter bytes are written.
+type scriptedConn struct {
+	net.Conn
+	reads     []readResult
+	emptyRead int
+
+	written   bytes.Buffer
+	failAfter int
+	writeErr  error
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.reads) == 0 {
+		c.emptyRead++
+		return 0, nil
+	}
+	next := c.reads[0]
+	c.reads = c.reads[1:]
+	return copy(b, next.data), next.err
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	if c.writeErr != nil && c.written.Len()+len(b) > c.failAfter {
+		n := c.failAfter - c.written.Len()
+		c.written.Write(b[:n])
+		return n, c.writeErr
+	}
+	return c.written.Write(b)
+}
+
+func (c *scriptedConn) SetDeadline(time.Time) error      { return nil }
+func (c *scriptedConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *scriptedConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestBufferedCopy(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+
+	tests := []struct {
+		name        string
+		src         *scriptedConn
+		dst         *scriptedConn
+		wantWritten string
+		wantErr     error
+	}{
+		{
+			name:        "transfer",
+			src:         &scriptedConn{reads: []readResult{{"hello ", nil}, {"world", nil}, {"", io.EOF}}},
+			dst:         &scriptedConn{},
+			wantWritten: "hello world",
+			wantErr:     io.EOF,
+		},
+		{
+			name:    "immediate EOF",
+			src:     &scriptedConn{reads: []readResult{{"", io.EOF}}},
+			dst:     &scriptedConn{},
+			wantErr: io.EOF,
+		},
+		{
+			name:        "data with EOF",
+			src:         &scriptedConn{reads: []readResult{{"last bytes", io.EOF}}},
+			dst:         &scriptedConn{},
+			wantWritten: "last bytes",
+			wantErr:     io.EOF,
+		},
+		{
+			name:        "write error mid-transfer",
+			src:         &scriptedConn{reads: []readResult{{"hello ", nil}, {"world", nil}, {"", io.EOF}}},
+			dst:         &scriptedConn{failAfter: 8, writeErr: errBroken},
+			wantWritten: "hello wo",
+			wantErr:     errBroken,
+		},
+		{
+			name:    "empty reads",
+			src:     &scriptedConn{},
+			dst:     &scriptedConn{},
+			wantErr: io.ErrNoProgress,
+		},
+	}
+	for _, test := range tests {
+		ch := NewConnectionHandler(nil, &ProxyConfig{BufferSize: 16, WriteTimeout: time.Second})
+		idle := newIdleTimer(time.Minute, test.src, test.dst)
+		var lastActivity atomic.Int64
+
+		written, err := ch.copyData(context.Background(), test.dst, test.src, idle, nil, &lastActivity)
+		idle.stop()
+
+		if err != test.wantErr {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.wantErr)
+		}
+		if written != int64(len(test.wantWritten)) || test.dst.written.String() != test.wantWritten {
+			t.Errorf("%s: wrote %d bytes %q, want %q", test.name, written, test.dst.written.String(), test.wantWritten)
+		}
+		// Only reads that return data count as activity
+		if moved := lastActivity.Load() != 0; moved != (test.wantWritten != "") {
+			t.Errorf("%s: activity recorded %t after moving %d bytes", test.name, moved, written)
+		}
+	}
+}
+
+func TestBufferedCopyGivesUpOnEmptyReads(t *testing.T) {
+	src := &scriptedConn{reads: []readResult{{"data", nil}}}
+	ch := NewConnectionHandler(nil, &ProxyConfig{WriteTimeout: time.Second})
+	idle := newIdleTimer(time.Minute, src, &scriptedConn{})
+	defer idle.stop()
+	var lastActivity atomic.Int64
+
+	if _, err := ch.copyData(context.Background(), &scriptedConn{}, src, idle, nil, &lastActivity); err != io.ErrNoProgress {
+		t.Fatalf("got %v, want io.ErrNoProgress", err)
+	}
+	if src.emptyRead != maxConsecutiveEmptyReads {
+		t.Fatalf("%d empty reads before giving up, want %d", src.emptyRead, maxConsecutiveEmptyReads)
+	}
+}
+
+// closeCountingConn is a client connection that counts its Close calls.
+type closeCountingConn struct {
+	*net.TCPConn
+	closes atomic.Int32
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closes.Add(1)
+	return c.TCPConn.Close()
+}
+
+// handleCounted runs HandleConnection on the server side of a loopback
+// connection while peer drives the client side, and returns how often the
+// handler closed the connection.
+func handleCounted(t *testing.T, proxy *ConnectionHandler, peer func(client net.Conn)) int32 {
+	t.Helper()
+
+	client, server := loopbackPair(t)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go peer(client)
+
+	conn := &closeCountingConn{TCPConn: server}
+	proxy.HandleConnection(conn)
+	return conn.closes.Load()
+}
+
+func TestClientConnectionIsClosedOnce(t *testing.T) {
+	echo := startBackend(t, func(conn net.Conn) (int64, error) {
+		return io.Copy(conn, conn)
+	})
+	reset := startBackend(t, func(conn net.Conn) (int64, error) {
+		var request [7]byte
+		n, err := io.ReadFull(conn, request[:])
+		conn.(*net.TCPConn).SetLinger(0)
+		return int64(n), err
+	})
+	denyLoopback, err := NewAccessControl(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+
+	newProxy := func(address string, configure func(*ProxyConfig)) *ConnectionHandler {
+		config := testProxyConfig()
+		if configure != nil {
+			configure(config)
+		}
+		pool := backend.NewBackendPool([]backend.Upstream{{Address: address, Weight: 1}}, &backend.ConnectionPoolSettings{
+			MaxIdle:     4,
+			MaxActive:   16,
+			IdleTimeout: time.Minute,
+		})
+		t.Cleanup(pool.Close)
+		return NewConnectionHandler(balancer.NewRoundRobin(pool), config)
+	}
+	roundTrip := func(client net.Conn) {
+		client.Write([]byte("request"))
+		client.(*net.TCPConn).CloseWrite()
+		io.Copy(io.Discard, client)
+	}
+	stayOpen := func(client net.Conn) {
+		client.Write([]byte("request"))
+		io.Copy(io.Discard, client)
+	}
+
+	tests := []struct {
+		name  string
+		proxy *ConnectionHandler
+		peer  func(net.Conn)
+	}{
+		{"relayed", newProxy(echo.Address(), nil), roundTrip},
+		{"backend reset", newProxy(reset.Address(), nil), stayOpen},
+		{"idle timeout", newProxy(echo.Address(), func(c *ProxyConfig) { c.IdleTimeout = 100 * time.Millisecond }), stayOpen},
+		{"no backend", newProxy("127.0.0.1:1", nil), stayOpen},
+		{"denied", newProxy(echo.Address(), func(c *ProxyConfig) { c.AccessControl = denyLoopback }), stayOpen},
+		{"panic", NewConnectionHandler(&panickingBalancer{}, testProxyConfig()), stayOpen},
+	}
+	for _, test := range tests {
+		if closes := handleCounted(t, test.proxy, test.peer); closes != 1 {
+			t.Errorf("%s: client closed %d times, want once", test.name, closes)
+		}
+	}
+
+	SetMaintenance(true)
+	defer SetMaintenance(false)
+	if closes := handleCounted(t, newProxy(echo.Address(), nil), stayOpen); closes != 1 {
+		t.Errorf("maintenance: client closed %d times, want once", closes)
+	}
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+// connectionIDKey carries a connection's ID in the context handed to the
+// connect phase, so retry logs can be traced back to their client.
+type connectionIDKey struct{}
+
+// fallbackIDs numbers connections if the system random source fails.
+var fallbackIDs atomic.Uint64
+
+// newConnectionID returns a random 16 character hex ID that prefixes every
+// log line about one client connection or HTTP request.
+func newConnectionID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%016x", fallbackIDs.Add(1))
+	}
+	return hex.EncodeToString(id)
+}
+
+func withConnectionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connectionIDKey{}, id)
+}
+
+// connectionIDFrom returns the ID stored in ctx, or "-" when there is none.
+func connectionIDFrom(ctx context.Context) string {
+	if id, ok := ctx.Value(connectionIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConnection is a relayed client connection as seen by the registry.
+// The activity timestamps are unix nanos updated from the copy loops without
+// taking the registry lock.
+type trackedConnection struct {
+	id        uint64
+	logID     string // the ID its log lines are prefixed with
+	client    string
+	backend   atomic.Value // string, set once a backend has been picked
+	startedAt time.Time
+
+	lastClientActivity  atomic.Int64
+	lastBackendActivity atomic.Int64
+}
+
+// activity returns the timestamp updated by reads in the given direction.
+func (c *trackedConnection) activity(direction copyDirection) *atomic.Int64 {
+	if direction == clientToBackend {
+		return &c.lastClientActivity
+	}
+	return &c.lastBackendActivity
+}
+
+// ConnectionInfo is a snapshot of a live connection for the admin API.
+type ConnectionInfo struct {
+	ID                  string     `json:"id"` // prefixes the connection's log lines
+	Client              string     `json:"client"`
+	Backend             string     `json:"backend,omitempty"`
+	StartedAt           time.Time  `json:"started_at"`
+	LastClientActivity  *time.Time `json:"last_client_activity,omitempty"`
+	LastBackendActivity *time.Time `json:"last_backend_activity,omitempty"`
+	Idle                string     `json:"idle"`
+}
+
+// connectionRegistry keeps the live connections keyed by ID. Its lock is only
+// taken on accept, close and listing, never per transferred byte.
+type connectionRegistry struct {
+	mu     sync.RWMutex
+	nextID atomic.Uint64
+	conns  map[uint64]*trackedConnection
+}
+
+var registry = &connectionRegistry{conns: make(map[uint64]*trackedConnection)}
+
+func (r *connectionRegistry) register(logID, client string) *trackedConnection {
+	conn := &trackedConnection{
+		id:        r.nextID.Add(1),
+		logID:     logID,
+		client:    client,
+		startedAt: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.conns[conn.id] = conn
+	r.mu.Unlock()
+
+	return conn
+}
+
+func (r *connectionRegistry) unregister(conn *trackedConnection) {
+	r.mu.Lock()
+	delete(r.conns, conn.id)
+	r.mu.Unlock()
+}
+
+// ActiveConnectionCount returns the number of connections currently being handled.
+func ActiveConnectionCount() int {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return len(registry.conns)
+}
+
+// ActiveConnections lists the connections currently being handled, oldest first.
+func ActiveConnections() []ConnectionInfo {
+	registry.mu.RLock()
+	conns := make([]*trackedConnection, 0, len(registry.conns))
+	for _, conn := range registry.conns {
+		conns = append(conns, conn)
+	}
+	registry.mu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	now := time.Now()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, conn := range conns {
+		info := ConnectionInfo{
+			ID:        conn.logID,
+			Client:    conn.client,
+			StartedAt: conn.startedAt,
+		}
+		if backend, ok := conn.backend.Load().(string); ok {
+			info.Backend = backend
+		}
+
+		info.LastClientActivity = activityTime(conn.lastClientActivity.Load())
+		info.LastBackendActivity = activityTime(conn.lastBackendActivity.Load())
+
+		lastActivity := conn.startedAt
+		for _, at := range []*time.Time{info.LastClientActivity, info.LastBackendActivity} {
+			if at != nil && at.After(lastActivity) {
+				lastActivity = *at
+			}
+		}
+		info.Idle = now.Sub(lastActivity).Round(time.Millisecond).String()
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+func activityTime(nanos int64) *time.Time {
+	if nanos == 0 {
+		return nil
+	}
+	at := time.Unix(0, nanos)
+	return &at
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"sync/atomic"
+	"time"
+	"zen/utils/logger"
+)
+
+// A drain takes the process out of rotation without stopping it: readiness
+// fails at once so the orchestrator stops sending traffic, new connections
+// are refused once the grace period has given it time to notice, and
+// existing connections run to completion. It cannot be undone; the process
+// is expected to be stopped once it has drained.
+var (
+	draining atomic.Bool
+	refusing atomic.Bool
+)
+
+// StartDrain begins a drain, refusing new connections after grace. Calling it
+// again while draining has no effect.
+func StartDrain(grace time.Duration) {
+	if draining.Swap(true) {
+		return
+	}
+
+	logger.Warn("Draining: failing readiness, refusing new connections in %s", grace)
+	time.AfterFunc(grace, func() {
+		refusing.Store(true)
+		logger.Warn("Draining: refusing new connections, %d still active", ActiveConnectionCount())
+	})
+}
+
+// Draining reports whether a drain has been started.
+func Draining() bool {
+	return draining.Load()
+}
+
+// RefusingConnections reports whether a drain is past its grace period and
+// new connections must be closed as soon as they are accepted.
+func RefusingConnections() bool {
+	return refusing.Load()
+}
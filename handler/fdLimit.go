@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"zen/utils/logger"
+)
+
+// fdCooldown is how long new connections are shed after a dial failed for
+// lack of file descriptors. Retrying sooner would only burn the few that
+// free up on dials bound to fail again.
+const fdCooldown = time.Second
+
+var ErrOutOfFileDescriptors = errors.New("out of file descriptors, shedding load")
+
+// fdCooldownUntil is shared by every handler since the limit is per process.
+var fdCooldownUntil atomic.Int64
+
+// isFDExhausted reports whether err comes from hitting the per-process or
+// system wide open file limit.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// startFDCooldown sheds new connections for fdCooldown. The warning is only
+// logged by the call that starts a cooldown, not by every failing dial.
+func startFDCooldown(address string, err error) {
+	now := time.Now()
+	previous := fdCooldownUntil.Swap(now.Add(fdCooldown).UnixNano())
+	if previous > now.UnixNano() {
+		return
+	}
+
+	logger.Warn("Out of file descriptors dialing backend %s: %s. Shedding new connections for %s; "+
+		"raise the open file limit (ulimit -n, LimitNOFILE) if this happens under normal load", address, err, fdCooldown)
+}
+
+func inFDCooldown() bool {
+	return time.Now().UnixNano() < fdCooldownUntil.Load()
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"zen/backend"
+	"zen/balancer"
+	"zen/utils/logger"
+	"zen/utils/recovery"
+)
+
+type dialResult struct {
+	conn    net.Conn
+	backend *backend.Backend
+	err     error
+}
+
+// hedgedConnection dials primary and a second backend from the balancer at
+// the same time and returns whichever connects first, trading an extra
+// connection for a lower tail connect latency. The other dial is cancelled;
+// if it connected anyway, the unused connection goes back to its pool. When
+// both fail, primary's error is returned for the caller to handle as a plain
+// failed attempt, while the second backend's failure is recorded here.
+// Without a second candidate it is a plain dial of primary.
+func (ch *ConnectionHandler) hedgedConnection(ctx context.Context, primary *backend.Backend, tried map[string]bool) (net.Conn, *backend.Backend, error) {
+	partner := ch.hedgePartner(primary, tried)
+	if partner == nil {
+		conn, err := ch.getConnectionWithContext(ctx, primary)
+		return conn, primary, err
+	}
+	tried[partner.Address] = true
+
+	id := connectionIDFrom(ctx)
+	logger.Debug("[%s] Hedging connect to %s with %s", id, primary.Address, partner.Address)
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	for _, candidate := range []*backend.Backend{primary, partner} {
+		go ch.hedgeDial(raceCtx, candidate, results)
+	}
+
+	var primaryErr error
+	for pending := 2; pending > 0; pending-- {
+		result := <-results
+		if result.err == nil {
+			if pending == 2 {
+				go releaseHedgeLoser(results)
+			}
+			if result.backend == partner {
+				logger.Debug("[%s] Hedged connect won by %s", id, partner.Address)
+			}
+			return result.conn, result.backend, nil
+		}
+
+		if result.backend == primary {
+			primaryErr = result.err
+			continue
+		}
+
+		retryStats.failure(partner.Address)
+		logger.Debug("[%s] Hedged connect to backend %s failed: %s", id, partner.Address, result.err)
+		if errors.Is(result.err, backend.ErrPoolExhausted) {
+			partner.RecordExhaustion(exhaustionThreshold, exhaustionCooldown)
+		} else if ch.checker != nil && ctx.Err() == nil && !isFDExhausted(result.err) {
+			ch.checker.CheckNow(partner.Address)
+		}
+	}
+
+	return nil, primary, primaryErr
+}
+
+// hedgePartner picks the second backend to dial, one that has not been tried
+// yet and is not cooling down, or returns nil when there is none. It scans
+// the balancer's alive set from the backend after primary, so partners rotate
+// with the primaries, instead of calling Next: every Next counts as a
+// selection, in the stats and in the load of strategies like least_request,
+// whether or not the partner is ever used.
+func (ch *ConnectionHandler) hedgePartner(primary *backend.Backend, tried map[string]bool) *backend.Backend {
+	lister, ok := ch.balancer.(balancer.ListingBalancer)
+	if !ok {
+		return nil
+	}
+
+	aliveBackends := lister.GetAliveBackends()
+	start := 0
+	for i, b := range aliveBackends {
+		if b.Address == primary.Address {
+			start = i + 1
+			break
+		}
+	}
+	for i := range aliveBackends {
+		candidate := aliveBackends[(start+i)%len(aliveBackends)]
+		if candidate.Address != primary.Address && !tried[candidate.Address] && !candidate.InCooldown() {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (ch *ConnectionHandler) hedgeDial(ctx context.Context, candidate *backend.Backend, results chan<- dialResult) {
+	// A panic still has to produce a result, or the race would wait forever
+	defer func() {
+		if value := recover(); value != nil {
+			recovery.Report("hedged dial of "+candidate.Address, value)
+			results <- dialResult{backend: candidate, err: fmt.Errorf("dial panicked: %v", value)}
+		}
+	}()
+
+	conn, err := ch.getConnectionWithContext(ctx, candidate)
+	results <- dialResult{conn: conn, backend: candidate, err: err}
+}
+
+// releaseHedgeLoser waits for the dial that lost the race. A connection it
+// made anyway has never carried a byte, so it is returned to its pool.
+func releaseHedgeLoser(results <-chan dialResult) {
+	if loser := <-results; loser.conn != nil {
+		loser.conn.Close()
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+	"zen/utils/testutil"
+)
+
+func TestHedgePartnerIsNotASelection(t *testing.T) {
+	upstreams := make([]backend.Upstream, 0, 3)
+	for i := 0; i < 3; i++ {
+		echo, err := testutil.NewEchoBackend()
+		if err != nil {
+			t.Fatalf("start backend: %s", err)
+		}
+		t.Cleanup(func() { echo.Close() })
+		upstreams = append(upstreams, backend.Upstream{Address: echo.Address(), Weight: 1})
+	}
+	pool := backend.NewBackendPool(upstreams, &backend.ConnectionPoolSettings{
+		MaxIdle:     4,
+		MaxActive:   16,
+		IdleTimeout: time.Minute,
+	})
+	t.Cleanup(pool.Close)
+
+	rr := balancer.NewRoundRobin(pool)
+	config := testProxyConfig()
+	config.HedgeConnect = true
+	ch := NewConnectionHandler(rr, config)
+
+	backends := pool.GetAliveBackends()
+	if partner := ch.hedgePartner(backends[0], map[string]bool{backends[0].Address: true}); partner != backends[1] {
+		t.Errorf("partner of the first backend is %v, want the second", partner)
+	}
+	tried := map[string]bool{backends[2].Address: true, backends[0].Address: true}
+	if partner := ch.hedgePartner(backends[2], tried); partner != backends[1] {
+		t.Errorf("partner of the last backend with the first tried is %v, want the second", partner)
+	}
+
+	// A hedged connection records only the balancer's own pick
+	address := serveProxy(t, ch)
+	const connections = 4
+	for i := 0; i < connections; i++ {
+		if _, err := testutil.RoundTrip(address, []byte("hello")); err != nil {
+			t.Fatalf("round trip: %s", err)
+		}
+	}
+	var selections uint64
+	for _, count := range rr.Stats() {
+		selections += count
+	}
+	if selections != connections {
+		t.Fatalf("%d selections for %d hedged connections, want one each", selections, connections)
+	}
+}
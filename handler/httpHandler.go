@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"zen/backend"
+	"zen/utils/logger"
+)
+
+// Hop-by-hop headers are meaningful only for a single transport-level
+// connection and must not be forwarded by proxies (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Route sends requests matching Host and PathPrefix to its own handler.
+// An empty Host matches any host.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Handler    *ConnectionHandler
+}
+
+type HTTPHandler struct {
+	defaultHandler *ConnectionHandler
+	routes         []Route
+}
+
+func NewHTTPHandler(defaultHandler *ConnectionHandler, routes []Route) *HTTPHandler {
+	return &HTTPHandler{
+		defaultHandler: defaultHandler,
+		routes:         routes,
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	address := r.RemoteAddr
+
+	// Every route shares the listener's access control
+	if !h.defaultHandler.accessControl.allowsAddress(address) {
+		deniedConnections.Add(1)
+		logger.Debug("Denied request from %s by access control", address)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id := newConnectionID()
+
+	// Requests in flight count as connections, so a drain or a shutdown
+	// waits for them like for relayed TCP connections.
+	tracked := registry.register(id, address)
+	defer registry.unregister(tracked)
+
+	if InMaintenance() {
+		h.defaultHandler.writeHTTPError(w, "Service under maintenance")
+		return
+	}
+
+	ch := h.selectHandler(r)
+
+	ctx, cancel := context.WithTimeout(withConnectionID(r.Context(), id), ch.requestTimeout)
+	defer cancel()
+
+	backendConnection, selectedBackend, err := ch.getBackendConnectionWithRetry(ctx, stickyKey(w, r, ch))
+	if err != nil {
+		logger.Error("[%s] Failed to establish connection to any backend for %s: %s", id, address, err)
+		ch.writeHTTPError(w, "Service temporarily unavailable")
+		return
+	}
+
+	logger.Debug("[%s] Proxying %s %s%s for %s to backend %s", id, r.Method, r.Host, r.URL.Path, address, selectedBackend.Address)
+	selectedBackend.IncrementActive()
+	defer selectedBackend.DecrementActive()
+	tracked.backend.Store(selectedBackend.Address)
+
+	// A request still running once the shutdown timeout is up is ended
+	// like a relay, by expiring the backend connection's deadlines.
+	stopOnShutdown := context.AfterFunc(relayCtx, func() {
+		backendConnection.SetDeadline(time.Now())
+	})
+
+	// requestTimeout covers sending the request and reading the response
+	// headers; proxyRequest lifts it before streaming the body.
+	if deadline, ok := ctx.Deadline(); ok {
+		backendConnection.SetDeadline(deadline)
+	}
+
+	var requestID string
+	if ch.addRequestID {
+		requestID = id
+	}
+
+	reusable, err := proxyRequest(w, r, backendConnection, requestID, ch.proxyIdleTimeout)
+	if err != nil {
+		logger.Debug("[%s] Error proxying request for %s to backend %s: %s", id, address, selectedBackend.Address, err)
+	}
+
+	// Once stopped, the shutdown can no longer expire the deadlines of a
+	// connection that went back to the pool.
+	if !stopOnShutdown() || !reusable {
+		discard(backendConnection)
+		return
+	}
+
+	backendConnection.SetDeadline(time.Time{})
+	backendConnection.Close()
+}
+
+// selectHandler returns the handler of the first route matching the request,
+// falling back to the default upstream group.
+func (h *HTTPHandler) selectHandler(r *http.Request) *ConnectionHandler {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	for _, route := range h.routes {
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		return route.Handler
+	}
+
+	return h.defaultHandler
+}
+
+// stickyKey returns the session cookie value used to pin the client to a
+// backend. Clients without one are assigned a new session, and the cookie is
+// set on the response so their next request lands on the same backend.
+func stickyKey(w http.ResponseWriter, r *http.Request, ch *ConnectionHandler) string {
+	if !ch.isSticky() || ch.stickyCookie == "" {
+		return ""
+	}
+
+	if cookie, err := r.Cookie(ch.stickyCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	session := make([]byte, 16)
+	if _, err := rand.Read(session); err != nil {
+		logger.Debug("Failed to generate session id: %s", err)
+		return ""
+	}
+
+	value := hex.EncodeToString(session)
+	http.SetCookie(w, &http.Cookie{Name: ch.stickyCookie, Value: value, Path: "/", HttpOnly: true})
+	return value
+}
+
+// proxyRequest forwards r over backendConnection and streams the response
+// back to w. It reports whether the backend connection is clean enough to be
+// handed to the next client. A non-empty requestID is sent as X-Request-Id
+// unless the request already carries one.
+//
+// Whatever deadline the caller set applies up to the response headers. The
+// body may then take as long as it needs, as long as the backend never goes
+// quiet for idleTimeout, so large and streamed responses are not cut off.
+func proxyRequest(w http.ResponseWriter, r *http.Request, backendConnection net.Conn, requestID string, idleTimeout time.Duration) (bool, error) {
+	outRequest := r.Clone(r.Context())
+	outRequest.Close = false
+	removeHopHeaders(outRequest.Header)
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outRequest.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		outRequest.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	if requestID != "" && outRequest.Header.Get("X-Request-Id") == "" {
+		outRequest.Header.Set("X-Request-Id", requestID)
+	}
+
+	if err := outRequest.Write(backendConnection); err != nil {
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return false, err
+	}
+
+	reader := bufio.NewReader(backendConnection)
+	response, err := http.ReadResponse(reader, outRequest)
+	if err != nil {
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return false, err
+	}
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+
+	backendConnection.SetDeadline(time.Time{})
+	body := &idleDeadlineReader{reader: response.Body, conn: backendConnection, timeout: idleTimeout}
+	if _, err := io.Copy(w, body); err != nil {
+		return false, err
+	}
+
+	return !response.Close && reader.Buffered() == 0, nil
+}
+
+// idleDeadlineReader reads a response body from conn, pushing conn's read
+// deadline out by timeout before every read. It stops on StopRelays like a
+// relay does.
+type idleDeadlineReader struct {
+	reader  io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleDeadlineReader) Read(b []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	// Checked after the deadline is pushed out, so a stop that came in
+	// between cannot be overwritten by it.
+	if relayCtx.Err() != nil {
+		return 0, errRelayStopped
+	}
+	return r.reader.Read(b)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// discard drops a backend connection that must not go back to the pool.
+func discard(conn net.Conn) {
+	if pooled, ok := conn.(*backend.PooledConnection); ok {
+		pooled.Discard()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+)
+
+// startHTTPProxy serves an HTTPHandler in front of a pool of address and
+// returns its URL and the backend.
+func startHTTPProxy(t *testing.T, config *ProxyConfig, address string) (string, *backend.Backend) {
+	t.Helper()
+
+	pool := backend.NewBackendPool([]backend.Upstream{{Address: address, Weight: 1}}, &backend.ConnectionPoolSettings{
+		MaxIdle:     4,
+		MaxActive:   16,
+		IdleTimeout: time.Minute,
+	})
+	t.Cleanup(pool.Close)
+
+	server := httptest.NewServer(NewHTTPHandler(NewConnectionHandler(balancer.NewRoundRobin(pool), config), nil))
+	t.Cleanup(server.Close)
+	return server.URL, pool.GetAllBackends()[0]
+}
+
+// httpBackend answers every request on a connection with respond, which
+// writes the whole response.
+func httpBackend(t *testing.T, respond func(conn net.Conn, request *http.Request)) string {
+	t.Helper()
+
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		reader := bufio.NewReader(conn)
+		for {
+			request, err := http.ReadRequest(reader)
+			if err != nil {
+				return 0, nil
+			}
+			io.Copy(io.Discard, request.Body)
+			respond(conn, request)
+		}
+	})
+	return b.Address()
+}
+
+func TestHTTPRequestInFlightIsTracked(t *testing.T) {
+	release := make(chan struct{})
+	address := httpBackend(t, func(conn net.Conn, request *http.Request) {
+		<-release
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	url, _ := startHTTPProxy(t, testProxyConfig(), address)
+
+	done := make(chan error, 1)
+	go func() {
+		response, err := http.Get(url + "/slow")
+		if err == nil {
+			response.Body.Close()
+		}
+		done <- err
+	}()
+
+	waitFor(t, "the request to be registered", func() bool {
+		for _, conn := range ActiveConnections() {
+			if conn.Backend == address {
+				return true
+			}
+		}
+		return false
+	})
+	if WaitForConnections(100 * time.Millisecond) {
+		t.Fatal("WaitForConnections returned while a request was in flight")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("request: %s", err)
+	}
+	if !WaitForConnections(time.Second) {
+		t.Fatalf("%d connections still registered after the request finished", ActiveConnectionCount())
+	}
+}
+
+func TestHTTPSlowBodyOutlivesRequestTimeout(t *testing.T) {
+	chunk := "a slowly streamed line\n"
+	const chunks = 6
+
+	// Headers come at once; the body takes twice the request timeout
+	address := httpBackend(t, func(conn net.Conn, request *http.Request) {
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(chunk)*chunks)
+		for i := 0; i < chunks; i++ {
+			time.Sleep(100 * time.Millisecond)
+			io.WriteString(conn, chunk)
+		}
+	})
+	config := testProxyConfig()
+	config.RequestTimeout = 300 * time.Millisecond
+	url, _ := startHTTPProxy(t, config, address)
+
+	response, err := http.Get(url + "/download")
+	if err != nil {
+		t.Fatalf("request: %s", err)
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("read body after %d bytes: %s", len(body), err)
+	}
+	if want := strings.Repeat(chunk, chunks); string(body) != want {
+		t.Fatalf("got %d bytes, want the full %d byte body", len(body), len(want))
+	}
+}
+
+func TestHTTPRequestTimeoutBoundsResponseHeaders(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	address := httpBackend(t, func(conn net.Conn, request *http.Request) {
+		<-release
+	})
+	config := testProxyConfig()
+	config.RequestTimeout = 200 * time.Millisecond
+	url, _ := startHTTPProxy(t, config, address)
+
+	start := time.Now()
+	response, err := http.Get(url + "/stuck")
+	if err != nil {
+		t.Fatalf("request: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("status %d, want %d", response.StatusCode, http.StatusBadGateway)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("a backend that never answered held the request for %s", elapsed)
+	}
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayTimer ends both sides of a relay when it fires. It does not close
+// the connections, which HandleConnection does exactly once whatever ended
+// the relay; it puts their deadlines in the past instead, so blocked reads
+// and writes return and the relay winds down like on StopRelays.
+type relayTimer struct {
+	timer   *time.Timer
+	mu      sync.Mutex
+	stopped bool
+	fired   atomic.Bool
+}
+
+func (t *relayTimer) start(after time.Duration, conns ...net.Conn) {
+	t.timer = time.AfterFunc(after, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.stopped {
+			return
+		}
+		t.fired.Store(true)
+		now := time.Now()
+		for _, conn := range conns {
+			conn.SetDeadline(now)
+		}
+	})
+}
+
+// stop disarms the timer. Once it returns the timer either has fired, as
+// expired reports, or never touches the connections again, so a backend
+// connection can be pooled without a stale deadline landing on it.
+func (t *relayTimer) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+	t.timer.Stop()
+}
+
+func (t *relayTimer) expired() bool {
+	return t.fired.Load()
+}
+
+// idleTimer tears down both sides of a relay once no bytes have moved in
+// either direction for the configured timeout. Both copy goroutines share a
+// single timer and reset it on every read.
+type idleTimer struct {
+	relayTimer
+	timeout time.Duration
+
+	// halfClose, once started, bounds the direction still relaying after
+	// the other one reached EOF. It is touched along with the idle timer.
+	halfClose atomic.Pointer[halfCloseTimer]
+}
+
+// halfCloseTimer ends the lingering side of a half-closed relay once it has
+// gone quiet for its timeout. Reads keep pushing it out, so a response that
+// is still streaming is not cut off.
+type halfCloseTimer struct {
+	relayTimer
+	timeout time.Duration
+}
+
+func newIdleTimer(timeout time.Duration, clientConn, backendConn net.Conn) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.start(timeout, clientConn, backendConn)
+	return t
+}
+
+func (t *idleTimer) touch() {
+	t.timer.Reset(t.timeout)
+	if halfClose := t.halfClose.Load(); halfClose != nil {
+		halfClose.timer.Reset(halfClose.timeout)
+	}
+}
+
+// startHalfClose gives conn, the side still being read after the other one
+// reached EOF, timeout without any data before the relay is ended.
+func (t *idleTimer) startHalfClose(timeout time.Duration, conn net.Conn) {
+	halfClose := &halfCloseTimer{timeout: timeout}
+	halfClose.start(timeout, conn)
+	t.halfClose.Store(halfClose)
+}
+
+func (t *idleTimer) stop() {
+	t.relayTimer.stop()
+	if halfClose := t.halfClose.Load(); halfClose != nil {
+		halfClose.stop()
+	}
+}
+
+// halfCloseExpired reports whether the half-close timer ended the relay.
+func (t *idleTimer) halfCloseExpired() bool {
+	halfClose := t.halfClose.Load()
+	return halfClose != nil && halfClose.expired()
+}
+
+// lifetimeTimer tears down both sides of a relay once it has lasted longer
+// than the maximum connection duration, regardless of activity. A nil
+// lifetimeTimer, used when no maximum is configured, never fires.
+type lifetimeTimer struct {
+	relayTimer
+}
+
+func newLifetimeTimer(duration time.Duration, clientConn, backendConn net.Conn) *lifetimeTimer {
+	if duration <= 0 {
+		return nil
+	}
+
+	t := &lifetimeTimer{}
+	t.start(duration, clientConn, backendConn)
+	return t
+}
+
+func (t *lifetimeTimer) stop() {
+	if t != nil {
+		t.relayTimer.stop()
+	}
+}
+
+func (t *lifetimeTimer) expired() bool {
+	return t != nil && t.relayTimer.expired()
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net"
+	"zen/utils/logger"
+)
+
+// setLinger sets SO_LINGER on conn, deciding what its Close does. Zero
+// resets the connection, discarding unsent data; a positive value makes
+// Close block for up to that many seconds while unsent data is delivered; a
+// negative value restores the OS default of sending it in the background.
+// Wrapped connections are unwrapped down to the TCP socket, and anything
+// that is not TCP is left alone.
+func setLinger(conn net.Conn, seconds int) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			if err := c.SetLinger(seconds); err != nil {
+				logger.Debug("Failed to set linger on connection to %s: %s", c.RemoteAddr(), err)
+			}
+			return
+		case *proxyProtocolConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }: // pooled and TLS connections
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"sync/atomic"
+	"zen/utils/logger"
+)
+
+// maintenance is shared by every handler: while it is on, new client
+// connections are rejected before a backend is selected. Health checks keep
+// running so the proxy can come back into rotation immediately.
+var maintenance atomic.Bool
+
+func SetMaintenance(enabled bool) {
+	if maintenance.Swap(enabled) == enabled {
+		return
+	}
+
+	if enabled {
+		logger.Warn("Maintenance mode ON: rejecting new connections")
+	} else {
+		logger.Info("Maintenance mode OFF: accepting new connections")
+	}
+}
+
+func InMaintenance() bool {
+	return maintenance.Load()
+}
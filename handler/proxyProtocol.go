@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"zen/utils/logger"
+)
+
+// ErrInvalidProxyHeader is returned when a connection on a PROXY protocol
+// listener does not start with a well-formed header.
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyV2Signature starts every binary (v2) PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest a text (v1) header can be, CRLF included.
+const proxyV1MaxLength = 107
+
+// NewProxyProtocolListener wraps ln so that every accepted connection must
+// start with a PROXY protocol v1 or v2 header. The client address in the
+// header replaces the peer address as the connection's RemoteAddr, so the
+// sticky and affinity keys, the access log and the connection registry all
+// see the real client. The header is read lazily by the connection's own
+// goroutine, never by Accept, and must arrive within timeout.
+func NewProxyProtocolListener(ln net.Listener, timeout time.Duration) net.Listener {
+	return proxyProtocolListener{Listener: ln, timeout: timeout}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, timeout: l.timeout}, nil
+}
+
+// proxyProtocolConn is a client connection whose header has not necessarily
+// been read yet. The first Read or RemoteAddr consumes it.
+type proxyProtocolConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	client net.Addr // nil for LOCAL and UNKNOWN headers, which keep the peer address
+	err    error
+}
+
+// handshake reads the header once and returns the error it failed with, if any.
+func (c *proxyProtocolConn) handshake() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.client, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			logger.Warn("Rejecting connection from %s: %s", c.Conn.RemoteAddr(), c.err)
+		} else if c.client != nil {
+			logger.Debug("PROXY header from %s declares client %s", c.Conn.RemoteAddr(), c.client)
+		}
+	})
+	return c.err
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client declared in the header, or the peer address
+// when the header declares none or is invalid.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.handshake() == nil && c.client != nil {
+		return c.client
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the underlying TCP connection.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if tcpConnection, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConnection.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader consumes a v1 or v2 header from r and returns the client
+// address it declares, nil when it declares none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Peeking a single byte tells the versions apart without waiting for
+	// more than a short v1 header may send.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+
+	if first[0] == proxyV2Signature[0] {
+		return readProxyV2Header(r)
+	}
+	return readProxyV1Header(r)
+}
+
+// readProxyV1Header parses "PROXY TCP4|TCP6 src dst sport dport\r\n" or
+// "PROXY UNKNOWN ...\r\n".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header longer than %d bytes", ErrInvalidProxyHeader, proxyV1MaxLength)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: missing PROXY signature", ErrInvalidProxyHeader)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported protocol %q", ErrInvalidProxyHeader, fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: expected 6 fields, got %d", ErrInvalidProxyHeader, len(fields))
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: bad source address %q", ErrInvalidProxyHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port %q", ErrInvalidProxyHeader, fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header parses the binary header. Only TCP over IPv4 and IPv6
+// carries a usable client address; LOCAL commands, such as the upstream
+// load balancer's own health checks, and other families keep the peer address.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: missing v2 signature", ErrInvalidProxyHeader)
+	}
+
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+
+	switch versionCommand & 0xf {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidProxyHeader, versionCommand&0xf)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 address block", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 address block", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
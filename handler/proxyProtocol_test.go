@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"zen/backend"
+	"zen/balancer"
+)
+
+// proxyV2Header builds a binary header with command, family and the
+// address block.
+func proxyV2Header(command, family byte, addresses []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return string(append(header, addresses...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4Block := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x9c, 0x40, 0x01, 0xbb}
+	ipv6Block := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x9c, 0x40, 0x01, 0xbb)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string // the declared client, "" for none
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 40000 443\r\n", "192.0.2.1:40000"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n", "[2001:db8::1]:40000"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", ""},
+		{"v2 IPv4", proxyV2Header(0x1, 0x11, ipv4Block), "192.0.2.1:40000"},
+		{"v2 IPv6", proxyV2Header(0x1, 0x21, ipv6Block), "[2001:db8::1]:40000"},
+		{"v2 LOCAL", proxyV2Header(0x0, 0x00, nil), ""},
+	}
+	for _, test := range tests {
+		client, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.header + "payload")))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		got := ""
+		if client != nil {
+			got = client.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: client %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadProxyHeaderRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"no header", "GET / HTTP/1.1\r\nHost: zen.test\r\n\r\n"},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"},
+		{"IPv6 declared as TCP4", "PROXY TCP4 2001:db8::1 2001:db8::2 40000 443\r\n"},
+		{"bad address", "PROXY TCP4 192.0.2.300 192.0.2.2 40000 443\r\n"},
+		{"bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 70000 443\r\n"},
+		{"missing fields", "PROXY TCP4 192.0.2.1 40000\r\n"},
+		{"unsupported protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 40000 443\r\n"},
+		{"truncated", "PROXY TCP4 192.0.2.1"},
+		{"v2 wrong version", strings.Replace(proxyV2Header(0x1, 0x11, make([]byte, 12)), "\x21\x11", "\x31\x11", 1)},
+		{"v2 short block", proxyV2Header(0x1, 0x11, make([]byte, 4))},
+		{"v2 truncated", proxyV2Header(0x1, 0x11, make([]byte, 12))[:20]},
+	}
+	for _, test := range tests {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(test.header)))
+		if !errors.Is(err, ErrInvalidProxyHeader) {
+			t.Errorf("%s: got %v, want ErrInvalidProxyHeader", test.name, err)
+		}
+	}
+}
+
+// startProxyProtocolProxy serves HandleConnection behind a PROXY protocol
+// listener in front of a pool of address.
+func startProxyProtocolProxy(t *testing.T, config *ProxyConfig, address string) string {
+	t.Helper()
+
+	pool := backend.NewBackendPool([]backend.Upstream{{Address: address, Weight: 1}}, &backend.ConnectionPoolSettings{
+		MaxIdle:     4,
+		MaxActive:   16,
+		IdleTimeout: time.Minute,
+	})
+	t.Cleanup(pool.Close)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	serveListener(t, NewConnectionHandler(balancer.NewRoundRobin(pool), config), NewProxyProtocolListener(ln, time.Second))
+	return ln.Addr().String()
+}
+
+// dialWithHeader connects to address and sends header followed by payload.
+func dialWithHeader(t *testing.T, address, header, payload string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, header+payload); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	return conn
+}
+
+func TestForgedProxyHeaderKeysOnDeclaredClient(t *testing.T) {
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		return io.Copy(conn, conn)
+	})
+
+	// The peer is always 127.0.0.1; only the declared client is denied
+	ac, err := NewAccessControl(nil, []string{"198.51.100.0/24"})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %s", err)
+	}
+	config := testProxyConfig()
+	config.AccessControl = ac
+	address := startProxyProtocolProxy(t, config, b.Address())
+
+	denied := DeniedConnectionCount()
+	conn := dialWithHeader(t, address, "PROXY TCP4 198.51.100.7 192.0.2.10 40000 443\r\n", "hello")
+	if response, err := io.ReadAll(conn); len(response) != 0 || isTimeout(err) {
+		t.Fatalf("denied client got %q, %v; want the connection closed", response, err)
+	}
+	if got := DeniedConnectionCount() - denied; got != 1 {
+		t.Errorf("denied count rose by %d, want 1", got)
+	}
+	if accepted := b.Accepted(); accepted != 0 {
+		t.Errorf("backend accepted %d connections for a denied client", accepted)
+	}
+
+	conn = dialWithHeader(t, address, "PROXY TCP4 203.0.113.9 192.0.2.10 40000 443\r\n", "hello")
+	response := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatalf("allowed client: %s", err)
+	}
+
+	// The header is stripped before the relay and the registry, like the
+	// access log, sees the declared client
+	if string(response) != "hello" {
+		t.Errorf("backend echoed %q, want only the payload", response)
+	}
+	found := false
+	for _, info := range ActiveConnections() {
+		found = found || info.Client == "203.0.113.9:40000"
+	}
+	if !found {
+		t.Errorf("no registered connection for the declared client in %+v", ActiveConnections())
+	}
+}
+
+func TestInvalidProxyHeaderIsRejected(t *testing.T) {
+	b := startBackend(t, func(conn net.Conn) (int64, error) {
+		return io.Copy(conn, conn)
+	})
+	address := startProxyProtocolProxy(t, testProxyConfig(), b.Address())
+
+	conn := dialWithHeader(t, address, "", "GET / HTTP/1.1\r\nHost: zen.test\r\n\r\n")
+	if response, err := io.ReadAll(conn); len(response) != 0 || isTimeout(err) {
+		t.Fatalf("client without a header got %q, %v; want the connection closed", response, err)
+	}
+	if accepted := b.Accepted(); accepted != 0 {
+		t.Errorf("backend accepted %d connections for an invalid header", accepted)
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket capping one relay direction at a fixed number
+// of bytes per second. The bucket holds at most one second worth of tokens,
+// so a single wait never exceeds about a second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when bytesPerSec is zero, meaning unlimited.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// chunkSize caps how much a relay reads at once so it never buffers more
+// than the limiter lets through in a second.
+func (l *rateLimiter) chunkSize(bufferSize int) int {
+	if l == nil {
+		return bufferSize
+	}
+	return max(min(bufferSize, int(l.rate)), 1)
+}
+
+// wait blocks until n bytes may be sent.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+	"zen/backend"
+)
+
+// RetryMetrics counts what the connect phase went through, across all
+// listeners. A rising retry or failure rate shows backend trouble before
+// health checks take a backend out of rotation.
+type RetryMetrics struct {
+	Retries   uint64            // attempts after the first one of a client
+	Exhausted uint64            // clients that got no backend connection at all
+	Failures  map[string]uint64 // failed connect attempts by backend address
+	Successes map[int]uint64    // clients connected, by the number of retries it took
+}
+
+type retryCounters struct {
+	retries   atomic.Uint64
+	exhausted atomic.Uint64
+
+	mu        sync.Mutex
+	failures  map[string]uint64
+	successes map[int]uint64
+}
+
+var retryStats = &retryCounters{
+	failures:  make(map[string]uint64),
+	successes: make(map[int]uint64),
+}
+
+func (c *retryCounters) failure(address string) {
+	c.mu.Lock()
+	c.failures[address]++
+	c.mu.Unlock()
+}
+
+// AddBackend is part of backend.MembershipObserver; a new backend has no
+// failures to count yet.
+func (c *retryCounters) AddBackend(*backend.Backend) {}
+
+// RemoveBackend forgets the failures of a backend that left its pool, so
+// addresses replaced by DNS or upstream file changes do not pile up.
+func (c *retryCounters) RemoveBackend(address string) {
+	c.mu.Lock()
+	delete(c.failures, address)
+	c.mu.Unlock()
+}
+
+// PruneRetryMetrics has the failure counts of pool's backends dropped once
+// they are removed from it. An address still served by another pool starts
+// counting again from zero.
+func PruneRetryMetrics(pool *backend.Pool) {
+	pool.Observe(retryStats)
+}
+
+func (c *retryCounters) success(retries int) {
+	c.mu.Lock()
+	c.successes[retries]++
+	c.mu.Unlock()
+}
+
+// GetRetryMetrics returns a snapshot of the connect phase counters.
+func GetRetryMetrics() RetryMetrics {
+	retryStats.mu.Lock()
+	defer retryStats.mu.Unlock()
+
+	metrics := RetryMetrics{
+		Retries:   retryStats.retries.Load(),
+		Exhausted: retryStats.exhausted.Load(),
+		Failures:  make(map[string]uint64, len(retryStats.failures)),
+		Successes: make(map[int]uint64, len(retryStats.successes)),
+	}
+	for address, n := range retryStats.failures {
+		metrics.Failures[address] = n
+	}
+	for retries, n := range retryStats.successes {
+		metrics.Successes[retries] = n
+	}
+	return metrics
+}
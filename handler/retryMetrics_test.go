@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"testing"
+	"time"
+	"zen/backend"
+)
+
+func TestRemovedBackendFailuresArePruned(t *testing.T) {
+	upstreams := []backend.Upstream{
+		{Address: "127.0.0.1:10001", Weight: 1},
+		{Address: "127.0.0.1:10002", Weight: 1},
+	}
+	pool := backend.NewBackendPool(upstreams, &backend.ConnectionPoolSettings{
+		MaxIdle:        1,
+		MaxActive:      1,
+		IdleTimeout:    time.Minute,
+		RemovalTimeout: time.Second,
+	})
+	t.Cleanup(pool.Close)
+	PruneRetryMetrics(pool)
+
+	for _, upstream := range upstreams {
+		retryStats.failure(upstream.Address)
+	}
+	if err := pool.RemoveBackend(upstreams[0].Address); err != nil {
+		t.Fatalf("RemoveBackend: %s", err)
+	}
+
+	waitFor(t, "the removed backend's failures to be dropped", func() bool {
+		_, counted := GetRetryMetrics().Failures[upstreams[0].Address]
+		return !counted
+	})
+	if GetRetryMetrics().Failures[upstreams[1].Address] == 0 {
+		t.Fatal("the failures of the remaining backend were dropped too")
+	}
+}
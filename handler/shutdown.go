@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errRelayStopped ends a relay that was stopped by StopRelays.
+var errRelayStopped = errors.New("relay stopped for shutdown")
+
+// relayCtx is handed to every relay. Cancelling it puts the deadlines of
+// both sides in the past, so reads and writes blocked on a quiet peer
+// return and the connection is torn down right away.
+var relayCtx, stopRelays = context.WithCancel(context.Background())
+
+// StopRelays ends every relayed connection, for connections still open once
+// the shutdown timeout is up. Relays started afterwards end as soon as they
+// start.
+func StopRelays() {
+	stopRelays()
+}
+
+// WaitForConnections blocks until no client connection is being handled or
+// timeout passes, and reports whether all of them finished.
+func WaitForConnections(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for ActiveConnectionCount() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+	"zen/backend"
+)
+
+// spliceable returns the raw TCP connections behind dst and src when the
+// relay between them can run in the kernel. Connections whose bytes pass
+// through userspace first, such as a PROXY protocol connection with its
+// header reader, are not.
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if !spliceSupported {
+		return nil, nil, false
+	}
+
+	dstTCP, dstOK := rawTCPConn(dst)
+	srcTCP, srcOK := rawTCPConn(src)
+	return dstTCP, srcTCP, dstOK && srcOK
+}
+
+func rawTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	if pooled, ok := conn.(*backend.PooledConnection); ok {
+		conn = pooled.NetConn()
+	}
+	tcpConnection, ok := conn.(*net.TCPConn)
+	return tcpConnection, ok
+}
+
+// spliceData is copyData for two raw TCP connections. It waits until src is
+// readable and then has the runtime move exactly the bytes already queued
+// with splice(2), so the data never enters userspace. Moving only what is
+// queued keeps the per-read bookkeeping of copyData: the idle timer, the
+// activity timestamp, the write deadline and the rate limiter still see
+// every burst, and src's read deadline still applies while waiting.
+func (ch *ConnectionHandler) spliceData(ctx context.Context, dst, src *net.TCPConn, idle *idleTimer, limiter *rateLimiter, lastActivity *atomic.Int64) (int64, error) {
+	rawConn, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var buffer []byte
+
+	for {
+		queued, err := waitReadable(rawConn)
+		if err != nil {
+			return written, err
+		}
+
+		if queued == 0 {
+			// EOF, a pending error, or bytes that arrived right after the
+			// queue was checked: a plain read tells them apart.
+			if buffer == nil {
+				buffer = make([]byte, limiter.chunkSize(ch.bufferSize))
+			}
+			n, err := src.Read(buffer)
+			if err != nil {
+				return written, err
+			}
+			if err := ch.noteRead(ctx, dst, idle, lastActivity); err != nil {
+				return written, err
+			}
+			limiter.wait(n)
+			w, err := dst.Write(buffer[:n])
+			written += int64(w)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		if err := ch.noteRead(ctx, dst, idle, lastActivity); err != nil {
+			return written, err
+		}
+		queued = limiter.chunkSize(queued)
+		limiter.wait(queued)
+
+		n, err := io.CopyN(dst, src, int64(queued))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// noteRead does copyData's bookkeeping for bytes read from src before they
+// are written to dst. Like bufferedCopy it checks ctx after pushing out the
+// write deadline, so a stop that came in between cannot be overwritten by
+// it, and returns errRelayStopped then.
+func (ch *ConnectionHandler) noteRead(ctx context.Context, dst net.Conn, idle *idleTimer, lastActivity *atomic.Int64) error {
+	idle.touch()
+	lastActivity.Store(time.Now().UnixNano())
+	dst.SetWriteDeadline(time.Now().Add(ch.writeTimeout))
+	if ctx.Err() != nil {
+		return errRelayStopped
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package handler
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// spliceSupported reports whether the runtime turns a copy between two TCP
+// connections into splice(2) calls.
+const spliceSupported = true
+
+// waitReadable blocks until the connection behind rawConn has bytes queued,
+// has reached EOF or has an error pending, honoring its read deadline. It
+// returns how many bytes are queued, zero for the other cases, and the
+// pending error if there is one.
+func waitReadable(rawConn syscall.RawConn) (int, error) {
+	var queued int32
+	var pendingErr error
+
+	err := rawConn.Read(func(fd uintptr) bool {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCINQ, uintptr(unsafe.Pointer(&queued)))
+		if errno != 0 {
+			pendingErr = errno
+			return true
+		}
+		if queued > 0 {
+			return true
+		}
+
+		// An empty queue is either EOF, a pending error or nothing yet. Only
+		// the last one is worth waiting for. Peeking consumes a pending
+		// error such as a reset, so it is returned from here: the read that
+		// follows would only see EOF.
+		var peek [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), peek[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN {
+			return false
+		}
+		if err != nil {
+			pendingErr = err
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(queued), pendingErr
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package handler
+
+import (
+	"errors"
+	"syscall"
+)
+
+// spliceSupported is false outside Linux, where the runtime has no
+// zero-copy path between two TCP connections.
+const spliceSupported = false
+
+func waitReadable(syscall.RawConn) (int, error) {
+	return 0, errors.New("splice is only supported on Linux")
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// spliceRelay is one relay direction over raw TCP: bytes written to writer
+// arrive on src, and bytes copied to dst arrive on reader.
+type spliceRelay struct {
+	writer, src, dst, reader *net.TCPConn
+}
+
+func newSpliceRelay(t *testing.T) *spliceRelay {
+	t.Helper()
+
+	if !spliceSupported {
+		t.Skip("splice is not supported on this platform")
+	}
+	r := &spliceRelay{}
+	r.writer, r.src = loopbackPair(t)
+	r.dst, r.reader = loopbackPair(t)
+	for _, conn := range []*net.TCPConn{r.writer, r.src, r.dst, r.reader} {
+		conn := conn
+		t.Cleanup(func() { conn.Close() })
+	}
+	if _, _, ok := spliceable(r.dst, r.src); !ok {
+		t.Fatal("two raw TCP connections are not spliceable")
+	}
+	return r
+}
+
+// copy runs copyData from src to dst and also returns the last activity
+// it recorded.
+func (r *spliceRelay) copy() (int64, int64, error) {
+	ch := NewConnectionHandler(nil, &ProxyConfig{WriteTimeout: time.Second})
+	idle := newIdleTimer(time.Minute, r.src, r.dst)
+	defer idle.stop()
+	var lastActivity atomic.Int64
+
+	written, err := ch.copyData(context.Background(), r.dst, r.src, idle, nil, &lastActivity)
+	return written, lastActivity.Load(), err
+}
+
+func TestSpliceTransfer(t *testing.T) {
+	r := newSpliceRelay(t)
+
+	payload := make([]byte, 4<<20)
+	rand.Read(payload)
+	go func() {
+		r.writer.Write(payload)
+		r.writer.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(r.reader)
+		received <- data
+	}()
+
+	written, lastActivity, err := r.copy()
+	if err != io.EOF {
+		t.Fatalf("error %v, want io.EOF", err)
+	}
+	if written != int64(len(payload)) || lastActivity == 0 {
+		t.Fatalf("wrote %d bytes with activity at %d, want %d bytes", written, lastActivity, len(payload))
+	}
+	r.dst.CloseWrite()
+	if data := <-received; !bytes.Equal(data, payload) {
+		t.Fatalf("reader got %d bytes that differ from the %d sent", len(data), len(payload))
+	}
+}
+
+func TestSpliceImmediateEOF(t *testing.T) {
+	r := newSpliceRelay(t)
+	r.writer.Close()
+
+	written, lastActivity, err := r.copy()
+	if err != io.EOF || written != 0 || lastActivity != 0 {
+		t.Fatalf("got %d bytes, %v, activity %d; want 0 bytes, io.EOF and no activity", written, err, lastActivity)
+	}
+}
+
+func TestSpliceWriteErrorMidTransfer(t *testing.T) {
+	r := newSpliceRelay(t)
+
+	// The destination's peer resets after the first bytes
+	go func() {
+		r.writer.Write([]byte("first"))
+		var buffer [5]byte
+		io.ReadFull(r.reader, buffer[:])
+		r.reader.SetLinger(0)
+		r.reader.Close()
+
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := r.writer.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	written, _, err := r.copy()
+	if err == nil || err == io.EOF || isTimeout(err) {
+		t.Fatalf("got %v after %d bytes, want the write error", err, written)
+	}
+	if written < int64(len("first")) {
+		t.Fatalf("wrote %d bytes before the reset, want at least %d", written, len("first"))
+	}
+}
+
+func TestSpliceSourceReset(t *testing.T) {
+	r := newSpliceRelay(t)
+
+	go func() {
+		r.writer.Write([]byte("partial"))
+		r.writer.SetLinger(0)
+		r.writer.Close()
+	}()
+	go io.Copy(io.Discard, r.reader)
+
+	// A reset must not look like a clean EOF
+	if _, _, err := r.copy(); err == io.EOF || err == nil {
+		t.Fatalf("got %v, want the reset", err)
+	}
+}
+
+func TestSpliceStopAfterWaitIsNotOverwritten(t *testing.T) {
+	r := newSpliceRelay(t)
+	if _, err := r.writer.Write([]byte("queued")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	// A stop that lands once src is readable, before the write deadline is
+	// pushed out: nothing has cut the deadlines, so only the ctx check can
+	// end the copy
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch := NewConnectionHandler(nil, &ProxyConfig{WriteTimeout: time.Second})
+	idle := newIdleTimer(time.Minute, r.src, r.dst)
+	defer idle.stop()
+	var lastActivity atomic.Int64
+
+	written, err := ch.spliceData(ctx, r.dst, r.src, idle, nil, &lastActivity)
+	if err != errRelayStopped || written != 0 {
+		t.Fatalf("got %d bytes, %v; want 0 bytes and errRelayStopped", written, err)
+	}
+}
@@ -1,22 +1,59 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"zen/admin"
 	"zen/backend"
 	"zen/balancer"
 	"zen/config"
 	"zen/handler"
 	"zen/utils/logger"
+	"zen/utils/version"
 )
 
-var (
-	backendPool   *backend.Pool
+// upstreamGroup bundles a backend pool with the background workers that keep it current.
+type upstreamGroup struct {
+	name          string
+	listener      string // name of the listener the group belongs to
+	pool          *backend.Pool
 	healthChecker *backend.HealthChecker
+	resolver      *backend.Resolver
+	fileWatcher   *backend.UpstreamFileWatcher
+	loadBalancer  balancer.LoadBalancer
+	affinity      *balancer.Affinity
+}
+
+// Exit codes, so supervisors can tell a clean stop from a broken deployment.
+const (
+	exitOK           = 0 // graceful shutdown on a signal, or a passing -check
+	exitConfigError  = 2 // the configuration could not be loaded or is invalid
+	exitStartupError = 3 // the configuration is fine but the server could not start
+)
+
+var (
+	listeners      []net.Listener
+	httpServers    []*http.Server // serving the http mode listeners
+	upstreamGroups []*upstreamGroup
+	adminServer    *admin.Server
+
+	// runningConfig is the configuration in effect, updated by a reload
+	// with the settings it applied.
+	runningConfig *config.Config
+
+	// shutdownTimeout bounds how long cleanUp waits for connections to finish.
+	shutdownTimeout time.Duration
 )
 
 func init() {
@@ -30,9 +67,18 @@ func init() {
 
 func main() {
 	var configPath string
+	var checkOnly bool
+	var printVersion bool
 	flag.StringVar(&configPath, "config", "config.yaml", "Path to the configuration file")
+	flag.BoolVar(&checkOnly, "check", false, "Validate the configuration and exit without starting the server")
+	flag.BoolVar(&printVersion, "version", false, "Print the version and build details and exit")
 	flag.Parse()
 
+	if printVersion {
+		fmt.Println(version.Get())
+		os.Exit(exitOK)
+	}
+
 	if configPath == "" {
 		configPath = "config.yaml"
 	}
@@ -40,93 +86,654 @@ func main() {
 	var cfg config.Config
 	err := config.ParseConfig(&cfg, configPath)
 	if err != nil {
-		logger.Fatal("Failed to parse configuration file: %s", err)
-		os.Exit(1)
+		logger.Exitf(exitConfigError, "Failed to parse configuration file: %s", err)
+	}
+
+	if checkOnly {
+		cfg.LogEffective()
+		if !checkConfig(&cfg) {
+			logger.Error("Configuration check failed")
+			os.Exit(exitConfigError)
+		}
+		logger.Info("Configuration OK")
+		os.Exit(exitOK)
+	}
+
+	// DEBUG=1 wins over the configured level, for a quick look on one host
+	level, _ := logger.ParseLevel(cfg.Logging.Level)
+	if os.Getenv("DEBUG") == "1" {
+		level = logger.LevelDebug
+	}
+	logger.SetLevel(level)
+
+	logger.SetTimeFormat(cfg.Logging.TimeFormat)
+	logger.SetUTC(cfg.Logging.UTC)
+
+	if cfg.Logging.File != "" {
+		err = logger.SetFileOutput(cfg.Logging.File, logger.RotationOptions{
+			MaxSizeMB:  cfg.Logging.MaxSizeMB,
+			MaxBackups: cfg.Logging.MaxBackups,
+			MaxAgeDays: cfg.Logging.MaxAgeDays,
+		})
+		if err != nil {
+			logger.Exitf(exitStartupError, "Failed to open log file %s: %s", cfg.Logging.File, err)
+		}
 	}
 
+	logger.Info("Build: %s", version.Get())
+	cfg.LogEffective()
+	runningConfig = &cfg
+	shutdownTimeout = cfg.Server.ShutdownTimeout
+
 	logger.Info("Starting load balancer server...")
-	ln, err := net.Listen("tcp", ":"+cfg.Server.Port)
-	if err != nil {
-		logger.Fatal("Failed to start server on port %s: %s", cfg.Server.Port, err)
+
+	// From here on a fatal error tears down whatever was started first.
+	logger.RegisterExitHook(func() {
+		logger.Info("Shutting down server, reason: fatal error")
 		cleanUp()
-		os.Exit(1)
+	})
+
+	proxyConfig := &handler.ProxyConfig{
+		MaxRetries:       cfg.Proxy.MaxRetries,
+		RetryBaseDelay:   cfg.Proxy.RetryBaseDelay,
+		RetryMaxDelay:    cfg.Proxy.RetryMaxDelay,
+		ConnectTimeout:   cfg.Proxy.ConnectTimeout,
+		RequestTimeout:   cfg.Proxy.RequestTimeout,
+		HandshakeTimeout: cfg.Proxy.HandshakeTimeout,
+		IdleTimeout:      cfg.Proxy.IdleTimeout,
+		WriteTimeout:     cfg.Proxy.WriteTimeout,
+		HalfCloseTimeout: cfg.Proxy.HalfCloseTimeout,
+
+		MaxConnectionDuration: cfg.Proxy.MaxConnectionDuration,
+		ErrorOnEarlyFailure:   cfg.Proxy.ErrorOnEarlyFailure,
+		BytesPerSecond:        cfg.Limits.PerConnBytesPerSec,
+		BufferSize:            cfg.Proxy.BufferSize,
+		MaxBufferedBytes:      cfg.Proxy.MaxBufferedBytes,
+		Linger:                *cfg.Proxy.Linger,
+		HedgeConnect:          cfg.Proxy.HedgeConnect,
+		AddRequestID:          cfg.Proxy.AddRequestID,
+		AccessLog: &handler.AccessLogConfig{
+			SampleRate:     *cfg.AccessLog.SampleRate,
+			SlowThreshold:  cfg.AccessLog.SlowThreshold,
+			BytesThreshold: cfg.AccessLog.BytesThreshold,
+		},
+	}
+	switch cfg.ErrorResponse.Mode {
+	case config.ErrorResponseHTTP:
+		proxyConfig.ErrorResponse = &handler.ErrorResponse{}
+	case config.ErrorResponseCustom:
+		proxyConfig.ErrorResponse = &handler.ErrorResponse{Status: cfg.ErrorResponse.Status, Body: cfg.ErrorResponse.Body}
+	}
+	accessControl, err := handler.NewAccessControl(cfg.AccessControl.Allow, cfg.AccessControl.Deny)
+	if err != nil {
+		logger.Exitf(exitConfigError, "Invalid access_control: %s", err)
+	}
+	proxyConfig.AccessControl = accessControl
+	if cfg.Proxy.OnNoBackends == config.OnNoBackendsWait {
+		proxyConfig.NoBackendsWait = cfg.Proxy.NoBackendsMaxWait
+	}
+
+	for _, listener := range cfg.Listeners {
+		startListener(&cfg, listener, proxyConfig)
+	}
+
+	handler.SetMaintenance(cfg.Server.Maintenance)
+
+	if cfg.Admin.Enabled {
+		startAdminServer(&cfg)
+	}
+
+	handleSignals(configPath)
+}
+
+// startListener binds a listener, starts its upstream groups and serves it
+// in the background until its socket is closed.
+func startListener(cfg *config.Config, listener *config.Listener, proxyConfig *handler.ProxyConfig) {
+	ln, err := listen(listener.Address, cfg.Server.ReusePort)
+	if err != nil {
+		logger.Exitf(exitStartupError, "Failed to start listener %s on %s: %s", listener.Name, listener.Address, err)
 	}
+	listeners = append(listeners, ln)
+	if cfg.Proxy.SocketReceiveBuffer > 0 || cfg.Proxy.SocketSendBuffer > 0 {
+		ln = socketBufferListener{ln, cfg.Proxy.SocketReceiveBuffer, cfg.Proxy.SocketSendBuffer}
+	}
+	ln = drainingListener{ln}
+	if listener.ProxyProtocol {
+		ln = handler.NewProxyProtocolListener(ln, cfg.Proxy.HandshakeTimeout)
+	}
+
+	listenerProxyConfig := *proxyConfig
+	listenerProxyConfig.StickyCookie = listener.Balancer.StickyCookie
+	proxyConfig = &listenerProxyConfig
 
-	backendPool = getBackendPool(&cfg)
+	dial := newDialOptions(listener)
+	defaultGroup := startUpstreamGroup(cfg, listener.Name, listener.HealthCheck, dial, listener.Upstream, listener.UpstreamFile)
+	defaultGroup.listener = listener.Name
+	proxy := newConnectionHandler(listener.Balancer, defaultGroup, proxyConfig)
 
-	if cfg.HealthCheck.Enabled {
-		healthCheckConfig := &backend.HealthCheckConfig{
-			Interval:           cfg.HealthCheck.Interval,
-			Timeout:            cfg.HealthCheck.Timeout,
-			HealthyThreshold:   cfg.HealthCheck.HealthyThreshold,
-			UnhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
+	if listener.Mode == config.ModeHTTP {
+		var routes []handler.Route
+		for _, route := range listener.Routes {
+			name := listener.Name + " " + route.Host + route.PathPrefix
+			group := startUpstreamGroup(cfg, name, listener.HealthCheck, dial, route.Upstream, "")
+			group.listener = listener.Name
+			routes = append(routes, handler.Route{
+				Host:       route.Host,
+				PathPrefix: route.PathPrefix,
+				Handler:    newConnectionHandler(listener.Balancer, group, proxyConfig),
+			})
 		}
-		healthChecker = backend.NewHealthChecker(backendPool, healthCheckConfig)
-		healthChecker.Start()
-		logger.Info("Health checker started")
-	} else {
-		logger.Info("Health checking disabled")
+
+		// ReadHeaderTimeout bounds the whole preamble, so a client dribbling
+		// header bytes cannot hold the connection open indefinitely.
+		server := &http.Server{
+			Handler:           handler.NewHTTPHandler(proxy, routes),
+			ReadHeaderTimeout: cfg.Proxy.HandshakeTimeout,
+			MaxHeaderBytes:    cfg.Proxy.MaxPreambleBytes,
+		}
+		httpServers = append(httpServers, server)
+		logger.Info("Listener %s ready on %s (http mode, %d routes)", listener.Name, listener.Address, len(routes))
+
+		go func() {
+			if err := server.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Listener %s stopped: %s", listener.Name, err)
+			}
+		}()
+		return
 	}
 
-	loadBalancer := balancer.NewRoundRobin(backendPool)
-	proxy := handler.NewConnectionHandler(loadBalancer)
+	logger.Info("Listener %s ready on %s", listener.Name, listener.Address)
 
-	go handleShutdown()
+	go acceptLoop(ln, listener.Name, proxy)
+}
 
-	logger.Info("Load balancer ready on port %s", cfg.Server.Port)
+// acceptLoop hands accepted connections to proxy until ln is closed. Like
+// net/http, it backs off on temporary errors such as running out of file
+// descriptors instead of spinning on them.
+func acceptLoop(ln net.Listener, name string, proxy *handler.ConnectionHandler) {
+	var tempDelay time.Duration
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			logger.Error("Failed to accept connection: %s", err)
-			continue
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if isTemporaryAcceptError(err) {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay = min(tempDelay*2, time.Second)
+				}
+				logger.Error("Listener %s failed to accept connection: %s; retrying in %s", name, err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+
+			logger.Error("Listener %s stopped accepting connections: %s", name, err)
+			return
 		}
 
+		tempDelay = 0
 		go proxy.HandleConnection(conn)
 	}
 }
 
-func handleShutdown() {
+// drainingListener closes connections as soon as they are accepted once a
+// drain has passed its grace period, in both TCP and HTTP mode.
+type drainingListener struct {
+	net.Listener
+}
+
+func (l drainingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !handler.RefusingConnections() {
+			return conn, err
+		}
+		logger.Debug("Refusing connection from %s: draining", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// socketBufferListener sizes the kernel buffers of accepted connections.
+type socketBufferListener struct {
+	net.Listener
+	receive, send int
+}
+
+func (l socketBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		if err := backend.SetSocketBuffers(conn, l.receive, l.send); err != nil {
+			logger.Debug("Failed to size socket buffers for %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+	return conn, err
+}
+
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Temporary()
+}
+
+// handleSignals reloads the health check settings on SIGHUP and shuts down
+// on SIGINT or SIGTERM.
+func handleSignals(configPath string) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	sig := <-sigChan
-	logger.Info("Received signal: %s. Shutting down...", sig)
+	for sig := range sigChan {
+		if sig == syscall.SIGHUP {
+			logger.Info("Received signal: %s. Reloading health check settings...", sig)
+			reloadHealthChecks(configPath)
+			continue
+		}
+
+		logger.Info("Received signal: %s. Shutting down...", sig)
+		shutdown("signal "+sig.String(), exitOK)
+	}
+}
+
+// reloadHealthChecks applies the health_check settings of a fresh read of
+// the configuration to the running health checkers, which keep the state of
+// their backends. Turning health checks on or off, and every other setting,
+// still takes a restart. An invalid configuration changes nothing.
+func reloadHealthChecks(configPath string) {
+	var cfg config.Config
+	if err := config.ParseConfig(&cfg, configPath); err != nil {
+		logger.Error("Reload failed, keeping the current settings: %s", err)
+		return
+	}
+
+	// Everything is built before any checker is touched, so a bad probe
+	// leaves all of them as they were.
+	listenersByName := make(map[string]*config.Listener, len(cfg.Listeners))
+	reloaded := make(map[string]*backend.HealthCheckConfig, len(cfg.Listeners))
+	for _, listener := range cfg.Listeners {
+		listenersByName[listener.Name] = listener
+		if !listener.HealthCheck.Enabled {
+			continue
+		}
+		healthCheckConfig, err := newHealthCheckConfig(listener.HealthCheck)
+		if err != nil {
+			logger.Error("Reload failed, keeping the current settings: listener %s: %s", listener.Name, err)
+			return
+		}
+		reloaded[listener.Name] = healthCheckConfig
+	}
+
+	skipped := make(map[string]bool)
+	for _, group := range upstreamGroups {
+		listener, exists := listenersByName[group.listener]
+		switch {
+		case !exists:
+			logger.Warn("Listener %s is gone from the configuration, restart to remove it", group.listener)
+			skipped[group.listener] = true
+		case (group.healthChecker != nil) != listener.HealthCheck.Enabled:
+			logger.Warn("Turning health checks on or off for listener %s needs a restart", group.listener)
+			skipped[group.listener] = true
+		case group.healthChecker != nil:
+			group.healthChecker.Reconfigure(reloaded[group.listener])
+		}
+	}
+
+	runningConfig = appliedConfig(runningConfig, listenersByName, cfg.HealthCheck, skipped)
+	if adminServer != nil {
+		adminServer.SetConfig(runningConfig)
+	}
+	logger.Info("Health check settings reloaded from %s; other changes take a restart", configPath)
+}
+
+// appliedConfig returns a copy of running with the health_check settings a
+// reload put into effect, so /config reports what is actually running. The
+// top level health_check only changes when no listener was skipped, as
+// listeners that kept their old settings may have inherited it.
+func appliedConfig(running *config.Config, reloaded map[string]*config.Listener, healthCheck *config.HealthCheck, skipped map[string]bool) *config.Config {
+	applied := *running
+	applied.Listeners = make([]*config.Listener, 0, len(running.Listeners))
+	for _, listener := range running.Listeners {
+		copied := *listener
+		if fresh, exists := reloaded[listener.Name]; exists && !skipped[listener.Name] {
+			copied.HealthCheck = fresh.HealthCheck
+		}
+		applied.Listeners = append(applied.Listeners, &copied)
+	}
 
+	if len(skipped) == 0 {
+		applied.HealthCheck = healthCheck
+	}
+	return &applied
+}
+
+// shutdown stops everything that was started and exits with code. The
+// reason ends up in the log so an exit can be traced back to its cause.
+func shutdown(reason string, code int) {
+	logger.Info("Shutting down server, reason: %s", reason)
 	cleanUp()
-	os.Exit(0)
+	logger.Info("Exiting with code %d", code)
+	os.Exit(code)
 }
 
 func cleanUp() {
-	logger.Info("Shutting down server...")
 
-	if healthChecker != nil {
-		healthChecker.Stop()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	// http.Server tracks its own connections: Shutdown closes the idle
+	// keep-alive ones now and the others once their request is answered.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var httpShutdown sync.WaitGroup
+	for _, server := range httpServers {
+		httpShutdown.Add(1)
+		go func(server *http.Server) {
+			defer httpShutdown.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+
+	if adminServer != nil {
+		adminServer.Stop()
 	}
 
-	if backendPool != nil {
-		backendPool.Close()
+	// With the listeners closed no connection comes in any more. Give the
+	// open ones, HTTP requests included, shutdownTimeout to finish, then
+	// cut the stragglers.
+	if !handler.WaitForConnections(shutdownTimeout) {
+		logger.Warn("%d connections still open after %s, closing them", handler.ActiveConnectionCount(), shutdownTimeout)
+		handler.StopRelays()
+		for _, server := range httpServers {
+			server.Close()
+		}
+		handler.WaitForConnections(time.Second)
 	}
+	httpShutdown.Wait()
+
+	for _, group := range upstreamGroups {
+		if group.healthChecker != nil {
+			group.healthChecker.Stop()
+		}
+
+		if group.resolver != nil {
+			group.resolver.Stop()
+		}
+
+		if group.fileWatcher != nil {
+			group.fileWatcher.Stop()
+		}
+
+		if group.affinity != nil {
+			group.affinity.Stop()
+		}
 
-	time.Sleep(1 * time.Second)
+		group.pool.Close()
+	}
 
 	logger.Info("Server shut down successfully.")
 }
 
-func getBackendPool(cfg *config.Config) *backend.Pool {
-	logger.Info("Initializing backend pool with %d upstream servers", len(cfg.Upstream))
+// checkConfig runs the checks that ParseConfig cannot do on its own: every
+// upstream must resolve and health check payloads must be well formed. It
+// logs every problem found and reports whether there were none.
+func checkConfig(cfg *config.Config) bool {
+	ok := true
 
-	if len(cfg.Upstream) == 0 {
-		logger.Fatal("No upstream servers configured")
-		cleanUp()
-		os.Exit(1)
+	for _, listener := range cfg.Listeners {
+		groups := [][]config.Upstream{listener.Upstream}
+		for _, route := range listener.Routes {
+			groups = append(groups, route.Upstream)
+		}
+
+		for _, upstreams := range groups {
+			if len(upstreams) == 0 {
+				logger.Error("Listener %s has an upstream group without servers", listener.Name)
+				ok = false
+			}
+			for _, upstream := range upstreams {
+				if err := checkUpstream(upstream.Address); err != nil {
+					logger.Error("Listener %s: upstream %s: %s", listener.Name, upstream.Address, err)
+					ok = false
+				}
+			}
+		}
+
+		hc := listener.HealthCheck
+		if hc.Enabled {
+			if _, err := backend.NewProbe(hc.Type, probeOptions(hc)); err != nil {
+				logger.Error("Listener %s: invalid %s health check: %s", listener.Name, hc.Type, err)
+				ok = false
+			}
+		}
+	}
+
+	return ok
+}
+
+func checkUpstream(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	logger.Info("Upstream %s resolves to %s", address, strings.Join(addresses, ", "))
+	return nil
+}
+
+func startAdminServer(cfg *config.Config) {
+	groups := make([]admin.Group, 0, len(upstreamGroups))
+	for _, group := range upstreamGroups {
+		groups = append(groups, admin.Group{
+			Name:          group.name,
+			Pool:          group.pool,
+			HealthChecker: group.healthChecker,
+			Balancer:      group.loadBalancer,
+		})
+	}
+
+	adminServer = admin.NewServer(cfg.Admin.Address, groups, cfg)
+	if err := adminServer.Start(); err != nil {
+		logger.Exitf(exitStartupError, "Failed to start admin server on %s: %s", cfg.Admin.Address, err)
+	}
+}
+
+// newConnectionHandler serves one upstream group. When the group is health
+// checked, failing to connect to a backend triggers an immediate check of it.
+func newConnectionHandler(cfg *config.Balancer, group *upstreamGroup, proxyConfig *handler.ProxyConfig) *handler.ConnectionHandler {
+	group.loadBalancer = newLoadBalancer(cfg, group)
+	proxy := handler.NewConnectionHandler(group.loadBalancer, proxyConfig)
+	if group.healthChecker != nil {
+		proxy.SetBackendChecker(group.healthChecker)
+	}
+	return proxy
+}
+
+func newLoadBalancer(cfg *config.Balancer, group *upstreamGroup) balancer.LoadBalancer {
+	lb, err := balancer.New(cfg.Strategy, group.pool, balancer.Options{
+		SlowStart: cfg.SlowStartDuration,
+		Params:    cfg.Params,
+	})
+	if err != nil {
+		logger.Exitf(exitConfigError, "Failed to create %s balancer: %s", cfg.Strategy, err)
+	}
+
+	if cfg.Sticky {
+		return balancer.NewSticky(lb, group.pool)
+	}
+	if cfg.AffinityTTL > 0 {
+		group.affinity = balancer.NewAffinity(lb, group.pool, cfg.AffinityTTL)
+		return group.affinity
 	}
+	return lb
+}
 
-	backendPool := backend.NewBackendPool(cfg.Upstream)
+// dialOptions are the settings a listener applies to every connection made
+// to the backends of its upstream groups.
+type dialOptions struct {
+	tls       *tls.Config
+	localAddr *net.TCPAddr
+}
+
+func newDialOptions(listener *config.Listener) dialOptions {
+	dial := dialOptions{tls: newUpstreamTLSConfig(listener.UpstreamTLS)}
+	if listener.UpstreamSourceAddr != "" {
+		dial.localAddr = &net.TCPAddr{IP: net.ParseIP(listener.UpstreamSourceAddr)}
+	}
+	return dial
+}
+
+// newUpstreamTLSConfig returns nil when connections to the backends stay plain TCP.
+func newUpstreamTLSConfig(cfg *config.UpstreamTLS) *tls.Config {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	tlsConfig, err := backend.NewUpstreamTLSConfig(&backend.UpstreamTLSSettings{
+		ServerName:         cfg.ServerName,
+		CAFile:             cfg.CAFile,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ClientCert:         cfg.ClientCert,
+		ClientKey:          cfg.ClientKey,
+	})
+	if err != nil {
+		logger.Exitf(exitConfigError, "Invalid upstream_tls: %s", err)
+	}
+	return tlsConfig
+}
+
+func newHealthCheckConfig(hc *config.HealthCheck) (*backend.HealthCheckConfig, error) {
+	probe, err := backend.NewProbe(hc.Type, probeOptions(hc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s health check: %w", hc.Type, err)
+	}
+
+	return &backend.HealthCheckConfig{
+		Interval:           hc.Interval,
+		Timeout:            hc.Timeout,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+		WaitForFirstCheck:  hc.WaitForFirstCheck,
+		FlapThreshold:      hc.FlapThreshold,
+		FlapWindow:         hc.FlapWindow,
+		FlapPenalty:        hc.FlapPenalty,
+		SlowThreshold:      hc.SlowThreshold,
+		Concurrency:        hc.Concurrency,
+		Probe:              probe,
+	}, nil
+}
+
+func probeOptions(cfg *config.HealthCheck) backend.ProbeOptions {
+	options := backend.ProbeOptions{
+		Path:    cfg.Path,
+		Service: cfg.Service,
+		Send:    cfg.Send,
+		Expect:  cfg.Expect,
+		Params:  cfg.Params,
+	}
+	if cfg.SourceAddr != "" {
+		options.LocalAddr = &net.TCPAddr{IP: net.ParseIP(cfg.SourceAddr)}
+	}
+	return options
+}
+
+func startUpstreamGroup(cfg *config.Config, name string, hc *config.HealthCheck, dial dialOptions,
+	upstreams []config.Upstream, upstreamFile string) *upstreamGroup {
+	targets := make([]backend.Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		targets = append(targets, backend.Upstream{
+			Address:       upstream.Address,
+			HealthAddress: upstream.HealthAddress,
+			Weight:        upstream.Weight,
+			Priority:      upstream.Priority,
+		})
+	}
+
+	group := &upstreamGroup{name: name, pool: getBackendPool(cfg, targets, dial)}
+	upstreamGroups = append(upstreamGroups, group)
+	handler.PruneRetryMetrics(group.pool)
+
+	if cfg.DNS.Enabled {
+		group.resolver = backend.NewResolver(group.pool, targets, cfg.DNS.RefreshInterval)
+		group.resolver.Start()
+	}
+
+	if upstreamFile != "" {
+		group.fileWatcher = backend.NewUpstreamFileWatcher(group.pool, upstreamFile, targets)
+		group.fileWatcher.Start()
+	}
+
+	if hc.Enabled {
+		healthCheckConfig, err := newHealthCheckConfig(hc)
+		if err != nil {
+			logger.Exitf(exitConfigError, "Listener %s: %s", name, err)
+		}
+		group.healthChecker = backend.NewHealthChecker(group.pool, healthCheckConfig)
+		group.healthChecker.Start()
+		logger.Info("Health checker started")
+
+		if hc.WaitForFirstCheck {
+			if group.healthChecker.WaitForFirstCheck(hc.FirstCheckTimeout) {
+				total, alive := group.pool.GetBackendCount()
+				logger.Info("Initial health check completed: %d/%d backends alive", alive, total)
+			} else {
+				logger.Warn("Initial health check did not finish within %s, accepting traffic anyway", hc.FirstCheckTimeout)
+			}
+		}
+	} else {
+		logger.Info("Health checking disabled")
+	}
+
+	return group
+}
+
+func getBackendPool(cfg *config.Config, upstreams []backend.Upstream, dial dialOptions) *backend.Pool {
+	logger.Info("Initializing backend pool with %d upstream servers", len(upstreams))
+
+	if len(upstreams) == 0 {
+		logger.Exitf(exitConfigError, "No upstream servers configured")
+	}
+
+	poolSettings := &backend.ConnectionPoolSettings{
+		MaxIdle:           cfg.ConnectionPool.MaxIdle,
+		MinIdle:           cfg.ConnectionPool.MinIdle,
+		MaxActive:         cfg.ConnectionPool.MaxActive,
+		IdleTimeout:       cfg.ConnectionPool.IdleTimeout,
+		MaxConnLifetime:   cfg.ConnectionPool.MaxConnLifetime,
+		BlockOnExhaustion: cfg.ConnectionPool.BlockOnExhaustion,
+		MaxWait:           cfg.ConnectionPool.MaxWait,
+		MaxQueue:          cfg.ConnectionPool.MaxQueue,
+		RemovalTimeout:    cfg.ConnectionPool.RemovalTimeout,
+
+		SocketReceiveBuffer: cfg.Proxy.SocketReceiveBuffer,
+		SocketSendBuffer:    cfg.Proxy.SocketSendBuffer,
+
+		TLS:       dial.tls,
+		LocalAddr: dial.localAddr,
+	}
+	if autosize := cfg.ConnectionPool.Autosize; autosize != nil {
+		poolSettings.AutosizeMin = autosize.MinActive
+		poolSettings.AutosizeMax = autosize.MaxActive
+	}
+
+	backendPool := backend.NewBackendPool(upstreams, poolSettings)
 	if backendPool == nil {
-		logger.Fatal("Failed to create backend pool")
-		cleanUp()
-		os.Exit(1)
+		logger.Exitf(exitStartupError, "Failed to create backend pool")
 	}
 
 	total, alive := backendPool.GetBackendCount()
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"zen/config"
+)
+
+func TestAppliedConfig(t *testing.T) {
+	healthCheck := func(interval time.Duration) *config.HealthCheck {
+		return &config.HealthCheck{Enabled: true, Interval: interval}
+	}
+	running := &config.Config{
+		HealthCheck: healthCheck(time.Second),
+		Listeners: []*config.Listener{
+			{Name: "web", HealthCheck: healthCheck(time.Second)},
+			{Name: "db", HealthCheck: healthCheck(time.Second)},
+		},
+	}
+	reloaded := map[string]*config.Listener{
+		"web": {Name: "web", HealthCheck: healthCheck(5 * time.Second)},
+		"db":  {Name: "db", HealthCheck: healthCheck(5 * time.Second)},
+	}
+
+	applied := appliedConfig(running, reloaded, healthCheck(5*time.Second), nil)
+	for _, listener := range applied.Listeners {
+		if listener.HealthCheck.Interval != 5*time.Second {
+			t.Errorf("listener %s: interval %s, want the reloaded 5s", listener.Name, listener.HealthCheck.Interval)
+		}
+	}
+	if applied.HealthCheck.Interval != 5*time.Second {
+		t.Errorf("top level interval %s, want the reloaded 5s", applied.HealthCheck.Interval)
+	}
+	if running.Listeners[0].HealthCheck.Interval != time.Second {
+		t.Error("the running configuration was modified")
+	}
+
+	// A skipped listener keeps reporting the settings it still runs with
+	applied = appliedConfig(running, reloaded, healthCheck(5*time.Second), map[string]bool{"db": true})
+	if got := applied.Listeners[0].HealthCheck.Interval; got != 5*time.Second {
+		t.Errorf("web: interval %s, want 5s", got)
+	}
+	if got := applied.Listeners[1].HealthCheck.Interval; got != time.Second {
+		t.Errorf("skipped db: interval %s, want the running 1s", got)
+	}
+	if got := applied.HealthCheck.Interval; got != time.Second {
+		t.Errorf("top level interval %s with a listener skipped, want the running 1s", got)
+	}
+}
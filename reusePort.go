@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// listen binds a TCP listener. With reusePort set, several processes may
+// bind the same address and the kernel spreads new connections across them.
+func listen(address string, reusePort bool) (net.Listener, error) {
+	if !reusePort {
+		return net.Listen("tcp", address)
+	}
+
+	if !reusePortSupported {
+		return nil, errReusePortUnsupported
+	}
+
+	lc := net.ListenConfig{Control: setReusePort}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,7 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+// soReusePort is SO_REUSEPORT, which the syscall package only defines for
+// some Linux architectures. Every Linux architecture but MIPS uses 15.
+const soReusePort = 0xf
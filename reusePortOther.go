@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "syscall"
+
+const reusePortSupported = false
+
+func setReusePort(network, address string, conn syscall.RawConn) error {
+	return errReusePortUnsupported
+}
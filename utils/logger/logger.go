@@ -5,7 +5,12 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Log levels
@@ -18,15 +23,25 @@ const (
 )
 
 var (
-	mu       sync.Mutex
-	level    = LevelDebug // default
-	debugLog = log.New(os.Stdout, "DEBUG: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
-	infoLog  = log.New(os.Stdout, "INFO:  ", log.LstdFlags|log.Lmicroseconds)
-	warnLog  = log.New(os.Stdout, "WARN:  ", log.LstdFlags|log.Lmicroseconds)
-	errorLog = log.New(os.Stderr, "ERROR: ", log.LstdFlags|log.Lmicroseconds)
-	fatalLog = log.New(os.Stderr, "FATAL: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	mu         sync.Mutex
+	level      = LevelDebug // default
+	timeFormat string       // empty keeps the standard log package timestamp
+	useUTC     bool
+	debugLog   = log.New(os.Stdout, "DEBUG: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	infoLog    = log.New(os.Stdout, "INFO:  ", log.LstdFlags|log.Lmicroseconds)
+	warnLog    = log.New(os.Stdout, "WARN:  ", log.LstdFlags|log.Lmicroseconds)
+	errorLog   = log.New(os.Stderr, "ERROR: ", log.LstdFlags|log.Lmicroseconds)
+	fatalLog   = log.New(os.Stderr, "FATAL: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 )
 
+var (
+	hooksMu   sync.Mutex
+	exitHooks []func()
+)
+
+// Loggers that report the caller's file and line.
+var withCaller = map[*log.Logger]bool{debugLog: true, fatalLog: true}
+
 func SetOutput(w io.Writer) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -37,40 +52,188 @@ func SetOutput(w io.Writer) {
 	fatalLog.SetOutput(w)
 }
 
+// SetOutputFor redirects a single level, e.g. to keep info and debug apart
+// from warn and error output.
+func SetOutputFor(l int, w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch l {
+	case LevelDebug:
+		debugLog.SetOutput(w)
+	case LevelInfo:
+		infoLog.SetOutput(w)
+	case LevelWarn:
+		warnLog.SetOutput(w)
+	case LevelError:
+		errorLog.SetOutput(w)
+	case LevelFatal:
+		fatalLog.SetOutput(w)
+	}
+}
+
+// SetFileOutput sends all log levels to a size-rotated file at path.
+func SetFileOutput(path string, options RotationOptions) error {
+	rf, err := NewRotatingFile(path, options)
+	if err != nil {
+		return err
+	}
+
+	SetOutput(rf)
+	return nil
+}
+
+// ParseLevel turns a level name, debug, info, warn, error or fatal, into
+// the level to pass to SetLevel. Case is ignored.
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "fatal":
+		return LevelFatal, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
 func SetLevel(l int) {
 	mu.Lock()
 	defer mu.Unlock()
 	level = l
 }
 
+// GetLevel returns the current level, so callers can skip building
+// expensive messages that would be filtered out anyway.
+func GetLevel() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return level
+}
+
+// SetTimeFormat renders timestamps of every level with the given time.Format
+// layout, e.g. time.RFC3339. An empty layout restores the default format.
+func SetTimeFormat(layout string) {
+	mu.Lock()
+	defer mu.Unlock()
+	timeFormat = layout
+	applyFlags()
+}
+
+// SetUTC renders timestamps in UTC instead of local time.
+func SetUTC(utc bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	useUTC = utc
+	applyFlags()
+}
+
+// applyFlags must be called with mu held. With a custom time format the
+// timestamp and caller are rendered by output, so the loggers only keep
+// their prefix.
+func applyFlags() {
+	for _, l := range []*log.Logger{debugLog, infoLog, warnLog, errorLog, fatalLog} {
+		if timeFormat != "" {
+			l.SetFlags(0)
+			continue
+		}
+
+		flags := log.LstdFlags | log.Lmicroseconds
+		if withCaller[l] {
+			flags |= log.Lshortfile
+		}
+		if useUTC {
+			flags |= log.LUTC
+		}
+		l.SetFlags(flags)
+	}
+}
+
 func Debug(format string, v ...any) {
 	if level <= LevelDebug {
-		debugLog.Output(2, sprint(format, v...))
+		output(debugLog, sprint(format, v...))
 	}
 }
 
 func Info(format string, v ...any) {
 	if level <= LevelInfo {
-		infoLog.Output(2, sprint(format, v...))
+		output(infoLog, sprint(format, v...))
 	}
 }
 
 func Warn(format string, v ...any) {
 	if level <= LevelWarn {
-		warnLog.Output(2, sprint(format, v...))
+		output(warnLog, sprint(format, v...))
 	}
 }
 
 func Error(format string, v ...any) {
 	if level <= LevelError {
-		errorLog.Output(2, sprint(format, v...))
+		output(errorLog, sprint(format, v...))
 	}
 }
 
+// Fatal logs the message, runs the exit hooks and exits with status 1.
 func Fatal(format string, v ...any) {
-	if level <= LevelFatal {
-		fatalLog.Output(2, sprint(format, v...))
+	output(fatalLog, sprint(format, v...))
+	exit(1)
+}
+
+// Exitf is Fatal with a chosen exit status.
+func Exitf(code int, format string, v ...any) {
+	output(fatalLog, sprint(format, v...))
+	exit(code)
+}
+
+// RegisterExitHook adds a function run by Fatal and Exitf before the process
+// exits, e.g. to close listeners. Hooks run in reverse registration order.
+func RegisterExitHook(hook func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+// exit runs the hooks once; a Fatal from within a hook exits right away.
+func exit(code int) {
+	hooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	hooksMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+	os.Exit(code)
+}
+
+// output writes msg on behalf of the caller of Debug, Info, etc.
+func output(l *log.Logger, msg string) {
+	mu.Lock()
+	layout, utc := timeFormat, useUTC
+	mu.Unlock()
+
+	if layout == "" {
+		l.Output(3, msg)
+		return
+	}
+
+	now := time.Now()
+	if utc {
+		now = now.UTC()
 	}
+
+	line := now.Format(layout) + " "
+	if withCaller[l] {
+		if _, file, lineNo, ok := runtime.Caller(2); ok {
+			line += filepath.Base(file) + ":" + strconv.Itoa(lineNo) + ": "
+		}
+	}
+
+	l.Output(3, line+msg)
 }
 
 func sprint(format string, v ...any) string {
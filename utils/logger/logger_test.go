@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// exitEnv names the variable that makes the test binary run exitInChild
+// instead of the tests, for a subprocess whose exit can be observed.
+const exitEnv = "ZEN_LOGGER_EXIT"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(exitEnv); mode != "" {
+		exitInChild(mode)
+	}
+	os.Exit(m.Run())
+}
+
+// exitInChild registers two hooks and exits the way mode names. Nothing
+// after the exit call may run.
+func exitInChild(mode string) {
+	SetOutput(os.Stdout)
+	RegisterExitHook(func() { fmt.Println("first hook") })
+	RegisterExitHook(func() { fmt.Println("second hook") })
+
+	switch mode {
+	case "fatal":
+		Fatal("fatal %s", "message")
+	case "exitf":
+		Exitf(3, "exitf message")
+	case "nested":
+		RegisterExitHook(func() { Fatal("fatal from a hook") })
+		Fatal("fatal message")
+	}
+	fmt.Println("still running")
+	os.Exit(0)
+}
+
+func runExit(t *testing.T, mode string) (string, int) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), exitEnv+"="+mode)
+	output, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("run child: %s", err)
+	}
+	return string(output), cmd.ProcessState.ExitCode()
+}
+
+func TestFatalRunsHooksAndExits(t *testing.T) {
+	output, code := runExit(t, "fatal")
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if !strings.Contains(output, "fatal message") {
+		t.Errorf("the message was not logged:\n%s", output)
+	}
+	if strings.Contains(output, "still running") {
+		t.Error("execution continued after Fatal")
+	}
+
+	second, first := strings.Index(output, "second hook"), strings.Index(output, "first hook")
+	if second < 0 || first < 0 || second > first {
+		t.Errorf("hooks did not run in reverse registration order:\n%s", output)
+	}
+}
+
+func TestExitfUsesItsCode(t *testing.T) {
+	output, code := runExit(t, "exitf")
+	if code != 3 {
+		t.Errorf("exit code %d, want 3", code)
+	}
+	if !strings.Contains(output, "first hook") || strings.Contains(output, "still running") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+}
+
+func TestFatalInHookExitsAtOnce(t *testing.T) {
+	output, code := runExit(t, "nested")
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if strings.Contains(output, "second hook") || strings.Contains(output, "first hook") {
+		t.Errorf("hooks ran again after a Fatal from a hook:\n%s", output)
+	}
+}
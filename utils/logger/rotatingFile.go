@@ -0,0 +1,139 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+// rename moves the current file aside on rotation; tests replace it.
+var rename = os.Rename
+
+type RotationOptions struct {
+	MaxSizeMB  int // rotate once the file would grow past this size, 0 disables rotation
+	MaxBackups int // rotated files to keep, 0 keeps all
+	MaxAgeDays int // delete rotated files older than this, 0 keeps them regardless of age
+}
+
+// RotatingFile is an io.Writer appending to a file and rotating it by size.
+// Rotated files are renamed to <path>.<timestamp>. It is safe for concurrent
+// use, which matters because all five loggers share the same writer.
+type RotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	options RotationOptions
+	file    *os.File
+	size    int64
+}
+
+func NewRotatingFile(path string, options RotationOptions) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, options: options}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	maxSize := int64(rf.options.MaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > maxSize {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "logger: failed to rotate %s: %s\n", rf.path, err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate must be called with rf.mu held.
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	backup := rf.path + "." + time.Now().Format(backupTimeFormat)
+	if err := rename(rf.path, backup); err != nil {
+		// Keep appending to the current file instead of a closed one; the
+		// next write past the limit tries again.
+		if openErr := rf.open(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.prune()
+	return nil
+}
+
+// prune removes rotated files beyond MaxBackups or older than MaxAgeDays.
+func (rf *RotatingFile) prune() {
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+
+	// The timestamp suffix sorts lexically, newest last
+	sort.Strings(backups)
+
+	cutoff := time.Now().AddDate(0, 0, -rf.options.MaxAgeDays)
+	for i, backup := range backups {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(backup, rf.path+".")); err != nil {
+			continue
+		}
+
+		tooMany := rf.options.MaxBackups > 0 && i < len(backups)-rf.options.MaxBackups
+		tooOld := false
+		if rf.options.MaxAgeDays > 0 {
+			if info, err := os.Stat(backup); err == nil && info.ModTime().Before(cutoff) {
+				tooOld = true
+			}
+		}
+
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
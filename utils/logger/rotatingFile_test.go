@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileKeepsWritingWhenRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zen.log")
+	rf, err := NewRotatingFile(path, RotationOptions{MaxSizeMB: 1})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %s", err)
+	}
+	defer rf.Close()
+
+	rename = func(string, string) error { return errors.New("rename refused") }
+	defer func() { rename = os.Rename }()
+
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 1024+16; i++ {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("write %d after the failed rotation: %s", i, err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log: %s", err)
+	}
+	if want := (1024 + 16) * len(line); len(data) != want {
+		t.Fatalf("log holds %d bytes, want all %d written", len(data), want)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 0 {
+		t.Fatalf("backups %v after every rename failed", backups)
+	}
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zen.log")
+	rf, err := NewRotatingFile(path, RotationOptions{MaxSizeMB: 1})
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %s", err)
+	}
+	defer rf.Close()
+
+	line := strings.Repeat("x", 1023) + "\n"
+	for i := 0; i < 1024+16; i++ {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+	}
+
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Fatalf("backups %v, want one", backups)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(16*len(line)) {
+		t.Fatalf("current file: %v, %v; want the %d bytes written after the rotation", info, err, 16*len(line))
+	}
+}
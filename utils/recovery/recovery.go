@@ -0,0 +1,29 @@
+package recovery
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"zen/utils/logger"
+)
+
+var panics atomic.Uint64
+
+// Recover stops a panic in the calling goroutine from taking the process
+// down. It must be deferred directly: defer recovery.Recover("task").
+func Recover(task string) {
+	if value := recover(); value != nil {
+		Report(task, value)
+	}
+}
+
+// Report logs a recovered panic with its stack and counts it. Use it when
+// the caller recovers itself because it has cleanup to do.
+func Report(task string, value any) {
+	panics.Add(1)
+	logger.Error("Recovered from panic in %s: %v\n%s", task, value, debug.Stack())
+}
+
+// Count returns how many panics have been recovered since startup.
+func Count() uint64 {
+	return panics.Load()
+}
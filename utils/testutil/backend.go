@@ -0,0 +1,127 @@
+// Package testutil provides in-process backends for exercising the relay
+// path and balancers without depending on remote hosts.
+package testutil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend is a TCP server on a loopback port that handles every connection
+// with its handler until closed.
+type Backend struct {
+	listener net.Listener
+	handler  func(net.Conn) (int64, error)
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	accepted atomic.Uint64
+	received atomic.Int64
+}
+
+// NewBackend starts a backend that runs handler on every connection and
+// closes the connection once it returns. handler reports the bytes it read.
+func NewBackend(handler func(net.Conn) (int64, error)) (*Backend, error) {
+	return newBackend(handler)
+}
+
+// NewEchoBackend starts a backend that writes back everything it reads.
+func NewEchoBackend() (*Backend, error) {
+	return newBackend(func(conn net.Conn) (int64, error) {
+		return io.Copy(conn, conn)
+	})
+}
+
+// NewSinkBackend starts a backend that reads and discards everything, for
+// measuring one way throughput.
+func NewSinkBackend() (*Backend, error) {
+	return newBackend(func(conn net.Conn) (int64, error) {
+		return io.Copy(io.Discard, conn)
+	})
+}
+
+func newBackend(handler func(net.Conn) (int64, error)) (*Backend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backend{
+		listener: listener,
+		handler:  handler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+	return b, nil
+}
+
+// Address returns the host:port the backend listens on.
+func (b *Backend) Address() string {
+	return b.listener.Addr().String()
+}
+
+// Accepted returns the number of connections accepted so far.
+func (b *Backend) Accepted() uint64 {
+	return b.accepted.Load()
+}
+
+// Received returns the number of bytes read from finished connections.
+func (b *Backend) Received() int64 {
+	return b.received.Load()
+}
+
+// Close stops accepting, closes every open connection and waits for their
+// handlers to return.
+func (b *Backend) Close() error {
+	err := b.listener.Close()
+
+	b.mu.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return err
+}
+
+func (b *Backend) acceptLoop() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		b.accepted.Add(1)
+		b.mu.Lock()
+		b.conns[conn] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *Backend) serve(conn net.Conn) {
+	defer b.wg.Done()
+
+	n, _ := b.handler(conn)
+	b.received.Add(n)
+
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
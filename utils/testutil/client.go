@@ -0,0 +1,28 @@
+package testutil
+
+import (
+	"io"
+	"net"
+)
+
+// RoundTrip connects to address, sends payload, half-closes the connection
+// and returns everything read back until EOF. Against an echo backend,
+// directly or through the proxy, it returns payload.
+func RoundTrip(address string, payload []byte) ([]byte, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(payload); err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err = tcpConn.CloseWrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.ReadAll(conn)
+}
@@ -0,0 +1,55 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X zen/utils/version.Version=1.4.0 -X zen/utils/version.Commit=$(git rev-parse HEAD) -X zen/utils/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// A build without them falls back to the VCS details Go embeds, if any.
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build info, filling commit and date from the embedded VCS
+// details when they were not stamped.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Date == "" {
+		info.Date = "unknown"
+	}
+	return info
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("zen %s (commit %s, built %s, %s)", i.Version, i.Commit, i.Date, i.GoVersion)
+}